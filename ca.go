@@ -0,0 +1,61 @@
+package main
+
+// unfoldedip (C) 2021 by Jörg Kost, jk@ip-clear.de
+// MIT License
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"unfoldedip/satca"
+)
+
+// caCommand handles the "ca" subcommand for the built-in certificate authority
+func caCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: ca init|issue|revoke [-h]")
+	}
+
+	flags := flag.NewFlagSet("ca "+args[0], flag.ExitOnError)
+	dir := flags.String("dir", "ca", "directory of the certificate authority")
+	name := flags.String("name", "", "name of the agent, the server certificate or the CA")
+	location := flags.String("location", "", "location of the agent, written into the certificate (issue)")
+	server := flags.Bool("server", false, "issue a server certificate for the mTLS listener (issue)")
+	hosts := flags.String("hosts", "localhost,127.0.0.1", "comma separated host names and addresses for server certificates (issue)")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "init":
+		if *name == "" {
+			*name = "unfolded agent CA"
+		}
+		err = satca.Init(*dir, *name)
+		if err == nil {
+			fmt.Println("Created CA in", *dir)
+		}
+	case "issue":
+		if *name == "" {
+			return fmt.Errorf("missing -name")
+		}
+		var certFile, keyFile string
+		certFile, keyFile, err = satca.Issue(*dir, *name, *location, *server, strings.Split(*hosts, ","))
+		if err == nil {
+			fmt.Println("Issued", certFile, keyFile)
+		}
+	case "revoke":
+		if *name == "" {
+			return fmt.Errorf("missing -name")
+		}
+		err = satca.Revoke(*dir, *name)
+		if err == nil {
+			fmt.Println("Revoked", *name, "the server reloads", *dir+string(os.PathSeparator)+satca.CACRL)
+		}
+	default:
+		err = fmt.Errorf("unknown ca command %s", args[0])
+	}
+	return err
+}
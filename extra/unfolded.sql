@@ -4,7 +4,10 @@ CREATE TABLE IF NOT EXISTS "alertgroup"
 		primary key autoincrement,
 	groupname TEXT,
 	emails TEXT,
-	owner_id int
+	owner_id int,
+	digest_seconds integer default 0,
+	daily_summary integer default 0,
+	rotation_id integer default 0
 );
 CREATE TABLE IF NOT EXISTS "satagents"
 (
@@ -13,7 +16,7 @@ CREATE TABLE IF NOT EXISTS "satagents"
 			primary key autoincrement,
 	satagent_name varchar default "something",
 	access_key varchar default "" not null
-, satagent_location varchar default "", lastseen string default "", locationfixed integer default 0);
+, satagent_location varchar default "", lastseen string default "", locationfixed integer default 0, version varchar default "", disabled integer default 0, status varchar default "approved", secret_sent integer default 1, pubkey TEXT default "", protocol integer default 0, os varchar default "", checks varchar default "", health TEXT default "", embedded integer default 0);
 CREATE TABLE IF NOT EXISTS "sessions"
 (
 	csrf string,
@@ -55,4 +58,55 @@ CREATE TABLE IF NOT EXISTS "services"
 	service_tocheck TEXT,
 	service_name text default "",
 	testlocations string default "any"
-, last_seen text default "");
+, last_seen text default "", severity text default "normal", timeout integer default 0);
+CREATE TABLE IF NOT EXISTS "alertgroup_schedules"
+(
+	schedule_id INTEGER not null
+		primary key autoincrement,
+	contact_id INTEGER,
+	email TEXT,
+	timezone TEXT default "UTC",
+	days TEXT default "1,2,3,4,5",
+	start_time TEXT default "08:00",
+	end_time TEXT default "18:00"
+);
+CREATE TABLE IF NOT EXISTS "rotations"
+(
+	rotation_id INTEGER not null
+		primary key autoincrement,
+	owner_id INTEGER,
+	name TEXT,
+	members TEXT,
+	handoff TEXT,
+	length_days INTEGER default 7,
+	timezone TEXT default "UTC"
+);
+CREATE TABLE IF NOT EXISTS "rotation_overrides"
+(
+	override_id INTEGER not null
+		primary key autoincrement,
+	rotation_id INTEGER,
+	email TEXT,
+	start_time TEXT,
+	end_time TEXT
+);
+CREATE TABLE IF NOT EXISTS "enrollment_tokens"
+(
+	token_id INTEGER not null
+		primary key autoincrement,
+	token TEXT not null,
+	created TEXT default CURRENT_TIMESTAMP,
+	used_by TEXT default ""
+);
+CREATE TABLE IF NOT EXISTS "api_tokens"
+(
+	token_id INTEGER not null
+		primary key autoincrement,
+	user_id INTEGER not null,
+	name TEXT not null,
+	token_hash TEXT not null,
+	scope TEXT default "read",
+	expires TEXT default "",
+	created TEXT default CURRENT_TIMESTAMP,
+	last_used TEXT default ""
+);
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"crypto/ed25519"
+	crand "crypto/rand"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/satori/uuid"
+	"hash/fnv"
 	"html/template"
+	"io"
 	"log"
+	"math/big"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 	"unfoldedip/satsql"
@@ -527,7 +535,7 @@ func isLoggedIn(request *http.Request, H sattypes.BaseHandler) (sattypes.Unfolde
 	return U, true
 }
 
-// handle profile page and updates to email and password
+// handle profile page, updates to email and password and the api tokens
 func profile(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
 	var g sattypes.Global
 
@@ -614,15 +622,69 @@ func profile(writer http.ResponseWriter, request *http.Request, H sattypes.BaseH
 			// set to success for template engine
 			g.State = 8
 			g.U = V
+		} else if request.Form.Get("action") == "apitoken" {
+			createAPIToken(request, H, &g)
+		} else if request.Form.Get("action") == "apitokendelete" {
+			tokenID, err := strconv.ParseInt(request.Form.Get("id"), 10, 64)
+			if err == nil {
+				err = satsql.DeleteAPIToken(H, g.U.UserID, tokenID)
+			}
+			if err != nil {
+				log.Println(err)
+				g.Errors = append(g.Errors, "Could not revoke the api token")
+			}
 		}
 	}
 
 	// Default is GET method where we will print out the template
 ExitAndDefault:
+	tokens, err := satsql.ReadAPITokens(H, g.U.UserID)
+	if err != nil {
+		log.Println(err)
+	}
+	g.APITokens = tokens
 	executeGlobalAgainstTemplate(writer, "profile.html", g)
 
 }
 
+// createAPIToken creates an api token from the profile form, the secret is shown only once
+func createAPIToken(request *http.Request, H sattypes.BaseHandler, g *sattypes.Global) {
+	name := strings.TrimSpace(request.Form.Get("name"))
+	if name == "" || len(name) > 64 {
+		g.Errors = append(g.Errors, "The token needs a name of up to 64 characters")
+		return
+	}
+	scope := request.Form.Get("scope")
+	if scope != sattypes.ScopeRead && scope != sattypes.ScopeWrite {
+		g.Errors = append(g.Errors, "Unknown scope "+scope)
+		return
+	}
+	// expiry in days, 0 for a token without expiry
+	days, err := strconv.Atoi(request.Form.Get("expires"))
+	if err != nil || days < 0 || days > 3650 {
+		g.Errors = append(g.Errors, "The expiry must be between 0 and 3650 days")
+		return
+	}
+
+	secret, hash, err := newAPIToken()
+	if err != nil {
+		log.Println(err)
+		g.Errors = append(g.Errors, "Could not create the api token")
+		return
+	}
+	token := sattypes.APIToken{UserID: g.U.UserID, Name: name, TokenHash: hash, Scope: scope}
+	if days > 0 {
+		token.Expires = time.Now().UTC().AddDate(0, 0, days).Format(time.DateTime)
+	}
+	err = satsql.InsertAPIToken(H, token)
+	if err != nil {
+		log.Println(err)
+		g.Errors = append(g.Errors, "Could not create the api token")
+		return
+	}
+	g.Notices = append(g.Notices, "New api token "+name+": "+secret+" - copy it now, it is not shown again")
+}
+
 // logout takes care of the logout process
 func logout(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
 	// read current cookie
@@ -661,12 +723,37 @@ func agentsConfig(writer http.ResponseWriter, request *http.Request, H sattypes.
 	}
 
 	// check agents access key
-	satAgent, allowed := CheckAgentAccessKey(request, H)
+	satAgent, allowed := CheckAgentAccessKey(writer, request, H)
 	if !allowed {
 		writer.WriteHeader(http.StatusForbidden)
 		return
 	}
 
+	// the agent has the current configuration, wait for a change, if it asks for it
+	etag, changed := configETag(satAgent)
+	if request.Header.Get("If-None-Match") == etag {
+		wait, _ := strconv.Atoi(request.Header.Get("agent-wait"))
+		if wait > maxConfigWait {
+			wait = maxConfigWait
+		}
+		if wait > 0 {
+			timer := time.NewTimer(time.Second * time.Duration(wait))
+			select {
+			case <-changed:
+			case <-timer.C:
+			case <-request.Context().Done():
+			}
+			timer.Stop()
+			etag, _ = configETag(satAgent)
+		}
+	}
+	writer.Header().Set("ETag", etag)
+	writer.Header().Set("agent-longpoll", strconv.Itoa(maxConfigWait))
+	if request.Header.Get("If-None-Match") == etag {
+		writer.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	// return matching services from DB
 	dbServices, err := satsql.ReadServices(H, 0, satAgent.SatAgentLocation, satAgent.SatOnlyLocation)
 	if err != nil {
@@ -674,8 +761,16 @@ func agentsConfig(writer http.ResponseWriter, request *http.Request, H sattypes.
 		return
 	}
 
+	// only the check types, the agent can run
+	agentServices := make([]sattypes.Service, 0, len(dbServices))
+	for _, service := range dbServices {
+		if satAgent.CanRun(service.Type) {
+			agentServices = append(agentServices, service)
+		}
+	}
+
 	// new json encoder
-	err = json.NewEncoder(writer).Encode(dbServices)
+	err = json.NewEncoder(writer).Encode(agentServices)
 	if err != nil {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 		return
@@ -685,6 +780,110 @@ func agentsConfig(writer http.ResponseWriter, request *http.Request, H sattypes.
 
 }
 
+// agentsHello takes the version, OS and check types of an agent, before it pulls its configuration
+func agentsHello(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
+
+	// only accept POST
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// check agents access key
+	satAgent, allowed := CheckAgentAccessKey(writer, request, H)
+	if !allowed {
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var hello sattypes.AgentHello
+	err := json.NewDecoder(request.Body).Decode(&hello)
+	if err != nil || hello.Protocol < 1 {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// keep only known check types
+	var checks []string
+	for _, check := range hello.Checks {
+		for _, checkType := range sattypes.CheckTypes {
+			if check == checkType {
+				checks = append(checks, check)
+			}
+		}
+	}
+	hello.Checks = checks
+
+	err = satsql.UpdateAgentHello(H, satAgent.SatAgentID, hello)
+	if err != nil {
+		log.Println(err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if H.Debug {
+		log.Println("Hello of agent", satAgent.SatAgentName, hello)
+	}
+
+	err = json.NewEncoder(writer).Encode(sattypes.ServerHello{Protocol: sattypes.ProtocolVersion, Version: sattypes.Version})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// agentsHeartbeat takes the health of an agent, saves it and passes it to the analytics thread
+func agentsHeartbeat(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
+	received := time.Now()
+
+	// only accept POST
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// check agents access key
+	satAgent, allowed := CheckAgentAccessKey(writer, request, H)
+	if !allowed {
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var health sattypes.AgentHealth
+	err := json.NewDecoder(request.Body).Decode(&health)
+	if err != nil || health.Time.IsZero() {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// the clock of the agent is compared with the arrival of the heartbeat
+	health.ClockOffset = health.Time.Sub(received).Seconds()
+	health.Received = received.UTC()
+
+	err = satsql.UpdateAgentHealth(H, satAgent.SatAgentID, health)
+	if err != nil {
+		log.Println(err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// tell the analytics thread about overloaded agents and skewed clocks, never block the agent
+	select {
+	case sattypes.AgentChannel <- sattypes.AgentSeen{Name: satAgent.SatAgentName, Location: satAgent.SatAgentLocation,
+		Time: received, Health: &health}:
+	default:
+	}
+}
+
+// maximum seconds, an agent may wait for a configuration change
+const maxConfigWait = 120
+
+// configETag returns the ETag of the configuration for an agent and a channel, that is closed on the next change,
+// the services of an agent depend on its location and its check types
+func configETag(satAgent sattypes.SatAgentSql) (string, <-chan struct{}) {
+	version, changed := sattypes.AgentConfig.Current()
+	h := fnv.New32a()
+	_, _ = fmt.Fprintf(h, "%s|%t|%s", satAgent.SatAgentLocation, satAgent.SatOnlyLocation, satAgent.Checks)
+	return fmt.Sprintf("\"%s-%x\"", version, h.Sum32()), changed
+}
+
 // agentsResults takes services results from agents
 func agentsResults(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
 
@@ -695,23 +894,62 @@ func agentsResults(writer http.ResponseWriter, request *http.Request, H sattypes
 	}
 
 	// check agents access key
-	_, allowed := CheckAgentAccessKey(request, H)
+	satAgent, allowed := CheckAgentAccessKey(writer, request, H)
 	if !allowed {
 		writer.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	// Read response and try to parse
+	defer request.Body.Close()
+
+	// Read the batch, the signature covers the raw body
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		log.Println(err)
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = verifyAgentSignature(satAgent, body, request.Header.Get("agent-signature"), H.RequireSigned)
+	if err != nil {
+		log.Println("Refusing results of agent", satAgent.SatAgentName, err)
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// try to parse
 	var agentResults []sattypes.ServiceResult
-	err := json.NewDecoder(request.Body).Decode(&agentResults)
+	err = json.Unmarshal(body, &agentResults)
 	if err != nil {
 		log.Println(err)
 	}
 
-	defer request.Body.Close()
+	// count the results for the agents page
+	agentStatistics.add(satAgent.SatAgentName, len(agentResults))
+
+	// the agent may only report services, that are part of its configuration
+	assigned, err := satsql.ReadServices(H, 0, satAgent.SatAgentLocation, false)
+	if err != nil {
+		log.Println(err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	assignedIDs := make(map[int64]bool, len(assigned))
+	for i := range assigned {
+		if !satAgent.CanRun(assigned[i].Type) {
+			continue
+		}
+		assignedIDs[assigned[i].ServiceID] = true
+	}
 
 	// for every parsed result, ...
 	for i := range agentResults {
+		if !assignedIDs[agentResults[i].ServiceID] {
+			log.Println("Dropping result for unassigned service", agentResults[i].ServiceID, "from agent",
+				satAgent.SatAgentName)
+			continue
+		}
+		// the test node is the authenticated location, not the one claimed in the result
+		agentResults[i].TestNode = satAgent.SatAgentLocation
 		// ... send  result to analytics via golang channel
 		sattypes.ResultsChannel <- agentResults[i]
 	}
@@ -724,71 +962,205 @@ func agentsResults(writer http.ResponseWriter, request *http.Request, H sattypes
 
 }
 
+// verifyAgentSignature checks the Ed25519 signature of a result batch against the registered key of the agent,
+// agents without a key may post unsigned batches, unless signatures are required
+func verifyAgentSignature(agent sattypes.SatAgentSql, body []byte, signature string, required bool) error {
+	if agent.PublicKey == "" {
+		if required {
+			return errors.New("no signing key registered")
+		}
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(agent.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("invalid signing key registered")
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(key, body, sig) {
+		return errors.New("invalid or missing signature")
+	}
+	return nil
+}
+
 // CheckAgentAccessKey retrieves the agent node and key of satagent and tries to match it
-// against a sql entry
-func CheckAgentAccessKey(request *http.Request, H sattypes.BaseHandler) (sattypes.SatAgentSql, bool) {
+// against a sql entry, new agents register with the global key or an enrollment token,
+// the own secret of an approved agent is handed out once in the agent-secret header
+func CheckAgentAccessKey(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) (sattypes.SatAgentSql, bool) {
 	var newAgent bool
 
-	// retrieve access-key from header
+	// retrieve access-key or enrollment token from header
 	accessKey := request.Header.Get("agent-key")
-	if len(accessKey) == 0 {
-		return sattypes.SatAgentSql{}, false
-	}
+	enrollToken := request.Header.Get("agent-token")
 
 	// retrieve agent-name and location from header
 	accessNode := request.Header.Get("agent-name")
 	locationNode := request.Header.Get("agent-location")
 
-	// try to match node in database , if nil == token found
-	switch err := satsql.SearchAgentAccessKey(H, accessNode, accessKey); err {
-	case nil:
-		// accessNode was found, continue
-		log.Println("Matched global server key for", accessKey, accessNode, request.RemoteAddr)
-		break
-	case sql.ErrNoRows:
-		if accessKey != H.SatKey {
-			log.Println("Invalid key for client, stopping operation for", accessNode, request.RemoteAddr)
-			return sattypes.SatAgentSql{}, false
+	// a verified client certificate on the mTLS listener sets name and location
+	certAgent := request.TLS != nil && len(request.TLS.VerifiedChains) > 0
+	if certAgent {
+		subject := request.TLS.VerifiedChains[0][0].Subject
+		accessNode = subject.CommonName
+		if len(subject.OrganizationalUnit) > 0 {
+			locationNode = subject.OrganizationalUnit[0]
 		}
-		// nothing was found, continue to global check
-		break
-	default:
+		enrollToken = ""
+	} else if len(accessKey) == 0 && len(enrollToken) == 0 {
+		return sattypes.SatAgentSql{}, false
+	}
+	if len(accessNode) == 0 {
 		return sattypes.SatAgentSql{}, false
 	}
 
 	satAgent, err := satsql.SelectAgent(H, "satagent_name", accessNode)
-	if err != nil {
-		log.Println("SatAgentSql not known", err)
-		err = nil
+	if err == sql.ErrNoRows {
 		newAgent = true
+	} else if err != nil {
+		log.Println(err)
+		return sattypes.SatAgentSql{}, false
 	}
 
-	if newAgent {
+	switch {
+	case certAgent && newAgent:
+		// the certificate is signed by our CA, the agent is approved with the location of the certificate
+		log.Println("Registering agent with client certificate", accessNode, request.RemoteAddr)
+		satAgent = sattypes.SatAgentSql{SatAgentName: accessNode, SatAgentLocation: locationNode,
+			AccessKey: gensecret(24), Status: sattypes.AgentApproved, SecretSent: true, LocationFixed: true}
+		err = satsql.InsertAgent(H, satAgent)
+		if err != nil {
+			log.Println(err)
+			return sattypes.SatAgentSql{}, false
+		}
+	case certAgent:
+		break
+	case len(enrollToken) != 0 && !newAgent:
+		// tokens enroll new agents only, they never replace the key of a known agent
+		log.Println("Enrollment token for the known agent, stopping operation for", accessNode, request.RemoteAddr)
+		return sattypes.SatAgentSql{}, false
+	case len(enrollToken) != 0:
+		// a valid enrollment token approves the new agent right away
+		if err = satsql.UseEnrollmentToken(H, enrollToken, accessNode); err != nil {
+			log.Println("Invalid enrollment token, stopping operation for", accessNode, request.RemoteAddr)
+			return sattypes.SatAgentSql{}, false
+		}
+		log.Println("Enrolled agent with token", accessNode, request.RemoteAddr)
+		satAgent.SatAgentName = accessNode
+		satAgent.SatAgentLocation = locationNode
+		satAgent.AccessKey = gensecret(24)
+		satAgent.Status = sattypes.AgentApproved
+		satAgent.SecretSent = true
+		satAgent.LocationFixed = true
+		err = satsql.InsertAgent(H, satAgent)
+		if err != nil {
+			log.Println(err)
+			return sattypes.SatAgentSql{}, false
+		}
+		writer.Header().Set("agent-secret", satAgent.AccessKey)
+	case newAgent:
+		// unknown agents need the global key
+		if !H.GlobalKey || accessKey != H.SatKey {
+			log.Println("Invalid key for client, stopping operation for", accessNode, request.RemoteAddr)
+			return sattypes.SatAgentSql{}, false
+		}
+		// the location is fixed at the registration, only admins change it later
+		satAgent = sattypes.SatAgentSql{SatAgentName: accessNode, SatAgentLocation: locationNode,
+			AccessKey: accessKey, Status: sattypes.AgentApproved, SecretSent: true, LocationFixed: true}
+		// in enrollment mode, the agent waits for an approval and gets its own secret
+		if H.EnrollAgents {
+			satAgent.AccessKey = gensecret(24)
+			satAgent.Status = sattypes.AgentPending
+			satAgent.SecretSent = false
+		}
 		if H.Debug {
-			log.Println("Creating SQL entry for sat agent", accessNode, accessKey, locationNode)
+			log.Println("Creating SQL entry for sat agent", accessNode, satAgent.Status, locationNode)
 		}
-		err = satsql.InsertAgent(H, accessNode, accessKey, locationNode)
+		err = satsql.InsertAgent(H, satAgent)
 		if err != nil {
 			log.Println(err)
 			return sattypes.SatAgentSql{}, false
 		}
-		satAgent, err = satsql.SelectAgent(H, "satagent_name", accessNode)
+	case accessKey == satAgent.AccessKey && (accessKey != H.SatKey || H.GlobalKey):
+		// own secret or legacy agent with the global key
+		break
+	case accessKey == H.SatKey && H.GlobalKey && satAgent.Status == sattypes.AgentApproved && !satAgent.SecretSent:
+		// approved agent picks up its own secret with the global key once
+		log.Println("Handing out own secret to agent", accessNode, request.RemoteAddr)
+		satAgent.SecretSent = true
+		err = satsql.UpdateAgent(H, satAgent)
 		if err != nil {
-			log.Println("SatAgentSql still not known", err)
+			log.Println(err)
 			return sattypes.SatAgentSql{}, false
 		}
+		writer.Header().Set("agent-secret", satAgent.AccessKey)
+	default:
+		log.Println("Invalid key for client, stopping operation for", accessNode, request.RemoteAddr)
+		return sattypes.SatAgentSql{}, false
+	}
+
+	// pending agents wait for an approval
+	if satAgent.Status == sattypes.AgentPending {
+		log.Println("Agent is waiting for an approval", accessNode, request.RemoteAddr)
+		return sattypes.SatAgentSql{}, false
+	}
+
+	// disabled agents are refused
+	if satAgent.Disabled {
+		log.Println("Agent is disabled, stopping operation for", accessNode, request.RemoteAddr)
+		return sattypes.SatAgentSql{}, false
+	}
+
+	// reload the agent for its id
+	satAgent, err = satsql.SelectAgent(H, "satagent_name", accessNode)
+	if err != nil {
+		log.Println("SatAgentSql still not known", err)
+		return sattypes.SatAgentSql{}, false
 	}
 
-	err = satsql.UpdateAgentLocation(H, locationNode, satAgent.SatAgentID)
+	err = satsql.UpdateAgentSeen(H, locationNode, request.Header.Get("agent-version"), satAgent.SatAgentID)
 	if err != nil {
 		log.Println(err)
 		return sattypes.SatAgentSql{}, false
 	}
 
+	// register the signing key of the agent on the first contact after the enrollment
+	publicKey := request.Header.Get("agent-pubkey")
+	if satAgent.PublicKey == "" && publicKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(publicKey); err != nil || len(key) != ed25519.PublicKeySize {
+			log.Println("Invalid signing key from agent", accessNode, request.RemoteAddr)
+		} else {
+			log.Println("Registering signing key for agent", accessNode)
+			satAgent.PublicKey = publicKey
+			if err = satsql.UpdateAgent(H, satAgent); err != nil {
+				log.Println(err)
+				return sattypes.SatAgentSql{}, false
+			}
+		}
+	}
+
+	// a fixed location is not changed by the agent
+	if satAgent.LocationFixed {
+		locationNode = satAgent.SatAgentLocation
+	}
+	satAgent.SatAgentLocation = locationNode
+
 	if H.Debug {
 		log.Println("Allowing access to satagent-node", accessNode)
 	}
 
+	// self-metrics of the worker pool of the agent
+	if stats := request.Header.Get("agent-stats"); stats != "" {
+		var pool sattypes.AgentPoolStats
+		if err = json.Unmarshal([]byte(stats), &pool); err == nil {
+			agentStatistics.setPool(accessNode, pool)
+		}
+	}
+
+	// tell the analytics thread, that the agent is alive, never block the agent
+	select {
+	case sattypes.AgentChannel <- sattypes.AgentSeen{Name: accessNode, Location: locationNode, Time: time.Now()}:
+	default:
+	}
+
 	// check if only location is set for this host
 	onlyLocation := request.Header.Get("agent-onlylocation")
 	if onlyLocation != "" && onlyLocation == "YES" {
@@ -798,17 +1170,32 @@ func CheckAgentAccessKey(request *http.Request, H sattypes.BaseHandler) (sattype
 	return satAgent, true
 }
 
-// CheckCSRFToken check CSRF token from a form against expected CSRF from the usersession
+// CheckCSRFToken check CSRF token from a form or the X-CSRF-Token header against expected CSRF from the usersession,
+// api requests authenticated by an api token pass without
 func CheckCSRFToken(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler, US sattypes.Session) bool {
-	// check csrf against current session
-	if request.FormValue("csrf") != US.CSRF {
+	// browsers don't send api tokens on their own, so api requests with a token can't be forged
+	api := strings.HasPrefix(request.URL.Path, "/api/")
+	if _, ok := request.Context().Value(apiTokenKey{}).(sattypes.APIToken); ok && api {
+		return true
+	}
+
+	// check csrf against current session, api clients send it in a header
+	csrf := request.FormValue("csrf")
+	if csrf == "" {
+		csrf = request.Header.Get("X-CSRF-Token")
+	}
+	if csrf != US.CSRF {
 		log.Println("CSRF is wrong, shall be", US.CSRF)
-		writer.WriteHeader(http.StatusForbidden)
+		if api {
+			apiFail(writer, http.StatusForbidden, "csrf token is missing or wrong")
+		} else {
+			writer.WriteHeader(http.StatusForbidden)
+		}
 		return false
 	}
 
 	if H.Debug {
-		log.Println("CSRF is right", US.CSRF, request.FormValue("csrf"))
+		log.Println("CSRF is right", US.CSRF, csrf)
 	}
 
 	return true
@@ -824,3 +1211,20 @@ func genrandom(length int) string {
 	}
 	return tempString.String()
 }
+
+// gensecret returns a random string from crypto/rand for agent keys, secrets and enrollment tokens,
+// unlike genrandom it can not be predicted from the time of the call
+func gensecret(length int) string {
+	charAndSpecial := []rune("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789")
+	max := big.NewInt(int64(len(charAndSpecial)))
+	var tempString strings.Builder
+	for i := 0; i < length; i++ {
+		n, err := crand.Int(crand.Reader, max)
+		if err != nil {
+			// without randomness no secret can be created
+			panic(err)
+		}
+		tempString.WriteRune(charAndSpecial[n.Int64()])
+	}
+	return tempString.String()
+}
@@ -5,11 +5,15 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"unfoldedip/satsql"
 	"unfoldedip/sattypes"
 )
 
+// for hardcoded aggregation windows
+var allowedDigests = []int{0, 30, 60, 120, 300, 600}
+
 // handle contacts and contact groups
 func alertgroups(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
 	var g sattypes.Global
@@ -114,6 +118,9 @@ func alertgroupAdd(writer http.ResponseWriter, request *http.Request, H sattypes
 	expectedVars := []string{
 		"groupname",
 		"emails",
+		"digestseconds",
+		"dailysummary",
+		"rotation",
 	}
 
 	// handle POST
@@ -175,16 +182,41 @@ func alertgroupAdd(writer http.ResponseWriter, request *http.Request, H sattypes
 					return arg
 				}(formValue)
 			case "emails":
-				newContact.Emails = func(arg string) string {
-					if len(arg) == 0 {
-						g.Errors = append(g.Errors, "Email addresses cant be count of zero")
-						return ""
+				newContact.Emails = formValue
+			case "digestseconds":
+				newContact.DigestSeconds = func(arg string) int {
+					val, err := strconv.Atoi(arg)
+					if err == nil {
+						for i := range allowedDigests {
+							if allowedDigests[i] == val {
+								return val
+							}
+						}
 					}
-					return arg
+					return 0
+				}(formValue)
+			case "dailysummary":
+				newContact.DailySummary = formValue == "1"
+			case "rotation":
+				newContact.RotationID = func(arg string) int64 {
+					if arg == "" || arg == "0" {
+						return 0
+					}
+					rotation, ok := ownRotation(H, arg, g.U.UserID)
+					if !ok {
+						g.Errors = append(g.Errors, "Wrong on-call rotation")
+						return 0
+					}
+					return rotation.RotationID
 				}(formValue)
 			}
 		}
 
+		// a group needs recipients, either emails or an on-call rotation
+		if newContact.Emails == "" && newContact.RotationID == 0 {
+			g.Errors = append(g.Errors, "Email addresses cant be count of zero without an on-call rotation")
+		}
+
 		// add userid to service for db insert
 		newContact.OwnerID = g.U.UserID
 
@@ -225,13 +257,162 @@ func alertgroupAdd(writer http.ResponseWriter, request *http.Request, H sattypes
 				// tell the template function, that we want to edit
 				// so it renders the right information
 				g.NextFunction = "edit"
+				// load the notification schedules of the members
+				g.Schedules, err = satsql.ReadNotificationSchedules(H, editContact.ContactID)
+				if err != nil {
+					log.Println(err)
+				}
 			}
 			// else do nothing...
 		}
 	}
 
 DefaultAndExit:
+	// load the rotations for the on-call select
+	g.Rotations = userRotations(H, g.U.UserID)
+	// Pass some defaults down the template
+	g.AllowedDigests = allowedDigests
 	// Default is GET method where we will print out the template
 	executeGlobalAgainstTemplate(writer, "alertgroup_add.html", g)
 
 }
+
+// adding a notification schedule for a member of an alert group
+func alertgroupScheduleAdd(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
+	// local variables
+	var g sattypes.Global
+	var err error
+	var group sattypes.AlertGroup
+	var newSchedule sattypes.NotificationSchedule
+
+	// retrieve session
+	if g.U, g.U.LoggedIn = isLoggedIn(request, H); !g.U.LoggedIn {
+		http.Redirect(writer, request, "/login?session=expired7", http.StatusSeeOther)
+		return
+	}
+
+	// only POST is allowed
+	if request.Method != http.MethodPost {
+		http.Redirect(writer, request, "/alertgroups", http.StatusSeeOther)
+		return
+	}
+
+	// Parse form arguments
+	err = request.ParseForm()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// check if csrf token is valid
+	if !CheckCSRFToken(writer, request, H, g.U.UserSession) {
+		return
+	}
+
+	// retrieve group by contact id and check the owner
+	group, err = satsql.SelectAlertGroup(H, "contact_id", request.FormValue("id"))
+	if err != nil || group.OwnerID != g.U.UserID {
+		if H.Debug {
+			log.Println("Not allowing access for schedule add or contact not existing")
+		}
+		http.Redirect(writer, request, "/alertgroups", http.StatusSeeOther)
+		return
+	}
+
+	newSchedule = sattypes.NotificationSchedule{
+		ContactID: group.ContactID,
+		Email:     strings.TrimSpace(request.FormValue("email")),
+		TimeZone:  strings.TrimSpace(request.FormValue("timezone")),
+		Days:      strings.Join(request.Form["days"], ","),
+		Start:     request.FormValue("start"),
+		End:       request.FormValue("end"),
+	}
+
+	// the schedule must belong to a member of the group
+	err = newSchedule.Validate()
+	if err == nil && !strings.Contains(","+strings.ReplaceAll(group.Emails, " ", "")+",", ","+newSchedule.Email+",") {
+		err = fmt.Errorf("%s is not a member of the alert group", newSchedule.Email)
+	}
+
+	if err != nil {
+		g.Errors = append(g.Errors, err.Error())
+	} else if err = satsql.InsertNotificationSchedule(H, &newSchedule); err != nil {
+		log.Println(err)
+		g.Errors = append(g.Errors, "Could not save the schedule")
+	} else {
+		http.Redirect(writer, request, fmt.Sprintf("/alertgroup_edit?id=%d", group.ContactID), http.StatusSeeOther)
+		return
+	}
+
+	// render the edit page again with the errors
+	g.AlertGroup = group
+	g.NextFunction = "edit"
+	g.AllowedDigests = allowedDigests
+	g.Rotations = userRotations(H, g.U.UserID)
+	g.Schedules, err = satsql.ReadNotificationSchedules(H, group.ContactID)
+	if err != nil {
+		log.Println(err)
+	}
+	executeGlobalAgainstTemplate(writer, "alertgroup_add.html", g)
+}
+
+// handle delete notification schedule (will be called by ajax query)
+func alertgroupScheduleDelete(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
+	// local variables
+	var g sattypes.Global
+	var group sattypes.AlertGroup
+	var scheduleID int64
+	var err error
+
+	// retrieve session
+	if g.U, g.U.LoggedIn = isLoggedIn(request, H); !g.U.LoggedIn {
+		http.Redirect(writer, request, "/login?session=expired5", http.StatusSeeOther)
+		return
+	}
+
+	// Delete method?  Else,  we will return
+	if request.Method != http.MethodPost {
+		goto DefaultAndExit
+	}
+
+	/* read params form */
+	err = request.ParseForm()
+	if err != nil {
+		log.Println(err)
+		goto DefaultAndExit
+	}
+
+	// check if csrf token is valid
+	if !CheckCSRFToken(writer, request, H, g.U.UserSession) {
+		return
+	}
+
+	// read schedule id
+	scheduleID, err = strconv.ParseInt(request.FormValue("scheduleid"), 10, 64)
+	if err != nil {
+		log.Println("No id for schedule deletion")
+		goto DefaultAndExit
+	}
+
+	// retrieve group by groupid
+	group, err = satsql.SelectAlertGroup(H, "contact_id", request.FormValue("id"))
+
+	// group exists and owner is current user, then delete
+	if err == nil && group.OwnerID == g.U.UserID {
+		if H.Debug {
+			log.Println("Deleting schedule", scheduleID, "of alertgroup", group.ContactID)
+		}
+		err := satsql.DeleteNotificationSchedule(H, group.ContactID, scheduleID)
+		if err != nil {
+			log.Println(err)
+			goto DefaultAndExit
+		}
+		writer.WriteHeader(http.StatusOK)
+		return
+	}
+
+	/* return no content by default */
+DefaultAndExit:
+	writer.WriteHeader(http.StatusNoContent)
+	return
+}
@@ -0,0 +1,808 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unfoldedip/satsql"
+	"unfoldedip/sattypes"
+)
+
+// default and maximum number of items per page
+const (
+	apiPerPage    = 50
+	apiMaxPerPage = 500
+)
+
+// apiError is the error object of all failed api requests
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	// Details lists the invalid fields of a service or an alert group
+	Details []string `json:"details,omitempty"`
+}
+
+// apiItem wraps a single object
+type apiItem struct {
+	Data any `json:"data"`
+}
+
+// apiList wraps a page of a list
+type apiList struct {
+	Data    any `json:"data"`
+	Page    int `json:"page"`
+	PerPage int `json:"per_page"`
+	Total   int `json:"total"`
+}
+
+// apiServiceState is the current state of a service
+type apiServiceState struct {
+	ServiceID int64  `json:"serviceid"`
+	Name      string `json:"name"`
+	State     string `json:"servicestate"`
+	LastEvent string `json:"lastevent"`
+}
+
+// apiAgent is an agent without its keys
+type apiAgent struct {
+	Name     string               `json:"name"`
+	Location string               `json:"location"`
+	LastSeen string               `json:"lastseen"`
+	Version  string               `json:"version"`
+	Protocol int                  `json:"protocol"`
+	OS       string               `json:"os"`
+	Checks   string               `json:"checks"`
+	Status   string               `json:"status"`
+	Disabled bool                 `json:"disabled"`
+	Health   sattypes.AgentHealth `json:"health"`
+}
+
+// apiTokenKey holds the api token of a request authenticated by a token in the request context
+type apiTokenKey struct{}
+
+// api handles the JSON api below /api/v1/ for the logged in user or the owner of an api token
+func api(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
+	// the description of the api is public
+	if request.URL.Path == "/api/v1/openapi.json" {
+		apiOpenAPI(writer, request, H)
+		return
+	}
+
+	var user sattypes.UnfoldedUser
+	var ok bool
+	if bearer, isToken := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer "); isToken {
+		var token sattypes.APIToken
+		user, token, ok = apiTokenUser(H, bearer)
+		if !ok {
+			apiFail(writer, http.StatusUnauthorized, "invalid or expired token")
+			return
+		}
+		if token.Scope != sattypes.ScopeWrite && request.Method != http.MethodGet && request.Method != http.MethodHead {
+			apiFail(writer, http.StatusForbidden, "token is read-only")
+			return
+		}
+		request = request.WithContext(context.WithValue(request.Context(), apiTokenKey{}, token))
+	} else {
+		user, ok = isLoggedIn(request, H)
+		if !ok {
+			apiFail(writer, http.StatusUnauthorized, "not logged in")
+			return
+		}
+		// scripts using the session cookie send the csrf token back in the X-CSRF-Token header
+		writer.Header().Set("X-CSRF-Token", user.UserSession.CSRF)
+	}
+
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		// browsers can't send JSON to other sites without asking first
+		if request.Method == http.MethodPost || request.Method == http.MethodPut {
+			mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				apiFail(writer, http.StatusUnsupportedMediaType, "content type must be application/json")
+				return
+			}
+		}
+		// check if csrf token is valid, requests with an api token don't need one
+		if !CheckCSRFToken(writer, request, H, user.UserSession) {
+			return
+		}
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(request.URL.Path, "/api/v1/"), "/"), "/")
+	switch path[0] {
+	case "services":
+		apiServices(writer, request, H, user, path[1:])
+	case "alertgroups":
+		apiAlertGroups(writer, request, H, user, path[1:])
+	case "logs":
+		if len(path) > 1 {
+			apiFail(writer, http.StatusNotFound, "not found")
+			return
+		}
+		apiLogs(writer, request, H, user, 0)
+	case "states":
+		if len(path) > 1 {
+			apiFail(writer, http.StatusNotFound, "not found")
+			return
+		}
+		apiStates(writer, request, H, user)
+	case "locations":
+		if len(path) > 1 {
+			apiFail(writer, http.StatusNotFound, "not found")
+			return
+		}
+		apiLocations(writer, request, H)
+	case "agents":
+		if len(path) > 1 {
+			apiFail(writer, http.StatusNotFound, "not found")
+			return
+		}
+		apiAgents(writer, request, H, user)
+	default:
+		apiFail(writer, http.StatusNotFound, "not found")
+	}
+}
+
+// apiServices lists and creates services, and reads, updates and deletes a service of the user
+func apiServices(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler, user sattypes.UnfoldedUser, path []string) {
+	if len(path) == 0 {
+		switch request.Method {
+		case http.MethodGet:
+			apiListServices(writer, request, H, user)
+		case http.MethodPost:
+			var service sattypes.Service
+			if !apiDecode(writer, request, &service) {
+				return
+			}
+			service.ServiceID = 0
+			apiSaveService(writer, H, user, service)
+		default:
+			apiFail(writer, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	// the same ownership check as for editing and deleting services in the web panel
+	service, err := satsql.SelectService(H, "service_id", path[0], user.UserID)
+	if err != nil || service.OwnerID != user.UserID {
+		if err != nil && err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		apiFail(writer, http.StatusNotFound, "service not found")
+		return
+	}
+
+	// logs of the service
+	if len(path) == 2 && path[1] == "logs" {
+		apiLogs(writer, request, H, user, service.ServiceID)
+		return
+	}
+	if len(path) > 1 {
+		apiFail(writer, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		apiJSON(writer, http.StatusOK, apiItem{Data: apiService(service)})
+	case http.MethodPut:
+		// fields, that are not sent, keep their value
+		changed := service
+		if !apiDecode(writer, request, &changed) {
+			return
+		}
+		changed.ServiceID = service.ServiceID
+		apiSaveService(writer, H, user, changed)
+	case http.MethodDelete:
+		if H.Debug {
+			log.Println("Deleting service", service.ServiceID)
+		}
+		err = satsql.DeleteService(H, service.ServiceID)
+		if err == nil {
+			err = satsql.DeleteServiceLogs(H, service.ServiceID)
+		}
+		if err != nil {
+			log.Println(err)
+			apiFail(writer, http.StatusInternalServerError, "could not delete the service")
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		apiFail(writer, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// apiListServices lists the services of the user, filtered by state and type
+func apiListServices(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler, user sattypes.UnfoldedUser) {
+	page, perPage, ok := apiPage(writer, request)
+	if !ok {
+		return
+	}
+	state, ok := apiStateFilter(writer, request)
+	if !ok {
+		return
+	}
+	checkType := request.URL.Query().Get("type")
+
+	services, err := satsql.ReadServices(H, user.UserID, "", false)
+	if err != nil {
+		log.Println(err)
+		apiFail(writer, http.StatusInternalServerError, "could not read the services")
+		return
+	}
+	selected := []sattypes.Service{}
+	for _, service := range services {
+		service = apiService(service)
+		if (state == "" || service.ServiceState == state) && (checkType == "" || service.Type == checkType) {
+			selected = append(selected, service)
+		}
+	}
+
+	start, end := apiBounds(len(selected), page, perPage)
+	apiJSON(writer, http.StatusOK, apiList{Data: selected[start:end], Page: page, PerPage: perPage, Total: len(selected)})
+}
+
+// apiSaveService validates and inserts or updates a service of the user
+func apiSaveService(writer http.ResponseWriter, H sattypes.BaseHandler, user sattypes.UnfoldedUser, service sattypes.Service) {
+	service.OwnerID = user.UserID
+	if details := validateService(H, user.UserID, &service); len(details) > 0 {
+		apiFail(writer, http.StatusUnprocessableEntity, "invalid service", details...)
+		return
+	}
+
+	status := http.StatusOK
+	var err error
+	if service.ServiceID != 0 {
+		if H.Debug {
+			log.Println("Updating service", service.ServiceID)
+		}
+		err = satsql.UpdateService(H, &service)
+	} else {
+		status = http.StatusCreated
+		err = satsql.InsertService(H, &service)
+	}
+	if err != nil {
+		log.Println("SQL error", err)
+		apiFail(writer, http.StatusInternalServerError, "could not save the service")
+		return
+	}
+
+	saved, err := satsql.SelectService(H, "service_id", strconv.FormatInt(service.ServiceID, 10), user.UserID)
+	if err != nil {
+		log.Println(err)
+		apiFail(writer, http.StatusInternalServerError, "could not read the service")
+		return
+	}
+	if status == http.StatusCreated {
+		writer.Header().Set("Location", fmt.Sprintf("/api/v1/services/%d", saved.ServiceID))
+	}
+	apiJSON(writer, status, apiItem{Data: apiService(saved)})
+}
+
+// apiService returns the service with SERVICE_UNKNOWN for services without results
+func apiService(service sattypes.Service) sattypes.Service {
+	if service.ServiceState != sattypes.ServiceUP && service.ServiceState != sattypes.ServiceDown {
+		service.ServiceState = sattypes.ServiceUnknown
+	}
+	return service
+}
+
+// validateService checks and completes a service like the form of the web panel, returns the invalid fields
+func validateService(H sattypes.BaseHandler, userID int64, service *sattypes.Service) []string {
+	var details []string
+
+	service.Name = strings.TrimSpace(service.Name)
+	if service.Name == "" {
+		details = append(details, "name: please enter a service name for identification")
+	}
+
+	knownType := false
+	for _, checkType := range sattypes.CheckTypes {
+		knownType = knownType || service.Type == checkType
+	}
+	if !knownType {
+		details = append(details, "type: must be one of "+strings.Join(sattypes.CheckTypes, ", "))
+	}
+
+	service.ToCheck = strings.TrimSpace(service.ToCheck)
+	if service.ToCheck == "" {
+		details = append(details, "tocheck: no hostname, url or host and port given")
+	} else if service.Type == "http" {
+		target, err := url.ParseRequestURI(service.ToCheck)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			details = append(details, "tocheck: invalid url")
+		}
+	}
+
+	// services without an interval are checked every 90 seconds like in the web panel
+	if service.Interval == 0 {
+		service.Interval = 90
+	}
+	validInterval := false
+	for _, interval := range allowedIntervals {
+		validInterval = validInterval || service.Interval == interval
+	}
+	if !validInterval {
+		details = append(details, fmt.Sprintf("interval: must be one of %v seconds", allowedIntervals))
+	}
+
+	if service.Timeout < 0 || service.Timeout > sattypes.MaxTimeout {
+		details = append(details, fmt.Sprintf("timeout: must be between 1 and %d seconds, 0 for the default", sattypes.MaxTimeout))
+	}
+
+	if service.ContactGroup != 0 {
+		group, err := satsql.SelectAlertGroup(H, "contact_id", strconv.Itoa(service.ContactGroup))
+		if err != nil || group.OwnerID != userID {
+			if err != nil && err != sql.ErrNoRows {
+				log.Println(err)
+			}
+			details = append(details, "contactgroup: wrong alert group")
+		}
+	}
+
+	if service.Severity == "" {
+		service.Severity = sattypes.SeverityNormal
+	}
+	if service.Severity != sattypes.SeverityNormal && service.Severity != sattypes.SeverityCritical {
+		details = append(details, fmt.Sprintf("severity: must be %s or %s", sattypes.SeverityNormal, sattypes.SeverityCritical))
+	}
+
+	// locations are separated by spaces, no location means any
+	service.Locations = strings.Join(strings.Fields(service.Locations), " ")
+	if service.Locations == "" {
+		service.Locations = "any"
+	}
+
+	return details
+}
+
+// apiAlertGroups lists and creates alert groups, and reads, updates and deletes an alert group of the user
+func apiAlertGroups(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler, user sattypes.UnfoldedUser, path []string) {
+	if len(path) == 0 {
+		switch request.Method {
+		case http.MethodGet:
+			page, perPage, ok := apiPage(writer, request)
+			if !ok {
+				return
+			}
+			groups, err := satsql.ReadAlertGroups(H, user.UserID)
+			if err != nil {
+				log.Println(err)
+				apiFail(writer, http.StatusInternalServerError, "could not read the alert groups")
+				return
+			}
+			if groups == nil {
+				groups = []sattypes.AlertGroup{}
+			}
+			start, end := apiBounds(len(groups), page, perPage)
+			apiJSON(writer, http.StatusOK, apiList{Data: groups[start:end], Page: page, PerPage: perPage, Total: len(groups)})
+		case http.MethodPost:
+			var group sattypes.AlertGroup
+			if !apiDecode(writer, request, &group) {
+				return
+			}
+			group.ContactID = 0
+			apiSaveAlertGroup(writer, H, user, group)
+		default:
+			apiFail(writer, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	// the same ownership check as for editing and deleting alert groups in the web panel
+	group, err := satsql.SelectAlertGroup(H, "contact_id", path[0])
+	if err != nil || group.OwnerID != user.UserID || len(path) > 1 {
+		if err != nil && err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		apiFail(writer, http.StatusNotFound, "alert group not found")
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		apiJSON(writer, http.StatusOK, apiItem{Data: group})
+	case http.MethodPut:
+		// fields, that are not sent, keep their value
+		changed := group
+		if !apiDecode(writer, request, &changed) {
+			return
+		}
+		changed.ContactID = group.ContactID
+		apiSaveAlertGroup(writer, H, user, changed)
+	case http.MethodDelete:
+		if H.Debug {
+			log.Println("Deleting alertgroup", group.ContactID)
+		}
+		err = satsql.DeleteAlertGroup(H, group.ContactID)
+		if err != nil {
+			log.Println(err)
+			apiFail(writer, http.StatusInternalServerError, "could not delete the alert group")
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		apiFail(writer, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// apiSaveAlertGroup validates and inserts or updates an alert group of the user
+func apiSaveAlertGroup(writer http.ResponseWriter, H sattypes.BaseHandler, user sattypes.UnfoldedUser, group sattypes.AlertGroup) {
+	group.OwnerID = user.UserID
+	if details := validateAlertGroup(H, user.UserID, &group); len(details) > 0 {
+		apiFail(writer, http.StatusUnprocessableEntity, "invalid alert group", details...)
+		return
+	}
+
+	status := http.StatusOK
+	var err error
+	if group.ContactID != 0 {
+		if H.Debug {
+			log.Println("Updating contact", group.ContactID)
+		}
+		err = satsql.UpdateAlertGroup(H, &group)
+	} else {
+		status = http.StatusCreated
+		err = satsql.InsertAlertGroup(H, &group)
+	}
+	if err != nil {
+		log.Println("SQL error", err)
+		apiFail(writer, http.StatusInternalServerError, "could not save the alert group")
+		return
+	}
+
+	saved, err := satsql.SelectAlertGroup(H, "contact_id", strconv.FormatInt(group.ContactID, 10))
+	if err != nil {
+		log.Println(err)
+		apiFail(writer, http.StatusInternalServerError, "could not read the alert group")
+		return
+	}
+	if status == http.StatusCreated {
+		writer.Header().Set("Location", fmt.Sprintf("/api/v1/alertgroups/%d", saved.ContactID))
+	}
+	apiJSON(writer, status, apiItem{Data: saved})
+}
+
+// validateAlertGroup checks an alert group like the form of the web panel, returns the invalid fields
+func validateAlertGroup(H sattypes.BaseHandler, userID int64, group *sattypes.AlertGroup) []string {
+	var details []string
+
+	group.GroupName = strings.TrimSpace(group.GroupName)
+	if group.GroupName == "" {
+		details = append(details, "groupname: group name cant be zero")
+	}
+
+	var emails []string
+	for _, email := range strings.Split(group.Emails, ",") {
+		email = strings.TrimSpace(email)
+		if email == "" {
+			continue
+		}
+		if _, err := mail.ParseAddress(email); err != nil {
+			details = append(details, "emails: invalid address "+email)
+		}
+		emails = append(emails, email)
+	}
+	group.Emails = strings.Join(emails, ",")
+
+	validDigest := false
+	for _, digest := range allowedDigests {
+		validDigest = validDigest || group.DigestSeconds == digest
+	}
+	if !validDigest {
+		details = append(details, fmt.Sprintf("digestseconds: must be one of %v seconds", allowedDigests))
+	}
+
+	if group.RotationID != 0 {
+		if _, ok := ownRotation(H, strconv.FormatInt(group.RotationID, 10), userID); !ok {
+			details = append(details, "rotationid: wrong on-call rotation")
+		}
+	}
+
+	// a group needs recipients, either emails or an on-call rotation
+	if group.Emails == "" && group.RotationID == 0 {
+		details = append(details, "emails: email addresses cant be count of zero without an on-call rotation")
+	}
+
+	return details
+}
+
+// apiLogs lists the state changes of the services of the user, or of a single service,
+// filtered by service, new state and time
+func apiLogs(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler, user sattypes.UnfoldedUser, serviceID int64) {
+	if request.Method != http.MethodGet {
+		apiFail(writer, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	page, perPage, ok := apiPage(writer, request)
+	if !ok {
+		return
+	}
+
+	query := request.URL.Query()
+	filter := sattypes.LogFilter{OwnerID: user.UserID, ServiceID: serviceID, Limit: perPage, Offset: (page - 1) * perPage}
+	if value := query.Get("service"); value != "" && serviceID == 0 {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			apiFail(writer, http.StatusBadRequest, "invalid service")
+			return
+		}
+		filter.ServiceID = id
+	}
+	switch state := strings.ToUpper(query.Get("state")); state {
+	case "", "UP", "DOWN":
+		filter.State = state
+	default:
+		apiFail(writer, http.StatusBadRequest, "state must be up or down")
+		return
+	}
+	var err error
+	if filter.Since, err = apiTime(query.Get("since")); err != nil {
+		apiFail(writer, http.StatusBadRequest, "invalid since, use RFC 3339 or YYYY-MM-DD")
+		return
+	}
+	if filter.Until, err = apiTime(query.Get("until")); err != nil {
+		apiFail(writer, http.StatusBadRequest, "invalid until, use RFC 3339 or YYYY-MM-DD")
+		return
+	}
+
+	logs, total, err := satsql.ReadFilteredServicesLog(H, filter)
+	if err != nil {
+		log.Println(err)
+		apiFail(writer, http.StatusInternalServerError, "could not read the logs")
+		return
+	}
+	if logs == nil {
+		logs = []sattypes.ServiceLog{}
+	}
+	apiJSON(writer, http.StatusOK, apiList{Data: logs, Page: page, PerPage: perPage, Total: total})
+}
+
+// apiStates lists the current states of the services of the user, filtered by state
+func apiStates(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler, user sattypes.UnfoldedUser) {
+	if request.Method != http.MethodGet {
+		apiFail(writer, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	page, perPage, ok := apiPage(writer, request)
+	if !ok {
+		return
+	}
+	state, ok := apiStateFilter(writer, request)
+	if !ok {
+		return
+	}
+
+	services, err := satsql.ReadServices(H, user.UserID, "", false)
+	if err != nil {
+		log.Println(err)
+		apiFail(writer, http.StatusInternalServerError, "could not read the services")
+		return
+	}
+	states := []apiServiceState{}
+	for _, service := range services {
+		service = apiService(service)
+		if state == "" || service.ServiceState == state {
+			states = append(states, apiServiceState{ServiceID: service.ServiceID, Name: service.Name,
+				State: service.ServiceState, LastEvent: service.LastEvent})
+		}
+	}
+
+	start, end := apiBounds(len(states), page, perPage)
+	apiJSON(writer, http.StatusOK, apiList{Data: states[start:end], Page: page, PerPage: perPage, Total: len(states)})
+}
+
+// apiLocations lists the locations of the agents, that have been seen in the last days
+func apiLocations(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
+	if request.Method != http.MethodGet {
+		apiFail(writer, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	page, perPage, ok := apiPage(writer, request)
+	if !ok {
+		return
+	}
+
+	locations, err := satsql.ReadAgentLocations(H)
+	if err != nil {
+		log.Println(err)
+		apiFail(writer, http.StatusInternalServerError, "could not read the locations")
+		return
+	}
+	if locations == nil {
+		locations = []sattypes.AgentLocation{}
+	}
+	start, end := apiBounds(len(locations), page, perPage)
+	apiJSON(writer, http.StatusOK, apiList{Data: locations[start:end], Page: page, PerPage: perPage, Total: len(locations)})
+}
+
+// apiAgents lists all agents without their keys, for admins only
+func apiAgents(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler, user sattypes.UnfoldedUser) {
+	if !user.Admin {
+		apiFail(writer, http.StatusForbidden, "admins only")
+		return
+	}
+	if request.Method != http.MethodGet {
+		apiFail(writer, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	page, perPage, ok := apiPage(writer, request)
+	if !ok {
+		return
+	}
+
+	agents, err := satsql.ReadAllAgents(H)
+	if err != nil {
+		log.Println(err)
+		apiFail(writer, http.StatusInternalServerError, "could not read the agents")
+		return
+	}
+	list := []apiAgent{}
+	for _, agent := range agents {
+		list = append(list, apiAgent{
+			Name:     agent.SatAgentName,
+			Location: agent.SatAgentLocation,
+			LastSeen: agent.LastSeen,
+			Version:  agent.Version,
+			Protocol: agent.Protocol,
+			OS:       agent.OS,
+			Checks:   agent.Checks,
+			Status:   agent.Status,
+			Disabled: agent.Disabled,
+			Health:   agent.Health,
+		})
+	}
+
+	start, end := apiBounds(len(list), page, perPage)
+	apiJSON(writer, http.StatusOK, apiList{Data: list[start:end], Page: page, PerPage: perPage, Total: len(list)})
+}
+
+// apiPage reads page and per_page of the query, writes an error for invalid values
+func apiPage(writer http.ResponseWriter, request *http.Request) (int, int, bool) {
+	page, perPage := 1, apiPerPage
+	query := request.URL.Query()
+	if value := query.Get("page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			apiFail(writer, http.StatusBadRequest, "page must be a number from 1")
+			return 0, 0, false
+		}
+		page = n
+	}
+	if value := query.Get("per_page"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > apiMaxPerPage {
+			apiFail(writer, http.StatusBadRequest, fmt.Sprintf("per_page must be a number from 1 to %d", apiMaxPerPage))
+			return 0, 0, false
+		}
+		perPage = n
+	}
+	return page, perPage, true
+}
+
+// apiBounds returns the slice bounds of a page
+func apiBounds(total, page, perPage int) (int, int) {
+	start := (page - 1) * perPage
+	if start > total {
+		start = total
+	}
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+	return start, end
+}
+
+// apiStateFilter reads the state filter of the query, up, down or unknown
+func apiStateFilter(writer http.ResponseWriter, request *http.Request) (string, bool) {
+	switch state := strings.ToLower(request.URL.Query().Get("state")); state {
+	case "":
+		return "", true
+	case "up":
+		return sattypes.ServiceUP, true
+	case "down":
+		return sattypes.ServiceDown, true
+	case "unknown":
+		return sattypes.ServiceUnknown, true
+	}
+	apiFail(writer, http.StatusBadRequest, "state must be up, down or unknown")
+	return "", false
+}
+
+// apiTime parses a time in RFC 3339 or a day, empty is the zero time
+func apiTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.UTC)
+}
+
+// apiDecode reads the JSON body into v, writes an error for invalid bodies
+func apiDecode(writer http.ResponseWriter, request *http.Request, v any) bool {
+	err := json.NewDecoder(http.MaxBytesReader(writer, request.Body, 1<<20)).Decode(v)
+	if err != nil {
+		var typeError *json.UnmarshalTypeError
+		if errors.As(err, &typeError) {
+			apiFail(writer, http.StatusBadRequest, "invalid body", fmt.Sprintf("%s: must be %s", typeError.Field, typeError.Type))
+			return false
+		}
+		apiFail(writer, http.StatusBadRequest, "invalid body", err.Error())
+		return false
+	}
+	return true
+}
+
+// apiJSON writes v as JSON with the status
+func apiJSON(writer http.ResponseWriter, status int, v any) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if err := json.NewEncoder(writer).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// apiTokenUser returns the owner and the api token for the secret of a bearer header,
+// unknown and expired tokens fail
+func apiTokenUser(H sattypes.BaseHandler, secret string) (sattypes.UnfoldedUser, sattypes.APIToken, bool) {
+	token, err := satsql.SelectAPIToken(H, hashAPIToken(secret))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return sattypes.UnfoldedUser{}, token, false
+	}
+	if token.Expired(time.Now()) {
+		return sattypes.UnfoldedUser{}, token, false
+	}
+
+	user, err := satsql.SelectUser(H, "id", fmt.Sprintf("%d", token.UserID))
+	if err != nil {
+		log.Println(err)
+		return sattypes.UnfoldedUser{}, token, false
+	}
+
+	err = satsql.UpdateAPITokenUsed(H, token.TokenID)
+	if err != nil {
+		log.Println(err)
+	}
+	return user, token, true
+}
+
+// newAPIToken returns a random secret for an api token and its hash for the database
+func newAPIToken() (string, string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(secret)
+	return token, hashAPIToken(token), nil
+}
+
+// hashAPIToken returns the hex encoded sha256 of an api token, the secret is never stored
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiFail writes the error object
+func apiFail(writer http.ResponseWriter, status int, message string, details ...string) {
+	apiJSON(writer, status, struct {
+		Error apiError `json:"error"`
+	}{apiError{Status: status, Message: message, Details: details}})
+}
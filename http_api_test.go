@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unfoldedip/satsql"
+	"unfoldedip/sattypes"
+)
+
+// apiClient sends requests to the api handler with a session cookie or a bearer token
+type apiClient struct {
+	t       *testing.T
+	H       sattypes.BaseHandler
+	session string
+	csrf    string
+	bearer  string
+}
+
+// apiResponse is the decoded answer of the api
+type apiResponse struct {
+	Data    json.RawMessage `json:"data"`
+	Page    int             `json:"page"`
+	PerPage int             `json:"per_page"`
+	Total   int             `json:"total"`
+	Error   apiError        `json:"error"`
+}
+
+// testUsers adds the admin alice and the user bob with a session each
+func testUsers(t *testing.T, H sattypes.BaseHandler) (apiClient, apiClient) {
+	t.Helper()
+	_, err := H.DB.Exec("insert into users (id, email, password, admin) values (1, 'alice@example.com', 'x', 1), " +
+		"(2, 'bob@example.com', 'x', 0); insert into sessions (csrf, sessionid, userid, last_activity) values " +
+		"('csrf-alice', 'session-alice', 1, datetime('now')), ('csrf-bob', 'session-bob', 2, datetime('now'))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return apiClient{t: t, H: H, session: "session-alice", csrf: "csrf-alice"},
+		apiClient{t: t, H: H, session: "session-bob", csrf: "csrf-bob"}
+}
+
+// do sends a request with an optional JSON body and returns status and answer
+func (c apiClient) do(method, path, body string) (int, apiResponse) {
+	c.t.Helper()
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if c.session != "" {
+		request.AddCookie(&http.Cookie{Name: "Session", Value: c.session})
+	}
+	if c.csrf != "" {
+		request.Header.Set("X-CSRF-Token", c.csrf)
+	}
+	if c.bearer != "" {
+		request.Header.Set("Authorization", "Bearer "+c.bearer)
+	}
+	recorder := httptest.NewRecorder()
+	api(recorder, request, c.H)
+
+	var response apiResponse
+	if recorder.Body.Len() > 0 {
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			c.t.Fatalf("%s %s answered no JSON: %s", method, path, recorder.Body)
+		}
+	}
+	return recorder.Code, response
+}
+
+// create posts an object and returns its id from the field idField
+func (c apiClient) create(path, body, idField string) int64 {
+	c.t.Helper()
+	status, response := c.do("POST", path, body)
+	if status != http.StatusCreated {
+		c.t.Fatalf("POST %s answered %d %+v", path, status, response.Error)
+	}
+	var object map[string]any
+	_ = json.Unmarshal(response.Data, &object)
+	return int64(object[idField].(float64))
+}
+
+// Test, that users can neither read nor change the services and alert groups of others
+func TestAPIOwnership(t *testing.T) {
+	H := testHandler(t)
+	alice, bob := testUsers(t, H)
+
+	groupID := alice.create("/api/v1/alertgroups", `{"groupname":"ops","emails":"ops@example.com"}`, "contactid")
+	serviceID := alice.create("/api/v1/services", fmt.Sprintf(`{"name":"web","type":"tcp","tocheck":"127.0.0.1:80","contactgroup":%d}`, groupID), "serviceid")
+	if err := satsql.InsertServiceChange(H, sattypes.ServiceResult{ServiceID: serviceID, Status: sattypes.ServiceDown}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{fmt.Sprintf("/api/v1/services/%d", serviceID), fmt.Sprintf("/api/v1/alertgroups/%d", groupID)} {
+		if status, _ := bob.do("GET", path, ""); status != http.StatusNotFound {
+			t.Errorf("GET %s of another user answered %d", path, status)
+		}
+		if status, _ := bob.do("PUT", path, `{"name":"bob","groupname":"bob","emails":"bob@example.com"}`); status != http.StatusNotFound {
+			t.Errorf("PUT %s of another user answered %d", path, status)
+		}
+		if status, _ := bob.do("DELETE", path, ""); status != http.StatusNotFound {
+			t.Errorf("DELETE %s of another user answered %d", path, status)
+		}
+	}
+	service, err := satsql.SelectService(H, "service_id", fmt.Sprint(serviceID), 1)
+	if err != nil || service.Name != "web" || service.OwnerID != 1 {
+		t.Errorf("Service of alice is %+v, %v", service, err)
+	}
+	group, err := satsql.SelectAlertGroup(H, "contact_id", fmt.Sprint(groupID))
+	if err != nil || group.GroupName != "ops" || group.OwnerID != 1 {
+		t.Errorf("Alert group of alice is %+v, %v", group, err)
+	}
+
+	// lists and logs hold the own objects only
+	for _, path := range []string{"/api/v1/services", "/api/v1/alertgroups", "/api/v1/states", "/api/v1/logs",
+		fmt.Sprintf("/api/v1/logs?service=%d", serviceID)} {
+		if status, response := bob.do("GET", path, ""); status != http.StatusOK || response.Total != 0 {
+			t.Errorf("GET %s of bob answered %d with %d items", path, status, response.Total)
+		}
+		if status, response := alice.do("GET", path, ""); status != http.StatusOK || response.Total != 1 {
+			t.Errorf("GET %s of alice answered %d with %d items", path, status, response.Total)
+		}
+	}
+	if status, _ := bob.do("GET", fmt.Sprintf("/api/v1/services/%d/logs", serviceID), ""); status != http.StatusNotFound {
+		t.Errorf("Logs of another user answered %d", status)
+	}
+
+	// a service can't be moved to the alert group of another user
+	status, response := bob.do("POST", "/api/v1/services", fmt.Sprintf(`{"name":"x","type":"tcp","tocheck":"127.0.0.1:80","contactgroup":%d}`, groupID))
+	if status != http.StatusUnprocessableEntity || !strings.Contains(strings.Join(response.Error.Details, ","), "contactgroup") {
+		t.Errorf("Service with the alert group of another user answered %d %+v", status, response.Error)
+	}
+
+	// agents are for admins only
+	if status, _ := bob.do("GET", "/api/v1/agents", ""); status != http.StatusForbidden {
+		t.Errorf("Agents for a user answered %d", status)
+	}
+	if status, _ := alice.do("GET", "/api/v1/agents", ""); status != http.StatusOK {
+		t.Errorf("Agents for an admin answered %d", status)
+	}
+
+	// the owner deletes
+	if status, _ := alice.do("DELETE", fmt.Sprintf("/api/v1/services/%d", serviceID), ""); status != http.StatusNoContent {
+		t.Errorf("DELETE of the own service answered %d", status)
+	}
+	if status, _ := alice.do("GET", fmt.Sprintf("/api/v1/services/%d", serviceID), ""); status != http.StatusNotFound {
+		t.Errorf("Deleted service answered %d", status)
+	}
+}
+
+// Test the validation and the error object
+func TestAPIValidation(t *testing.T) {
+	H := testHandler(t)
+	alice, _ := testUsers(t, H)
+
+	status, response := alice.do("POST", "/api/v1/services", `{"name":" ","type":"gopher","interval":7,"severity":"high","timeout":-1}`)
+	if status != http.StatusUnprocessableEntity || response.Error.Status != status || response.Error.Message != "invalid service" {
+		t.Fatalf("Invalid service answered %d %+v", status, response.Error)
+	}
+	details := strings.Join(response.Error.Details, "\n")
+	for _, field := range []string{"name:", "type:", "tocheck:", "interval:", "severity:", "timeout:"} {
+		if !strings.Contains(details, field) {
+			t.Errorf("Details miss %s: %s", field, details)
+		}
+	}
+	if status, response = alice.do("POST", "/api/v1/services", `{"name":"web","type":"http","tocheck":"ftp://example.com"}`); status != http.StatusUnprocessableEntity {
+		t.Errorf("Service with an ftp url answered %d", status)
+	}
+
+	status, response = alice.do("POST", "/api/v1/alertgroups", `{"groupname":"","emails":"not an address","digestseconds":5}`)
+	details = strings.Join(response.Error.Details, "\n")
+	if status != http.StatusUnprocessableEntity || !strings.Contains(details, "groupname:") || !strings.Contains(details, "emails:") ||
+		!strings.Contains(details, "digestseconds:") {
+		t.Errorf("Invalid alert group answered %d %+v", status, response.Error)
+	}
+	if status, _ = alice.do("POST", "/api/v1/alertgroups", `{"groupname":"ops","emails":"ops@example.com","rotationid":99}`); status != http.StatusUnprocessableEntity {
+		t.Errorf("Alert group with an unknown rotation answered %d", status)
+	}
+
+	// a valid service is completed with the defaults of the web panel
+	id := alice.create("/api/v1/services", `{"name":" web ","type":"tcp","tocheck":"127.0.0.1:80"}`, "serviceid")
+	_, response = alice.do("GET", fmt.Sprintf("/api/v1/services/%d", id), "")
+	var service sattypes.Service
+	_ = json.Unmarshal(response.Data, &service)
+	if service.Name != "web" || service.Interval != 90 || service.Locations != "any" || service.Severity != sattypes.SeverityNormal ||
+		service.ServiceState != sattypes.ServiceUnknown {
+		t.Errorf("Created service is %+v", service)
+	}
+
+	// PUT keeps the fields, that are not sent, and is validated as well
+	if status, _ = alice.do("PUT", fmt.Sprintf("/api/v1/services/%d", id), `{"interval":7}`); status != http.StatusUnprocessableEntity {
+		t.Errorf("PUT with an invalid interval answered %d", status)
+	}
+	if status, response = alice.do("PUT", fmt.Sprintf("/api/v1/services/%d", id), `{"name":"www"}`); status != http.StatusOK {
+		t.Errorf("PUT answered %d %+v", status, response.Error)
+	}
+	_ = json.Unmarshal(response.Data, &service)
+	if service.Name != "www" || service.ToCheck != "127.0.0.1:80" {
+		t.Errorf("Updated service is %+v", service)
+	}
+
+	// requests, that are not understood
+	requests := []struct {
+		method, path, body string
+		status             int
+	}{
+		{"POST", "/api/v1/services", `{"name":`, http.StatusBadRequest},
+		{"PATCH", "/api/v1/services", "", http.StatusMethodNotAllowed},
+		{"GET", "/api/v1/nothing", "", http.StatusNotFound},
+		{"GET", "/api/v1/services/abc", "", http.StatusNotFound},
+		{"GET", "/api/v1/logs?state=sideways", "", http.StatusBadRequest},
+		{"GET", "/api/v1/logs?since=yesterday", "", http.StatusBadRequest},
+	}
+	for _, r := range requests {
+		if status, response = alice.do(r.method, r.path, r.body); status != r.status || response.Error.Status != r.status ||
+			response.Error.Message == "" {
+			t.Errorf("%s %s answered %d %+v, expected %d", r.method, r.path, status, response.Error, r.status)
+		}
+	}
+
+	// JSON only
+	request := httptest.NewRequest("POST", "/api/v1/services", strings.NewReader(`{}`))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.AddCookie(&http.Cookie{Name: "Session", Value: alice.session})
+	request.Header.Set("X-CSRF-Token", alice.csrf)
+	recorder := httptest.NewRecorder()
+	api(recorder, request, H)
+	if recorder.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Form post answered %d", recorder.Code)
+	}
+
+	// no login
+	if status, response = (apiClient{t: t, H: H}).do("GET", "/api/v1/services", ""); status != http.StatusUnauthorized ||
+		response.Error.Status != http.StatusUnauthorized {
+		t.Errorf("Request without login answered %d", status)
+	}
+}
+
+// Test the pages of the lists
+func TestAPIPagination(t *testing.T) {
+	H := testHandler(t)
+	alice, _ := testUsers(t, H)
+	for i := 0; i < 5; i++ {
+		alice.create("/api/v1/services", fmt.Sprintf(`{"name":"web%d","type":"tcp","tocheck":"127.0.0.1:%d"}`, i, 80+i), "serviceid")
+	}
+
+	pages := []struct {
+		query       string
+		items, page int
+	}{
+		{"", 5, 1},
+		{"?per_page=2", 2, 1},
+		{"?per_page=2&page=3", 1, 3},
+		{"?per_page=2&page=4", 0, 4},
+		{"?per_page=500&page=1000000", 0, 1000000},
+	}
+	for _, p := range pages {
+		status, response := alice.do("GET", "/api/v1/services"+p.query, "")
+		var services []sattypes.Service
+		_ = json.Unmarshal(response.Data, &services)
+		if status != http.StatusOK || len(services) != p.items || response.Total != 5 || response.Page != p.page {
+			t.Errorf("Page %s answered %d with %d of %d items on page %d", p.query, status, len(services), response.Total, response.Page)
+		}
+		// an empty page is an empty list, not null
+		if p.items == 0 && string(response.Data) != "[]" {
+			t.Errorf("Empty page %s is %s", p.query, response.Data)
+		}
+	}
+	if _, response := alice.do("GET", "/api/v1/services", ""); response.PerPage != apiPerPage {
+		t.Errorf("Default page size is %d", response.PerPage)
+	}
+
+	for _, query := range []string{"?page=0", "?page=-1", "?page=x", "?per_page=0", "?per_page=501"} {
+		if status, _ := alice.do("GET", "/api/v1/services"+query, ""); status != http.StatusBadRequest {
+			t.Errorf("Page %s answered %d", query, status)
+		}
+	}
+}
+
+// testToken adds an api token of the user and returns its secret
+func testToken(t *testing.T, H sattypes.BaseHandler, userID int64, scope, expires string) string {
+	t.Helper()
+	secret, hash, err := newAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = satsql.InsertAPIToken(H, sattypes.APIToken{UserID: userID, Name: scope, TokenHash: hash, Scope: scope, Expires: expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// Test the login, scope, expiry, revocation and last use of api tokens
+func TestAPIToken(t *testing.T) {
+	H := testHandler(t)
+	testUsers(t, H)
+	write := apiClient{t: t, H: H, bearer: testToken(t, H, 1, sattypes.ScopeWrite, "")}
+	read := apiClient{t: t, H: H, bearer: testToken(t, H, 1, sattypes.ScopeRead, "")}
+
+	// tokens log in without session and csrf token
+	id := write.create("/api/v1/services", `{"name":"web","type":"tcp","tocheck":"127.0.0.1:80"}`, "serviceid")
+	status, response := read.do("GET", "/api/v1/services", "")
+	if status != http.StatusOK || response.Total != 1 {
+		t.Errorf("Read token answered %d with %d items", status, response.Total)
+	}
+
+	// read-only tokens can't write
+	writes := []struct{ method, path, body string }{
+		{"POST", "/api/v1/services", `{"name":"web2","type":"tcp","tocheck":"127.0.0.1:81"}`},
+		{"PUT", fmt.Sprintf("/api/v1/services/%d", id), `{"name":"www"}`},
+		{"DELETE", fmt.Sprintf("/api/v1/services/%d", id), ""},
+		{"POST", "/api/v1/alertgroups", `{"groupname":"ops","emails":"ops@example.com"}`},
+	}
+	for _, w := range writes {
+		if status, response = read.do(w.method, w.path, w.body); status != http.StatusForbidden || response.Error.Message != "token is read-only" {
+			t.Errorf("%s %s with a read token answered %d %+v", w.method, w.path, status, response.Error)
+		}
+	}
+	if service, _ := satsql.SelectService(H, "service_id", fmt.Sprint(id), 1); service.Name != "web" {
+		t.Errorf("Read token changed the service to %+v", service)
+	}
+
+	// unknown and expired tokens fail, tokens expiring later work
+	past := time.Now().UTC().Add(-time.Minute).Format(time.DateTime)
+	future := time.Now().UTC().Add(time.Hour).Format(time.DateTime)
+	for bearer, want := range map[string]int{
+		"unknown": http.StatusUnauthorized,
+		testToken(t, H, 1, sattypes.ScopeRead, past):   http.StatusUnauthorized,
+		testToken(t, H, 1, sattypes.ScopeRead, future): http.StatusOK,
+	} {
+		if status, _ = (apiClient{t: t, H: H, bearer: bearer}).do("GET", "/api/v1/services", ""); status != want {
+			t.Errorf("Token %s answered %d, expected %d", bearer, status, want)
+		}
+	}
+
+	// the last use is written at most once a minute
+	lastUsed := func() string {
+		var used string
+		if err := H.DB.QueryRow("select last_used from api_tokens where token_hash = ?", hashAPIToken(read.bearer)).Scan(&used); err != nil {
+			t.Fatal(err)
+		}
+		return used
+	}
+	if lastUsed() == "" {
+		t.Error("Last use of the read token is empty")
+	}
+	recent := time.Now().UTC().Add(-10 * time.Second).Format(time.DateTime)
+	old := time.Now().UTC().Add(-2 * time.Hour).Format(time.DateTime)
+	for stored, updated := range map[string]bool{recent: false, old: true} {
+		if _, err := H.DB.Exec("update api_tokens set last_used = ? where token_hash = ?", stored, hashAPIToken(read.bearer)); err != nil {
+			t.Fatal(err)
+		}
+		read.do("GET", "/api/v1/services", "")
+		if used := lastUsed(); (used != stored) != updated {
+			t.Errorf("Last use %s became %s", stored, used)
+		}
+	}
+
+	// revoked tokens fail, other users can't revoke them
+	tokens, err := satsql.ReadAPITokens(H, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range tokens {
+		if token.Scope == sattypes.ScopeWrite {
+			if err = satsql.DeleteAPIToken(H, 2, token.TokenID); err != nil {
+				t.Fatal(err)
+			}
+			if status, _ = write.do("GET", "/api/v1/services", ""); status != http.StatusOK {
+				t.Errorf("Token revoked by another user answered %d", status)
+			}
+			if err = satsql.DeleteAPIToken(H, 1, token.TokenID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if status, _ = write.do("GET", "/api/v1/services", ""); status != http.StatusUnauthorized {
+		t.Errorf("Revoked token answered %d", status)
+	}
+}
+
+// Test, that api tokens skip the csrf token below /api/ only
+func TestCSRFTokenBypass(t *testing.T) {
+	H := testHandler(t)
+	alice, _ := testUsers(t, H)
+	bearer := testToken(t, H, 1, sattypes.ScopeWrite, "")
+	session := sattypes.Session{CSRF: "csrf-alice"}
+	withToken := func(request *http.Request) *http.Request {
+		return request.WithContext(context.WithValue(request.Context(), apiTokenKey{}, sattypes.APIToken{Scope: sattypes.ScopeWrite}))
+	}
+
+	checks := []struct {
+		request *http.Request
+		ok      bool
+	}{
+		{withToken(httptest.NewRequest("POST", "/api/v1/services", nil)), true},
+		{withToken(httptest.NewRequest("POST", "/service_delete", nil)), false},
+		{httptest.NewRequest("POST", "/api/v1/services", nil), false},
+		{httptest.NewRequest("POST", "/service_delete", nil), false},
+	}
+	for _, c := range checks {
+		recorder := httptest.NewRecorder()
+		if ok := CheckCSRFToken(recorder, c.request, H, session); ok != c.ok || (!ok && recorder.Code != http.StatusForbidden) {
+			t.Errorf("CSRF check of %s passed %v with %d", c.request.URL.Path, ok, recorder.Code)
+		}
+	}
+
+	// a session together with a bearer token on a form of the web panel still needs the csrf token
+	id := alice.create("/api/v1/services", `{"name":"web","type":"tcp","tocheck":"127.0.0.1:80"}`, "serviceid")
+	request := httptest.NewRequest("POST", "/service_delete", strings.NewReader(fmt.Sprintf("id=%d", id)))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", "Bearer "+bearer)
+	request.AddCookie(&http.Cookie{Name: "Session", Value: alice.session})
+	recorder := httptest.NewRecorder()
+	serviceDelete(recorder, request, H)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Form post with a bearer token and without csrf token answered %d", recorder.Code)
+	}
+	if _, err := satsql.SelectService(H, "service_id", fmt.Sprint(id), 1); err != nil {
+		t.Errorf("Service was deleted without csrf token: %v", err)
+	}
+
+	// the api with the session cookie needs it as well
+	alice.csrf = ""
+	if status, response := alice.do("DELETE", fmt.Sprintf("/api/v1/services/%d", id), ""); status != http.StatusForbidden ||
+		response.Error.Status != http.StatusForbidden {
+		t.Errorf("DELETE with session and without csrf token answered %d", status)
+	}
+}
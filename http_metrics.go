@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unfoldedip/satsql"
+	"unfoldedip/sattypes"
+)
+
+// metricsStates are the values of the unfolded_service_state metric
+var metricsStates = []string{sattypes.ServiceUP, sattypes.ServiceDown, sattypes.ServiceUnknown}
+
+// metrics exports services, agents and the analytics thread in the Prometheus text format
+func metrics(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler, snapshot func() sattypes.AnalyticsMetrics) {
+	if !metricsAllowed(request, H) {
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	services, err := satsql.ReadServices(H, 0, "", false)
+	if err != nil {
+		log.Println(err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ServiceID < services[j].ServiceID })
+	analytics := snapshot()
+	now := time.Now()
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetricsHeader(writer, "unfolded_service_state", "gauge", "current state of the service, 1 for the active state")
+	for _, service := range services {
+		state := service.ServiceState
+		if state != sattypes.ServiceUP && state != sattypes.ServiceDown {
+			state = sattypes.ServiceUnknown
+		}
+		for _, s := range metricsStates {
+			value := 0
+			if s == state {
+				value = 1
+			}
+			fmt.Fprintf(writer, "unfolded_service_state{%s,state=%s} %d\n", serviceLabels(service), metricsLabel(metricsState(s)), value)
+		}
+	}
+
+	// the analytics thread knows only services with results since the start of the server
+	byID := make(map[int64]sattypes.Service)
+	for _, service := range services {
+		byID[service.ServiceID] = service
+	}
+	writeMetricsHeader(writer, "unfolded_service_transitions_total", "counter", "state changes of the service since the start of the server")
+	for _, m := range analytics.Services {
+		if service, ok := byID[m.ServiceID]; ok {
+			fmt.Fprintf(writer, "unfolded_service_transitions_total{%s} %d\n", serviceLabels(service), m.Transitions)
+		}
+	}
+	writeMetricsHeader(writer, "unfolded_service_latency_seconds", "gauge", "duration of the last check of the service per location")
+	for _, m := range analytics.Services {
+		if service, ok := byID[m.ServiceID]; ok {
+			for _, r := range m.LastResults {
+				fmt.Fprintf(writer, "unfolded_service_latency_seconds{%s,location=%s} %s\n", serviceLabels(service),
+					metricsLabel(r.TestNode), metricsFloat(r.Latency))
+			}
+		}
+	}
+	writeMetricsHeader(writer, "unfolded_service_result_age_seconds", "gauge", "age of the last result of the service per location")
+	for _, m := range analytics.Services {
+		if service, ok := byID[m.ServiceID]; ok {
+			for _, r := range m.LastResults {
+				fmt.Fprintf(writer, "unfolded_service_result_age_seconds{%s,location=%s} %s\n", serviceLabels(service),
+					metricsLabel(r.TestNode), metricsFloat(now.Sub(r.Time).Seconds()))
+			}
+		}
+	}
+
+	writeMetricsHeader(writer, "unfolded_agent_last_seen_timestamp_seconds", "gauge", "last contact of the agent as unix time")
+	for _, agent := range analytics.Agents {
+		fmt.Fprintf(writer, "unfolded_agent_last_seen_timestamp_seconds{agent=%s,location=%s} %d\n",
+			metricsLabel(agent.Name), metricsLabel(agent.Location), agent.LastSeen.Unix())
+	}
+	writeMetricsHeader(writer, "unfolded_agent_up", "gauge", "0, if the agent has been silent for the silence period")
+	for _, agent := range analytics.Agents {
+		up := 1
+		if agent.Down {
+			up = 0
+		}
+		fmt.Fprintf(writer, "unfolded_agent_up{agent=%s,location=%s} %d\n", metricsLabel(agent.Name), metricsLabel(agent.Location), up)
+	}
+
+	writeMetricsHeader(writer, "unfolded_read_messages_total", "counter", "results handled by the analytics thread")
+	fmt.Fprintf(writer, "unfolded_read_messages_total %d\n", analytics.ReadMessages)
+	writeMetricsHeader(writer, "unfolded_results_channel_depth", "gauge", "results waiting for the analytics thread")
+	fmt.Fprintf(writer, "unfolded_results_channel_depth %d\n", len(sattypes.ResultsChannel))
+	writeMetricsHeader(writer, "unfolded_results_channel_capacity", "gauge", "maximum number of results waiting for the analytics thread")
+	fmt.Fprintf(writer, "unfolded_results_channel_capacity %d\n", cap(sattypes.ResultsChannel))
+
+	kinds := make([]string, 0, len(analytics.Mails))
+	for kind := range analytics.Mails {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	writeMetricsHeader(writer, "unfolded_notifications_sent_total", "counter", "notification mails sent per kind")
+	for _, kind := range kinds {
+		fmt.Fprintf(writer, "unfolded_notifications_sent_total{kind=%s} %d\n", metricsLabel(kind), analytics.Mails[kind].Sent)
+	}
+	writeMetricsHeader(writer, "unfolded_notifications_failed_total", "counter", "notification mails failed per kind")
+	for _, kind := range kinds {
+		fmt.Fprintf(writer, "unfolded_notifications_failed_total{kind=%s} %d\n", metricsLabel(kind), analytics.Mails[kind].Failed)
+	}
+}
+
+// metricsAllowed returns true, if the request carries the bearer token or comes directly from an allowed address
+func metricsAllowed(request *http.Request, H sattypes.BaseHandler) bool {
+	if H.MetricsToken != "" {
+		token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(H.MetricsToken)) == 1 {
+			return true
+		}
+	}
+	// behind a reverse proxy every client has the address of the proxy
+	if request.Header.Get("X-Forwarded-For") != "" || request.Header.Get("Forwarded") != "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, network := range H.MetricsAllow {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMetricsAllow parses a comma separated list of addresses and networks, e.g. 127.0.0.1,10.0.0.0/8
+func parseMetricsAllow(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q in metrics allow list", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q in metrics allow list", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// writeMetricsHeader writes the HELP and TYPE lines of a metric
+func writeMetricsHeader(writer io.Writer, name, kind, help string) {
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// serviceLabels returns the labels of a service
+func serviceLabels(service sattypes.Service) string {
+	return fmt.Sprintf("service_id=\"%d\",service=%s,type=%s", service.ServiceID, metricsLabel(service.Name), metricsLabel(service.Type))
+}
+
+// metricsState turns SERVICE_UP into up
+func metricsState(state string) string {
+	return strings.ToLower(strings.TrimPrefix(state, "SERVICE_"))
+}
+
+// metricsLabel quotes a label value, escaping backslash, double quote and newline
+func metricsLabel(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return `"` + value + `"`
+}
+
+// metricsFloat formats a sample value
+func metricsFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"unfoldedip/sattypes"
+)
+
+// Test the access to /metrics by token and address
+func TestMetricsAllowed(t *testing.T) {
+	allow, err := parseMetricsAllow("127.0.0.1, 10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	H := sattypes.BaseHandler{MetricsToken: "secret", MetricsAllow: allow}
+
+	tests := []struct {
+		remote  string
+		headers map[string]string
+		allowed bool
+	}{
+		{"127.0.0.1:4000", nil, true},
+		{"10.1.2.3:4000", nil, true},
+		{"192.0.2.1:4000", nil, false},
+		{"192.0.2.1:4000", map[string]string{"Authorization": "Bearer secret"}, true},
+		{"192.0.2.1:4000", map[string]string{"Authorization": "Bearer wrong"}, false},
+		// a reverse proxy on the same host
+		{"127.0.0.1:4000", map[string]string{"X-Forwarded-For": "192.0.2.1"}, false},
+		{"127.0.0.1:4000", map[string]string{"Forwarded": "for=192.0.2.1"}, false},
+		{"127.0.0.1:4000", map[string]string{"X-Forwarded-For": "192.0.2.1", "Authorization": "Bearer secret"}, true},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "/metrics", nil)
+		request.RemoteAddr = test.remote
+		for key, value := range test.headers {
+			request.Header.Set(key, value)
+		}
+		if allowed := metricsAllowed(request, H); allowed != test.allowed {
+			t.Errorf("Request from %s with %v allowed is %v", test.remote, test.headers, allowed)
+		}
+	}
+
+	// without allow list and token nobody is allowed
+	request := httptest.NewRequest("GET", "/metrics", nil)
+	request.RemoteAddr = "127.0.0.1:4000"
+	if metricsAllowed(request, sattypes.BaseHandler{}) {
+		t.Error("Request allowed without allow list and token")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"unfoldedip/sattypes"
+)
+
+// openAPIDocument is the OpenAPI 3 description of the JSON api
+type openAPIDocument struct {
+	OpenAPI    string                                 `json:"openapi"`
+	Info       openAPIInfo                            `json:"info"`
+	Servers    []openAPIServer                        `json:"servers,omitempty"`
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components openAPIComponents                      `json:"components"`
+	Security   []map[string][]string                  `json:"security"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type openAPIServer struct {
+	URL string `json:"url"`
+}
+
+type openAPIComponents struct {
+	Schemas         sattypes.OpenAPISchemas  `json:"schemas"`
+	SecuritySchemes map[string]openAPISchema `json:"securitySchemes"`
+}
+
+// openAPISchema is a free form object, e.g. a security scheme
+type openAPISchema map[string]any
+
+type openAPIOperation struct {
+	Summary     string                     `json:"summary"`
+	OperationID string                     `json:"operationId"`
+	Tags        []string                   `json:"tags"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIBody               `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      map[string]any `json:"schema"`
+}
+
+type openAPIBody struct {
+	Required bool                    `json:"required"`
+	Content  map[string]openAPIMedia `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                  `json:"description"`
+	Content     map[string]openAPIMedia `json:"content,omitempty"`
+}
+
+type openAPIMedia struct {
+	Schema map[string]any `json:"schema"`
+}
+
+// apiOpenAPI serves the OpenAPI description of the api without a login, so clients can be generated from it
+func apiOpenAPI(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
+	if request.Method != http.MethodGet {
+		apiFail(writer, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	apiJSON(writer, http.StatusOK, openAPISpec(H.URL))
+}
+
+// openAPISpec describes all endpoints of the api, the schemas are generated from the Go types of the responses
+func openAPISpec(serverURL string) openAPIDocument {
+	schemas := sattypes.OpenAPISchemas{}
+	service := schemas.Ref(sattypes.Service{})
+	alertGroup := schemas.Ref(sattypes.AlertGroup{})
+	serviceLog := schemas.Ref(sattypes.ServiceLog{})
+	schemas.Ref(sattypes.ServiceResult{})
+
+	// errors and wrappers are kept in sync with the structs written by apiFail, apiItem and apiList
+	schemas.Ref(apiError{})
+	schemas["ErrorResponse"] = schemas.Object(struct {
+		Error apiError `json:"error"`
+	}{})
+	item := func(name string, data map[string]any) map[string]any {
+		schema := schemas.Object(apiItem{})
+		schema["properties"].(map[string]any)["data"] = data
+		schemas[name] = schema
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	list := func(name string, data map[string]any) map[string]any {
+		schema := schemas.Object(apiList{})
+		schema["properties"].(map[string]any)["data"] = map[string]any{"type": "array", "items": data}
+		schemas[name] = schema
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	// request bodies can leave out fields, the server completes them like the forms of the web panel
+	input := func(name string, v any) map[string]any {
+		schema := schemas.Object(v)
+		delete(schema, "required")
+		schemas[name] = schema
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	serviceInput := input("ServiceInput", sattypes.Service{})
+	alertGroupInput := input("AlertGroupInput", sattypes.AlertGroup{})
+	serviceItem := item("ServiceItem", service)
+	alertGroupItem := item("AlertGroupItem", alertGroup)
+	serviceList := list("ServiceList", service)
+	alertGroupList := list("AlertGroupList", alertGroup)
+	logList := list("ServiceLogList", serviceLog)
+	stateList := list("ServiceStateList", schemas.Ref(apiServiceState{}))
+	locationList := list("AgentLocationList", schemas.Ref(sattypes.AgentLocation{}))
+	agentList := list("AgentList", schemas.Ref(apiAgent{}))
+
+	// parameters
+	integer := map[string]any{"type": "integer", "format": "int64"}
+	id := openAPIParameter{Name: "id", In: "path", Required: true, Schema: integer}
+	pages := []openAPIParameter{
+		{Name: "page", In: "query", Description: "page from 1", Schema: map[string]any{"type": "integer", "minimum": 1, "default": 1}},
+		{Name: "per_page", In: "query", Description: "items per page", Schema: map[string]any{"type": "integer", "minimum": 1,
+			"maximum": apiMaxPerPage, "default": apiPerPage}},
+	}
+	state := openAPIParameter{Name: "state", In: "query", Schema: map[string]any{"type": "string", "enum": []string{"up", "down", "unknown"}}}
+	logFilter := []openAPIParameter{
+		{Name: "state", In: "query", Schema: map[string]any{"type": "string", "enum": []string{"up", "down"}}},
+		{Name: "since", In: "query", Description: "RFC 3339 time or a day like 2026-10-01", Schema: map[string]any{"type": "string"}},
+		{Name: "until", In: "query", Description: "RFC 3339 time or a day like 2026-10-01", Schema: map[string]any{"type": "string"}},
+	}
+	params := func(lists ...[]openAPIParameter) []openAPIParameter {
+		var all []openAPIParameter
+		for _, l := range lists {
+			all = append(all, l...)
+		}
+		return all
+	}
+
+	// responses
+	content := func(description string, schema map[string]any) openAPIResponse {
+		return openAPIResponse{Description: description, Content: map[string]openAPIMedia{"application/json": {Schema: schema}}}
+	}
+	failed := content("error", map[string]any{"$ref": "#/components/schemas/ErrorResponse"})
+	responses := func(status string, response openAPIResponse, errors ...string) map[string]openAPIResponse {
+		all := map[string]openAPIResponse{status: response, "401": failed}
+		for _, e := range errors {
+			all[e] = failed
+		}
+		return all
+	}
+	body := func(schema map[string]any) *openAPIBody {
+		return &openAPIBody{Required: true, Content: map[string]openAPIMedia{"application/json": {Schema: schema}}}
+	}
+	deleted := openAPIResponse{Description: "deleted"}
+
+	paths := map[string]map[string]openAPIOperation{
+		"/services": {
+			"get": {Summary: "List the services", OperationID: "listServices", Tags: []string{"services"},
+				Parameters: params(pages, []openAPIParameter{state, {Name: "type", In: "query", Schema: map[string]any{"type": "string",
+					"enum": sattypes.CheckTypes}}}),
+				Responses: responses("200", content("services", serviceList), "400")},
+			"post": {Summary: "Create a service", OperationID: "createService", Tags: []string{"services"}, RequestBody: body(serviceInput),
+				Responses: responses("201", content("created service", serviceItem), "403", "415", "422")},
+		},
+		"/services/{id}": {
+			"get": {Summary: "Read a service", OperationID: "getService", Tags: []string{"services"}, Parameters: params([]openAPIParameter{id}),
+				Responses: responses("200", content("service", serviceItem), "404")},
+			"put": {Summary: "Update a service, fields not sent keep their value", OperationID: "updateService", Tags: []string{"services"},
+				Parameters: params([]openAPIParameter{id}), RequestBody: body(serviceInput),
+				Responses: responses("200", content("updated service", serviceItem), "403", "404", "415", "422")},
+			"delete": {Summary: "Delete a service", OperationID: "deleteService", Tags: []string{"services"}, Parameters: params([]openAPIParameter{id}),
+				Responses: responses("204", deleted, "403", "404")},
+		},
+		"/services/{id}/logs": {
+			"get": {Summary: "List the state changes of a service", OperationID: "listServiceLogs", Tags: []string{"logs"},
+				Parameters: params([]openAPIParameter{id}, pages, logFilter),
+				Responses:  responses("200", content("state changes", logList), "400", "404")},
+		},
+		"/logs": {
+			"get": {Summary: "List the state changes of all services", OperationID: "listLogs", Tags: []string{"logs"},
+				Parameters: params(pages, []openAPIParameter{{Name: "service", In: "query", Schema: integer}}, logFilter),
+				Responses:  responses("200", content("state changes", logList), "400")},
+		},
+		"/states": {
+			"get": {Summary: "List the current state of all services", OperationID: "listStates", Tags: []string{"services"},
+				Parameters: params(pages, []openAPIParameter{state}),
+				Responses:  responses("200", content("states", stateList), "400")},
+		},
+		"/alertgroups": {
+			"get": {Summary: "List the alert groups", OperationID: "listAlertGroups", Tags: []string{"alertgroups"}, Parameters: pages,
+				Responses: responses("200", content("alert groups", alertGroupList), "400")},
+			"post": {Summary: "Create an alert group", OperationID: "createAlertGroup", Tags: []string{"alertgroups"}, RequestBody: body(alertGroupInput),
+				Responses: responses("201", content("created alert group", alertGroupItem), "403", "415", "422")},
+		},
+		"/alertgroups/{id}": {
+			"get": {Summary: "Read an alert group", OperationID: "getAlertGroup", Tags: []string{"alertgroups"}, Parameters: params([]openAPIParameter{id}),
+				Responses: responses("200", content("alert group", alertGroupItem), "404")},
+			"put": {Summary: "Update an alert group, fields not sent keep their value", OperationID: "updateAlertGroup", Tags: []string{"alertgroups"},
+				Parameters: params([]openAPIParameter{id}), RequestBody: body(alertGroupInput),
+				Responses: responses("200", content("updated alert group", alertGroupItem), "403", "404", "415", "422")},
+			"delete": {Summary: "Delete an alert group", OperationID: "deleteAlertGroup", Tags: []string{"alertgroups"},
+				Parameters: params([]openAPIParameter{id}), Responses: responses("204", deleted, "403", "404")},
+		},
+		"/locations": {
+			"get": {Summary: "List the agent locations", OperationID: "listLocations", Tags: []string{"agents"}, Parameters: pages,
+				Responses: responses("200", content("locations", locationList), "400")},
+		},
+		"/agents": {
+			"get": {Summary: "List the agents without their keys, admins only", OperationID: "listAgents", Tags: []string{"agents"}, Parameters: pages,
+				Responses: responses("200", content("agents", agentList), "400", "403")},
+		},
+	}
+
+	document := openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: openAPIInfo{Title: "Unfolded API", Version: "1",
+			Description: "Services, alert groups and logs of the user of the api token or the session"},
+		Paths: paths,
+		Components: openAPIComponents{
+			Schemas: schemas,
+			SecuritySchemes: map[string]openAPISchema{
+				"token":   {"type": "http", "scheme": "bearer", "description": "personal api token from the profile page"},
+				"session": {"type": "apiKey", "in": "cookie", "name": "Session"},
+			},
+		},
+		Security: []map[string][]string{{"token": {}}, {"session": {}}},
+	}
+	if serverURL != "" {
+		document.Servers = []openAPIServer{{URL: strings.TrimSuffix(serverURL, "/") + "/api/v1"}}
+	}
+	return document
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unfoldedip/satsql"
+	"unfoldedip/sattypes"
+)
+
+// for hardcoded rotation lengths in days
+var allowedRotationDays = []int{1, 7, 14}
+
+// handle on-call rotations, shows who is on call now and next
+func rotations(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
+	var g sattypes.Global
+
+	// retrieve session
+	if g.U, g.U.LoggedIn = isLoggedIn(request, H); !g.U.LoggedIn {
+		http.Redirect(writer, request, "/login?session=expired2", http.StatusSeeOther)
+		return
+	}
+
+	// retrieve rotations with the current and next on-call member
+	g.Rotations = userRotations(H, g.U.UserID)
+
+	// Default is GET method where we will print out the template
+	executeGlobalAgainstTemplate(writer, "rotations.html", g)
+}
+
+// userRotations returns the rotations of a user, the on-call member is resolved right now
+func userRotations(H sattypes.BaseHandler, userID int64) []sattypes.RotationStatus {
+	var statuses []sattypes.RotationStatus
+
+	rotations, err := satsql.ReadRotations(H, userID)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	now := time.Now()
+	for _, rotation := range rotations {
+		overrides, err := satsql.ReadRotationOverrides(H, rotation.RotationID)
+		if err != nil {
+			log.Println(err)
+		}
+		statuses = append(statuses, rotation.Status(now, overrides))
+	}
+	return statuses
+}
+
+// ownRotation returns the rotation from the form id, if the user is its owner
+func ownRotation(H sattypes.BaseHandler, id string, userID int64) (sattypes.Rotation, bool) {
+	rotationID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return sattypes.Rotation{}, false
+	}
+	rotation, err := satsql.SelectRotation(H, rotationID)
+	if err != nil || rotation.OwnerID != userID {
+		return sattypes.Rotation{}, false
+	}
+	return rotation, true
+}
+
+// adding and editing an on-call rotation
+func rotationAdd(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
+	// local variables
+	var g sattypes.Global
+	var err error
+	var newRotation sattypes.Rotation
+
+	// retrieve session
+	if g.U, g.U.LoggedIn = isLoggedIn(request, H); !g.U.LoggedIn {
+		http.Redirect(writer, request, "/login?session=expired7", http.StatusSeeOther)
+		return
+	}
+
+	// handle POST
+	if request.Method == http.MethodPost {
+		// Parse form arguments
+		err = request.ParseForm()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		// check if csrf token is valid
+		if !CheckCSRFToken(writer, request, H, g.U.UserSession) {
+			return
+		}
+
+		// if we are in edit mode, we need carefully check, if the user
+		// is allowed to access the rotation id
+		if request.Form.Get("nextfunction") == "edit" {
+			garbageRotation, ok := ownRotation(H, request.FormValue("id"), g.U.UserID)
+			if !ok {
+				if H.Debug {
+					log.Println("Not allowing access for rotation edit or rotation not existing")
+				}
+				goto DefaultAndExit
+			}
+			newRotation.RotationID = garbageRotation.RotationID
+			g.NextFunction = "edit"
+		}
+
+		newRotation.OwnerID = g.U.UserID
+		newRotation.Name = template.HTMLEscapeString(strings.TrimSpace(request.FormValue("name")))
+		newRotation.Members = strings.Join(sattypes.Rotation{Members: request.FormValue("members")}.MemberList(), ",")
+		newRotation.TimeZone = strings.TrimSpace(request.FormValue("timezone"))
+		// the browser sends datetime-local as 2006-01-02T15:04
+		newRotation.Handoff = strings.Replace(request.FormValue("handoff"), "T", " ", 1)
+		newRotation.LengthDays = func(arg string) int {
+			val, err := strconv.Atoi(arg)
+			if err == nil {
+				for i := range allowedRotationDays {
+					if allowedRotationDays[i] == val {
+						return val
+					}
+				}
+			}
+			return 7
+		}(request.FormValue("lengthdays"))
+
+		if err = newRotation.Validate(); err != nil {
+			g.Errors = append(g.Errors, err.Error())
+			g.Rotation = newRotation
+			goto DefaultAndExit
+		}
+
+		// check if we are in edit or post
+		if newRotation.RotationID != 0 {
+			if H.Debug {
+				log.Println("Updating rotation", newRotation.RotationID)
+			}
+			err = satsql.UpdateRotation(H, &newRotation)
+		} else {
+			err = satsql.InsertRotation(H, &newRotation)
+		}
+		if err != nil {
+			log.Println(err)
+			g.State = 2
+			g.Rotation = newRotation
+		} else {
+			http.Redirect(writer, request, "/rotations", http.StatusSeeOther)
+			return
+		}
+	}
+
+	// check if we are in edit mode
+	if request.Method == http.MethodGet {
+		// new rotations start next monday with a week per member
+		now := time.Now()
+		g.Rotation = sattypes.Rotation{LengthDays: 7, TimeZone: "UTC",
+			Handoff: now.AddDate(0, 0, (8-int(now.Weekday()))%7).Format("2006-01-02") + " 09:00"}
+
+		if strings.Contains(request.URL.Path, "rotation_edit") {
+			editRotation, ok := ownRotation(H, request.FormValue("id"), g.U.UserID)
+			if ok {
+				g.Rotation = editRotation
+				g.NextFunction = "edit"
+				g.RotationOverrides, err = satsql.ReadRotationOverrides(H, editRotation.RotationID)
+				if err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}
+
+DefaultAndExit:
+	// on failed updates, show the overrides again
+	if g.NextFunction == "edit" && g.RotationOverrides == nil {
+		g.RotationOverrides, err = satsql.ReadRotationOverrides(H, g.Rotation.RotationID)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	// Pass some defaults down the template
+	g.AllowedIntervals = allowedRotationDays
+	// Default is GET method where we will print out the template
+	executeGlobalAgainstTemplate(writer, "rotation_add.html", g)
+}
+
+// handle delete rotation (will be called by ajax query)
+func rotationDelete(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
+	// local variables
+	var g sattypes.Global
+	var delRotation sattypes.Rotation
+	var ok bool
+
+	// retrieve session
+	if g.U, g.U.LoggedIn = isLoggedIn(request, H); !g.U.LoggedIn {
+		http.Redirect(writer, request, "/login?session=expired5", http.StatusSeeOther)
+		return
+	}
+
+	// Delete method?  Else,  we will return
+	if request.Method != http.MethodPost {
+		goto DefaultAndExit
+	}
+
+	/* read params form */
+	if err := request.ParseForm(); err != nil {
+		log.Println(err)
+		goto DefaultAndExit
+	}
+
+	// check if csrf token is valid
+	if !CheckCSRFToken(writer, request, H, g.U.UserSession) {
+		return
+	}
+
+	// rotation exists and owner is current user, then delete
+	delRotation, ok = ownRotation(H, request.FormValue("id"), g.U.UserID)
+	if ok {
+		if H.Debug {
+			log.Println("Deleting rotation", delRotation.RotationID)
+		}
+		if err := satsql.DeleteRotation(H, delRotation.RotationID); err != nil {
+			log.Println(err)
+			goto DefaultAndExit
+		}
+		writer.WriteHeader(http.StatusOK)
+		return
+	}
+
+	/* return no content by default */
+DefaultAndExit:
+	writer.WriteHeader(http.StatusNoContent)
+	return
+}
+
+// adding an override to an on-call rotation
+func rotationOverrideAdd(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
+	// local variables
+	var g sattypes.Global
+	var err error
+
+	// retrieve session
+	if g.U, g.U.LoggedIn = isLoggedIn(request, H); !g.U.LoggedIn {
+		http.Redirect(writer, request, "/login?session=expired7", http.StatusSeeOther)
+		return
+	}
+
+	// only POST is allowed
+	if request.Method != http.MethodPost {
+		http.Redirect(writer, request, "/rotations", http.StatusSeeOther)
+		return
+	}
+
+	// Parse form arguments
+	err = request.ParseForm()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// check if csrf token is valid
+	if !CheckCSRFToken(writer, request, H, g.U.UserSession) {
+		return
+	}
+
+	// retrieve rotation and check the owner
+	rotation, ok := ownRotation(H, request.FormValue("id"), g.U.UserID)
+	if !ok {
+		if H.Debug {
+			log.Println("Not allowing access for override add or rotation not existing")
+		}
+		http.Redirect(writer, request, "/rotations", http.StatusSeeOther)
+		return
+	}
+
+	newOverride := sattypes.RotationOverride{
+		RotationID: rotation.RotationID,
+		Email:      strings.TrimSpace(request.FormValue("email")),
+		Start:      strings.Replace(request.FormValue("start"), "T", " ", 1),
+		End:        strings.Replace(request.FormValue("end"), "T", " ", 1),
+	}
+
+	if err = newOverride.Validate(rotation); err != nil {
+		g.Errors = append(g.Errors, err.Error())
+	} else if err = satsql.InsertRotationOverride(H, &newOverride); err != nil {
+		log.Println(err)
+		g.Errors = append(g.Errors, "Could not save the override")
+	} else {
+		http.Redirect(writer, request, fmt.Sprintf("/rotation_edit?id=%d", rotation.RotationID), http.StatusSeeOther)
+		return
+	}
+
+	// render the edit page again with the errors
+	g.Rotation = rotation
+	g.NextFunction = "edit"
+	g.AllowedIntervals = allowedRotationDays
+	g.RotationOverrides, err = satsql.ReadRotationOverrides(H, rotation.RotationID)
+	if err != nil {
+		log.Println(err)
+	}
+	executeGlobalAgainstTemplate(writer, "rotation_add.html", g)
+}
+
+// handle delete rotation override (will be called by ajax query)
+func rotationOverrideDelete(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
+	// local variables
+	var g sattypes.Global
+	var rotation sattypes.Rotation
+	var overrideID int64
+	var ok bool
+	var err error
+
+	// retrieve session
+	if g.U, g.U.LoggedIn = isLoggedIn(request, H); !g.U.LoggedIn {
+		http.Redirect(writer, request, "/login?session=expired5", http.StatusSeeOther)
+		return
+	}
+
+	// Delete method?  Else,  we will return
+	if request.Method != http.MethodPost {
+		goto DefaultAndExit
+	}
+
+	/* read params form */
+	err = request.ParseForm()
+	if err != nil {
+		log.Println(err)
+		goto DefaultAndExit
+	}
+
+	// check if csrf token is valid
+	if !CheckCSRFToken(writer, request, H, g.U.UserSession) {
+		return
+	}
+
+	// read override id
+	overrideID, err = strconv.ParseInt(request.FormValue("overrideid"), 10, 64)
+	if err != nil {
+		log.Println("No id for override deletion")
+		goto DefaultAndExit
+	}
+
+	// rotation exists and owner is current user, then delete
+	rotation, ok = ownRotation(H, request.FormValue("id"), g.U.UserID)
+	if ok {
+		if H.Debug {
+			log.Println("Deleting override", overrideID, "of rotation", rotation.RotationID)
+		}
+		err := satsql.DeleteRotationOverride(H, rotation.RotationID, overrideID)
+		if err != nil {
+			log.Println(err)
+			goto DefaultAndExit
+		}
+		writer.WriteHeader(http.StatusOK)
+		return
+	}
+
+	/* return no content by default */
+DefaultAndExit:
+	writer.WriteHeader(http.StatusNoContent)
+	return
+}
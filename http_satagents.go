@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unfoldedip/satsql"
+	"unfoldedip/sattypes"
+)
+
+// agentStats counts the results of every agent per minute
+type agentStats struct {
+	mutex sync.Mutex
+	// minute of the current counters
+	minute int64
+	// results of the current and the last full minute per agent
+	current, last map[string]int
+	// last self-metrics of the worker pool per agent
+	pools map[string]sattypes.AgentPoolStats
+}
+
+// agentStatistics is filled by the agents results handler
+var agentStatistics = agentStats{current: make(map[string]int), last: make(map[string]int),
+	pools: make(map[string]sattypes.AgentPoolStats)}
+
+// rollover moves the counters, when a new minute has started
+func (a *agentStats) rollover(now time.Time) {
+	minute := now.Unix() / 60
+	if minute == a.minute {
+		return
+	}
+	if minute == a.minute+1 {
+		a.last = a.current
+	} else {
+		a.last = make(map[string]int)
+	}
+	a.current = make(map[string]int)
+	a.minute = minute
+}
+
+// add counts results for an agent
+func (a *agentStats) add(name string, results int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.rollover(time.Now())
+	a.current[name] += results
+}
+
+// setPool saves the self-metrics of the worker pool of an agent
+func (a *agentStats) setPool(name string, pool sattypes.AgentPoolStats) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.pools[name] = pool
+}
+
+// pool returns the last self-metrics of the worker pool of an agent
+func (a *agentStats) pool(name string) sattypes.AgentPoolStats {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.pools[name]
+}
+
+// perMinute returns the results of the agent in the last full minute
+func (a *agentStats) perMinute(name string) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.rollover(time.Now())
+	return a.last[name]
+}
+
+// satAgents lists all agents for admins and handles the management actions
+func satAgents(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
+	var g sattypes.Global
+	var err error
+
+	// retrieve session
+	if g.U, g.U.LoggedIn = isLoggedIn(request, H); !g.U.LoggedIn {
+		http.Redirect(writer, request, "/login?session=expired2", http.StatusSeeOther)
+		return
+	}
+
+	// only admins can manage the agents
+	if !g.U.Admin {
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// handle the actions
+	if request.Method == http.MethodPost {
+		// Parse form arguments
+		err = request.ParseForm()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		// check if csrf token is valid
+		if !CheckCSRFToken(writer, request, H, g.U.UserSession) {
+			return
+		}
+
+		// enrollment tokens are not bound to an agent
+		switch request.FormValue("action") {
+		case "token":
+			token := gensecret(32)
+			err = satsql.InsertEnrollmentToken(H, token)
+			if err != nil {
+				log.Println(err)
+				g.Errors = append(g.Errors, "Could not create the enrollment token")
+			} else {
+				g.Notices = append(g.Notices, "New enrollment token: "+token+" - start the agent with -agenttoken "+token)
+			}
+			goto DefaultAndExit
+		case "tokendelete":
+			tokenID, err := strconv.ParseInt(request.FormValue("id"), 10, 64)
+			if err == nil {
+				err = satsql.DeleteEnrollmentToken(H, tokenID)
+			}
+			if err != nil {
+				log.Println(err)
+				g.Errors = append(g.Errors, "Could not delete the enrollment token")
+			}
+			goto DefaultAndExit
+		}
+
+		agent, err := satsql.SelectAgent(H, "satagent_id", request.FormValue("id"))
+		if err != nil {
+			log.Println(err)
+			g.Errors = append(g.Errors, "Agent not found")
+			goto DefaultAndExit
+		}
+
+		switch request.FormValue("action") {
+		case "key":
+			// the new key is shown only once
+			agent.AccessKey = gensecret(24)
+			err = satsql.UpdateAgent(H, agent)
+			if err == nil {
+				g.Notices = append(g.Notices, "New key for "+agent.SatAgentName+": "+agent.AccessKey+
+					" - start the agent with -agentkey "+agent.AccessKey)
+			}
+		case "approve":
+			// the agent picks up its own secret with its next call and keeps its location
+			agent.Status = sattypes.AgentApproved
+			agent.LocationFixed = true
+			err = satsql.UpdateAgent(H, agent)
+		case "signreset":
+			// the agent registers a new signing key with its next call
+			agent.PublicKey = ""
+			err = satsql.UpdateAgent(H, agent)
+		case "lock":
+			agent.LocationFixed = !agent.LocationFixed
+			err = satsql.UpdateAgent(H, agent)
+		case "location":
+			// the location is set by admins and locked against the agent
+			location := strings.TrimSpace(request.FormValue("location"))
+			if location == "" {
+				g.Errors = append(g.Errors, "Location is empty")
+				goto DefaultAndExit
+			}
+			agent.SatAgentLocation = location
+			agent.LocationFixed = true
+			err = satsql.UpdateAgent(H, agent)
+		case "disable":
+			agent.Disabled = !agent.Disabled
+			err = satsql.UpdateAgent(H, agent)
+		case "delete":
+			err = satsql.DeleteAgent(H, agent.SatAgentID)
+		default:
+			g.Errors = append(g.Errors, "Unknown action")
+		}
+		if err != nil {
+			log.Println(err)
+			g.Errors = append(g.Errors, "Could not update the agent")
+		}
+		if H.Debug {
+			log.Println("Agent action", request.FormValue("action"), "for", agent.SatAgentName)
+		}
+	}
+
+DefaultAndExit:
+	// retrieve agents and their statistics
+	g.SatAgents, err = satsql.ReadAllAgents(H)
+	if err != nil {
+		log.Println(err)
+	}
+	for i := range g.SatAgents {
+		g.SatAgents[i].ResultsPerMinute = agentStatistics.perMinute(g.SatAgents[i].SatAgentName)
+		g.SatAgents[i].Pool = agentStatistics.pool(g.SatAgents[i].SatAgentName)
+	}
+	g.EnrollmentTokens, err = satsql.ReadEnrollmentTokens(H)
+	if err != nil {
+		log.Println(err)
+	}
+
+	// Default is GET method where we will print out the template
+	executeGlobalAgainstTemplate(writer, "satagents.html", g)
+}
+
+// errAgentNameTaken is returned by localAgentKey for the name of a remote agent
+var errAgentNameTaken = errors.New("the agent name is used by a remote agent, start the server with another " +
+	"-agentname or delete the agent on the agents page")
+
+// localAgentKey registers the embedded agent of the server with the signing key of this run,
+// so it works without the global key, returns the own key of the agent
+func localAgentKey(H sattypes.BaseHandler, name, location, publicKey string) (string, error) {
+	agent, err := satsql.SelectAgent(H, "satagent_name", name)
+	if err == nil {
+		// never take over the key of a remote agent with the same name
+		if !agent.Embedded {
+			return "", fmt.Errorf("%w: %s", errAgentNameTaken, name)
+		}
+		// an agent registered with the global key needs its own, when the global key is turned off
+		if agent.AccessKey == H.SatKey && !H.GlobalKey {
+			agent.AccessKey = gensecret(24)
+		}
+		agent.Status = sattypes.AgentApproved
+		agent.SecretSent = true
+		agent.PublicKey = publicKey
+		return agent.AccessKey, satsql.UpdateAgent(H, agent)
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	agent = sattypes.SatAgentSql{SatAgentName: name, SatAgentLocation: location, AccessKey: gensecret(24),
+		Status: sattypes.AgentApproved, SecretSent: true, PublicKey: publicKey, Embedded: true, LocationFixed: true}
+	err = satsql.InsertAgent(H, agent)
+	if err != nil {
+		return "", err
+	}
+	return agent.AccessKey, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unfoldedip/satsql"
+	"unfoldedip/sattypes"
+)
+
+// testHandler returns a handler with a copy of unfolded-test.sqlite, that is removed after the test
+func testHandler(t *testing.T) sattypes.BaseHandler {
+	t.Helper()
+	data, err := os.ReadFile("unfolded-test.sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "unfolded.sqlite")
+	if err = os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return sattypes.BaseHandler{DB: db, SatKey: "global", GlobalKey: true}
+}
+
+// Test the registration of the embedded agent next to remote agents
+func TestLocalAgentKey(t *testing.T) {
+	H := testHandler(t)
+
+	// the embedded agent registers itself and gets a new signing key on every start
+	key, err := localAgentKey(H, "local", "Munich", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := localAgentKey(H, "local", "Munich", "second")
+	if err != nil || again != key {
+		t.Fatalf("Second start returned key %q and %v", again, err)
+	}
+	agent, _ := satsql.SelectAgent(H, "satagent_name", "local")
+	if !agent.Embedded || agent.PublicKey != "second" {
+		t.Errorf("Embedded agent is %+v", agent)
+	}
+
+	// a remote agent with the same name keeps its key
+	remote := sattypes.SatAgentSql{SatAgentName: "muc1", SatAgentLocation: "Munich", AccessKey: "remote",
+		Status: sattypes.AgentApproved, SecretSent: true, PublicKey: "remote"}
+	if err = satsql.InsertAgent(H, remote); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = localAgentKey(H, "muc1", "Munich", "local"); !errors.Is(err, errAgentNameTaken) {
+		t.Errorf("Taking over a remote agent returned %v", err)
+	}
+	agent, _ = satsql.SelectAgent(H, "satagent_name", "muc1")
+	if agent.AccessKey != "remote" || agent.PublicKey != "remote" || agent.Embedded {
+		t.Errorf("Remote agent was changed to %+v", agent)
+	}
+}
+
+// Test enrollment tokens for new and known agents
+func TestEnrollmentToken(t *testing.T) {
+	H := testHandler(t)
+	sattypes.AgentChannel = make(chan sattypes.AgentSeen, 10)
+	known := sattypes.SatAgentSql{SatAgentName: "muc1", SatAgentLocation: "Munich", AccessKey: "own",
+		Status: sattypes.AgentApproved, SecretSent: true, LocationFixed: true}
+	if err := satsql.InsertAgent(H, known); err != nil {
+		t.Fatal(err)
+	}
+	if err := satsql.InsertEnrollmentToken(H, "token"); err != nil {
+		t.Fatal(err)
+	}
+	enroll := func(name string) (*httptest.ResponseRecorder, bool) {
+		request := httptest.NewRequest("GET", "/agents/config", nil)
+		request.Header.Set("agent-token", "token")
+		request.Header.Set("agent-name", name)
+		request.Header.Set("agent-location", "Berlin")
+		recorder := httptest.NewRecorder()
+		_, ok := CheckAgentAccessKey(recorder, request, H)
+		return recorder, ok
+	}
+
+	// a token never replaces the key of a known agent and is not used up
+	if _, ok := enroll("muc1"); ok {
+		t.Error("Token accepted for a known agent")
+	}
+	agent, _ := satsql.SelectAgent(H, "satagent_name", "muc1")
+	if agent.AccessKey != "own" || !agent.LocationFixed || agent.SatAgentLocation != "Munich" {
+		t.Errorf("Known agent was changed to %+v", agent)
+	}
+
+	// new agents are enrolled with their own secret
+	recorder, ok := enroll("ber1")
+	if !ok {
+		t.Fatal("Token refused for a new agent")
+	}
+	agent, _ = satsql.SelectAgent(H, "satagent_name", "ber1")
+	if secret := recorder.Header().Get("agent-secret"); secret == "" || secret != agent.AccessKey {
+		t.Errorf("Secret %q handed out for agent %+v", secret, agent)
+	}
+
+	// every token works once
+	if _, ok = enroll("ham1"); ok {
+		t.Error("Token accepted twice")
+	}
+}
+
+// Test, that the location of an agent registered with the global key is fixed at the registration
+func TestAgentLocationFixed(t *testing.T) {
+	H := testHandler(t)
+	sattypes.AgentChannel = make(chan sattypes.AgentSeen, 10)
+	contact := func(location string) sattypes.SatAgentSql {
+		request := httptest.NewRequest("GET", "/agents/config", nil)
+		request.Header.Set("agent-key", "global")
+		request.Header.Set("agent-name", "muc1")
+		request.Header.Set("agent-location", location)
+		agent, ok := CheckAgentAccessKey(httptest.NewRecorder(), request, H)
+		if !ok {
+			t.Fatal("Global key refused")
+		}
+		return agent
+	}
+
+	// the agent keeps the location of the first contact
+	contact("Munich")
+	if agent := contact("Berlin"); agent.SatAgentLocation != "Munich" {
+		t.Errorf("Agent moved itself to %q", agent.SatAgentLocation)
+	}
+	agent, _ := satsql.SelectAgent(H, "satagent_name", "muc1")
+	if !agent.LocationFixed || agent.SatAgentLocation != "Munich" {
+		t.Errorf("Stored agent %+v", agent)
+	}
+
+	// admins change the location
+	agent.SatAgentLocation = "Hamburg"
+	if err := satsql.UpdateAgent(H, agent); err != nil {
+		t.Fatal(err)
+	}
+	if agent = contact("Berlin"); agent.SatAgentLocation != "Hamburg" {
+		t.Errorf("Location of the admin replaced by %q", agent.SatAgentLocation)
+	}
+}
+
+// Test, that an agent with a hello without usable check types gets no services, unlike an agent without hello
+func TestAgentsHelloChecks(t *testing.T) {
+	H := testHandler(t)
+	sattypes.AgentChannel = make(chan sattypes.AgentSeen, 10)
+	for _, name := range []string{"legacy", "modern", "future"} {
+		agent := sattypes.SatAgentSql{SatAgentName: name, SatAgentLocation: "Munich", AccessKey: name,
+			Status: sattypes.AgentApproved, SecretSent: true}
+		if err := satsql.InsertAgent(H, agent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hello := func(name, body string) int {
+		request := httptest.NewRequest("POST", "/agents/hello", strings.NewReader(body))
+		request.Header.Set("agent-key", name)
+		request.Header.Set("agent-name", name)
+		request.Header.Set("agent-location", "Munich")
+		recorder := httptest.NewRecorder()
+		agentsHello(recorder, request, H)
+		return recorder.Code
+	}
+	if status := hello("modern", `{"protocol":2,"checks":["tcp","gopher"]}`); status != http.StatusOK {
+		t.Fatalf("Hello answered %d", status)
+	}
+	if status := hello("future", `{"protocol":2,"checks":["gopher"]}`); status != http.StatusOK {
+		t.Fatalf("Hello answered %d", status)
+	}
+
+	tests := []struct {
+		name string
+		runs map[string]bool
+	}{
+		{"legacy", map[string]bool{"tcp": true, "http": true}},
+		{"modern", map[string]bool{"tcp": true, "http": false}},
+		{"future", map[string]bool{"tcp": false, "http": false}},
+	}
+	for _, test := range tests {
+		agent, err := satsql.SelectAgent(H, "satagent_name", test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for checkType, want := range test.runs {
+			if got := agent.CanRun(checkType); got != want {
+				t.Errorf("Agent %s with checks %q can run %s: %v", test.name, agent.Checks, checkType, got)
+			}
+		}
+	}
+}
+
+// Test, that the embedded agent of a database of the first release keeps running after the upgrade
+func TestUpgradedEmbeddedAgent(t *testing.T) {
+	schema, err := os.ReadFile("satsql/testdata/unfolded-first.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "unfolded.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	H := sattypes.BaseHandler{DB: db, SatKey: "global", GlobalKey: true}
+	// the first release registered every agent, also the embedded one, with the global key
+	_, err = db.Exec(string(schema) + "; insert into satagents (satagent_name, access_key, satagent_location) values " +
+		"('muc1', 'global', 'Munich'), ('fra1', 'global', 'Frankfurt'), ('ber1', 'own', 'Berlin')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = satsql.UpgradeSchema(H, "muc1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if key, err := localAgentKey(H, "muc1", "Munich", "public"); err != nil || key != "global" {
+		t.Errorf("Embedded agent after the upgrade got key %q and %v", key, err)
+	}
+	for _, name := range []string{"fra1", "ber1"} {
+		if _, err := localAgentKey(H, name, "Munich", "public"); !errors.Is(err, errAgentNameTaken) {
+			t.Errorf("Taking over the remote agent %s after the upgrade returned %v", name, err)
+		}
+	}
+}
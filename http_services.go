@@ -15,6 +15,9 @@ import (
 	"unfoldedip/sattypes"
 )
 
+// for hardcoded intervals
+var allowedIntervals = []int{5, 15, 30, 60, 90, 120}
+
 // services prints all configured services from a customer
 func services(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
 	var g sattypes.Global
@@ -33,6 +36,12 @@ func services(writer http.ResponseWriter, request *http.Request, H sattypes.Base
 		g.Services = Services
 	}
 
+	// read locations for marking the stale ones
+	g.SatAgentLocations, err = satsql.ReadAgentLocations(H)
+	if err != nil {
+		log.Println(err)
+	}
+
 	// Default is GET method where we will print out the template
 	executeGlobalAgainstTemplate(writer, "services.html", g)
 }
@@ -121,8 +130,6 @@ func serviceAdd(writer http.ResponseWriter, request *http.Request, H sattypes.Ba
 	var err error
 	// for create, edit and checking access
 	var newService, editService, garbageService sattypes.Service
-	// for hardcoded
-	var AllowedIntervals = []int{5, 15, 30, 60, 90, 120}
 
 	// retrieve session
 	if g.U, g.U.LoggedIn = isLoggedIn(request, H); !g.U.LoggedIn {
@@ -149,6 +156,8 @@ func serviceAdd(writer http.ResponseWriter, request *http.Request, H sattypes.Ba
 		"hosttcp",
 		"servicename",
 		"locations",
+		"severity",
+		"timeout",
 	}
 
 	// handle POST
@@ -236,14 +245,23 @@ func serviceAdd(writer http.ResponseWriter, request *http.Request, H sattypes.Ba
 				newService.Interval = func(arg string) int {
 					val, err := strconv.Atoi(arg)
 					if err == nil {
-						for i := range AllowedIntervals {
-							if AllowedIntervals[i] == val {
+						for i := range allowedIntervals {
+							if allowedIntervals[i] == val {
 								return val
 							}
 						}
 					}
 					return 90
 				}(formValue)
+			case "timeout":
+				newService.Timeout = func(arg string) int {
+					val, err := strconv.Atoi(arg)
+					if err != nil || val < 0 || val > sattypes.MaxTimeout {
+						g.Errors = append(g.Errors, fmt.Sprintf("Timeout must be between 1 and %d seconds", sattypes.MaxTimeout))
+						return 0
+					}
+					return val
+				}(formValue)
 			case "contactgroup":
 				newService.ContactGroup = func(arg string) int {
 					val, err := strconv.Atoi(arg)
@@ -284,9 +302,21 @@ func serviceAdd(writer http.ResponseWriter, request *http.Request, H sattypes.Ba
 				newService.Expected = func(arg string) string {
 					return arg
 				}(formValue)
+			case "severity":
+				newService.Severity = func(arg string) string {
+					if arg == sattypes.SeverityCritical {
+						return arg
+					}
+					return sattypes.SeverityNormal
+				}(formValue)
 			}
 		}
 
+		// services without a severity are normal
+		if newService.Severity == "" {
+			newService.Severity = sattypes.SeverityNormal
+		}
+
 		// make some combination check, for example if checktype is ping, we
 		// need a hostname or an ip address, if checktype is http we need
 		// httpurl value set
@@ -352,7 +382,7 @@ func serviceAdd(writer http.ResponseWriter, request *http.Request, H sattypes.Ba
 
 DefaultAndExit:
 	// Pass some defaults down the template
-	g.AllowedIntervals = AllowedIntervals
+	g.AllowedIntervals = allowedIntervals
 	if g.Service.ServiceID == 0 {
 		g.Service.Interval = 90
 	}
@@ -515,3 +545,65 @@ DefaultAndExit:
 	writer.WriteHeader(http.StatusNoContent)
 	return
 }
+
+// serviceAck handles the acknowledge link from the notification mails,
+// GET will ask for confirmation, POST will write the acknowledgement into the service log
+func serviceAck(writer http.ResponseWriter, request *http.Request, H sattypes.BaseHandler) {
+	// local variables
+	var g sattypes.Global
+	var ackService sattypes.Service
+	var serviceID string
+	var err error
+
+	// retrieve session
+	if g.U, g.U.LoggedIn = isLoggedIn(request, H); !g.U.LoggedIn {
+		http.Redirect(writer, request, "/login?session=expired8", http.StatusSeeOther)
+		return
+	}
+
+	/* read params from form  */
+	err = request.ParseForm()
+	if err != nil {
+		log.Println(err)
+		http.Redirect(writer, request, "/services", http.StatusSeeOther)
+		return
+	}
+
+	// read serviceID
+	serviceID = request.FormValue("id")
+	if serviceID == "" {
+		log.Println("No id for service acknowledge")
+		http.Redirect(writer, request, "/services", http.StatusSeeOther)
+		return
+	}
+
+	// retrieve service by service_id, only the owner can acknowledge
+	ackService, err = satsql.SelectService(H, "service_id", serviceID, g.U.UserID)
+	if err != nil || ackService.OwnerID != g.U.UserID {
+		if H.Debug {
+			log.Println("Not allowing access for service acknowledge or service not existing")
+		}
+		http.Redirect(writer, request, "/services", http.StatusSeeOther)
+		return
+	}
+
+	if request.Method == http.MethodPost {
+		// check if csrf token is valid
+		if !CheckCSRFToken(writer, request, H, g.U.UserSession) {
+			return
+		}
+
+		// the acknowledgement is part of the service log
+		err = satsql.InsertServiceAck(H, ackService.ServiceID,
+			strings.TrimPrefix(ackService.ServiceState, "SERVICE_"), g.U.Email)
+		if err != nil {
+			log.Println(err)
+		}
+		http.Redirect(writer, request, fmt.Sprintf("/service_logs?id=%d", ackService.ServiceID), http.StatusSeeOther)
+		return
+	}
+
+	// Default is GET method where we will print out the template
+	g.Service = ackService
+	executeGlobalAgainstTemplate(writer, "service_ack.html", g)
+}
@@ -4,15 +4,25 @@ package main
 // MIT License
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"database/sql"
+	"encoding/base64"
+	"errors"
 	"flag"
 	"html/template"
 	"log"
 	_ "modernc.org/sqlite"
 	"net/http"
-	"sync"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 	"unfoldedip/satagent"
 	"unfoldedip/satanalytics"
+	"unfoldedip/satca"
+	"unfoldedip/satsql"
 	"unfoldedip/sattypes"
 )
 
@@ -29,26 +39,85 @@ func init() {
 func main() {
 	var err error
 	var SMTPConfig sattypes.SMTPConfiguration
-	wg := sync.WaitGroup{}
+	var TLSConfig serverTLS
+	// listeners, agents and analytics, that are stopped on shutdown
+	var servers []*http.Server
+	var agentShutdowns []func(context.Context) error
+	var analyticsShutdown func(context.Context) error
+
+	// subcommand for the built-in certificate authority
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		if err = caCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	// command line arguments for server
 	httpAddr := flag.String("http", "127.0.0.1:8080", "port for the default listener  (server)")
 	dbFile := flag.String("db", "unfolded.sqlite", "path to the sqlite database filer (server)")
 	server := flag.Bool("server", true, "server / http mode enabled, -server=false for disabling")
+	// command line arguments for the native TLS listener
+	flag.StringVar(&TLSConfig.CertFile, "tls-cert", "", "certificate for serving the web panel with TLS on the http port")
+	flag.StringVar(&TLSConfig.KeyFile, "tls-key", "", "key for the certificate of -tls-cert")
+	flag.BoolVar(&TLSConfig.ACME, "acme", false, "obtain and renew the certificate for the host of serverurl with ACME")
+	flag.StringVar(&TLSConfig.ACMEDirectory, "acme-directory", "", "ACME directory url (default Let's Encrypt)")
+	flag.StringVar(&TLSConfig.ACMECA, "acme-ca", "", "PEM file with the CA of the ACME directory, e.g. for Pebble")
+	flag.StringVar(&TLSConfig.ACMECache, "acme-cache", "acme-cache", "directory for caching ACME account and certificates")
+	flag.StringVar(&TLSConfig.ACMEEmail, "acme-email", "", "contact email for the ACME account")
+	flag.StringVar(&TLSConfig.Redirect, "redirect", "", "listener for redirecting HTTP to HTTPS and ACME http-01 challenges, e.g. 0.0.0.0:80")
 	// command line arguments for smtp interface
 	flag.StringVar(&SMTPConfig.SmtpServer, "smtp", "", "server for smtp sendmail function")
 	flag.StringVar(&SMTPConfig.SmtpUser, "smtpuser", "", "login for smtp authentication")
 	flag.StringVar(&SMTPConfig.SmtpPassword, "smtppass", "", "password for smtp authentication")
 	flag.StringVar(&SMTPConfig.SmtpSender, "smtpsender", "", "sender email source for all mails")
+	flag.StringVar(&SMTPConfig.SmtpMode, "smtpmode", sattypes.SMTPModeStartTLS, "smtp transport security: none, starttls or tls (implicit, port 465)")
+	flag.StringVar(&SMTPConfig.SmtpAuth, "smtpauth", "", "smtp auth mechanism: none, plain, login or cram-md5 (default plain, if smtpuser is set)")
+	flag.StringVar(&SMTPConfig.SmtpCAFile, "smtpca", "", "PEM file with a custom CA for verifying the smtp server certificate")
+	flag.BoolVar(&SMTPConfig.SmtpInsecure, "smtpinsecure", false, "skip verification of the smtp server certificate")
+	flag.StringVar(&SMTPConfig.SmtpHelo, "smtphelo", "", "name for the smtp HELO/EHLO greeting (default hostname)")
+	summaryHour := flag.Int("summaryhour", 7, "local hour for sending the daily summary to alert groups, -1 for disabling")
+	agentSilence := flag.Duration("agentsilence", time.Minute*10, "period after a silent agent is considered dead, 0 for disabling")
+	adminAlertGroup := flag.Int64("adminalertgroup", 0, "id of the alert group, that is notified about dead and recovered agents")
+	agentMaxLag := flag.Duration("agentmaxlag", time.Second*30, "delay of checks after an agent is considered overloaded, 0 for disabling")
+	agentMaxSkew := flag.Duration("agentmaxskew", time.Second*10, "offset of the agent clock to the server clock after it is considered skewed, 0 for disabling")
+	agentTLS := flag.String("agenttls", "", "port for the mutual TLS listener for agents, e.g. 0.0.0.0:8443 (server)")
+	agentTLSCert := flag.String("agenttlscert", "ca/server.crt", "server certificate for the mutual TLS listener")
+	agentTLSKey := flag.String("agenttlskey", "ca/server.key", "server key for the mutual TLS listener")
+	agentCA := flag.String("agentca", "ca/ca.crt", "CA certificate for verifying agent client certificates")
+	agentCRL := flag.String("agentcrl", "ca/ca.crl", "revocation list for agent client certificates, empty for disabling")
+	enrollAgents := flag.Bool("enroll", false, "new agents connecting with the global key stay pending till an admin approves them")
+	requireSigned := flag.Bool("requiresigned", false, "refuse results from agents without a registered signing key")
+	metricsToken := flag.String("metricstoken", "", "bearer token for scraping /metrics")
+	metricsAllow := flag.String("metricsallow", "", "addresses and networks allowed to scrape /metrics without token, e.g. 127.0.0.1,10.0.0.0/8")
+	globalKey := flag.Bool("globalkey", true, "accept the global agentkey for new and not yet enrolled agents, -globalkey=false for disabling")
 	// command line arguments for client
 	agent := flag.Bool("agent", true, "satellite (satagent) mode only")
 	agentLocation := flag.String("agentloc", "Munich", "satagent location")
 	agentOnlyLocation := flag.Bool("onlylocation", false, "boolean to control, if the agent can do any check or only for his location")
 	agentName := flag.String("agentname", "muc1", "satagent name")
 	serverURL := flag.String("serverurl", "http://localhost:8080", "url for satserver")
+	agentToken := flag.String("agenttoken", "", "one time enrollment token, created by an admin in the web panel")
+	agentCert := flag.String("agentcert", "", "client certificate of the agent for the mutual TLS listener")
+	agentCertKey := flag.String("agentcertkey", "", "key of the client certificate of the agent")
+	serverCA := flag.String("serverca", "", "CA certificate for verifying the server certificate, default system roots")
+	agentSignKey := flag.String("agentsignkey", "satagent.signkey", "file with the Ed25519 key for signing results, created on the first start, empty for disabling")
+	spoolFile := flag.String("spool", "satagent.spool", "file for keeping unsent results during server outages, empty for memory only")
+	spoolSize := flag.Int("spoolsize", 10000, "maximum number of unsent results, the oldest are evicted first")
+	configCache := flag.String("configcache", "satagent.config", "file for caching the services for starting without the server, empty for disabling")
+	workers := flag.Int("workers", 32, "maximum number of concurrent checks of the agent")
+	queueSize := flag.Int("queuesize", 1024, "maximum number of due checks waiting for a worker, further checks are skipped")
+	typeLimits := flag.String("typelimits", "ping=8", "maximum number of concurrent checks per type, e.g. ping=8,http=16")
+	longPoll := flag.Int("longpoll", 55, "seconds, the server may hold a configuration pull till a service changes, 0 for periodic pulls only")
+	heartbeat := flag.Duration("heartbeat", time.Minute, "interval for sending the health of the agent to the server, 0 for disabling")
+	jitter := flag.Float64("jitter", 0, "delay every check by a random part of its interval up to this fraction, e.g. 0.1")
+	exporterAddr := flag.String("exporter", "", "port for exporting the results of -exporterconfig to Prometheus without server, e.g. 127.0.0.1:9115")
+	exporterConfig := flag.String("exporterconfig", "exporter.json", "file with the services for the exporter")
+	agentSecret := flag.String("agentsecret", "satagent.secret", "file for saving the own secret of the agent, empty for disabling")
 	// both
 	agentKey := flag.String("agentkey", "0000", "shared access key for submitting to the satkey")
 	debug := flag.Bool("debug", false, "turns on debug mode")
+	shutdownTimeout := flag.Duration("shutdowntimeout", time.Second*10, "maximum time for sending pending results and mails on SIGINT or SIGTERM")
 
 	// parse command line arguments
 	flag.Parse()
@@ -57,6 +126,25 @@ func main() {
 	BaseHandler.Debug = *debug
 	BaseHandler.SatKey = *agentKey
 	BaseHandler.SMTPConfiguration = SMTPConfig
+	BaseHandler.SummaryHour = *summaryHour
+	BaseHandler.AgentSilence = *agentSilence
+	BaseHandler.AdminAlertGroup = *adminAlertGroup
+	BaseHandler.AgentMaxLag = *agentMaxLag
+	BaseHandler.AgentMaxSkew = *agentMaxSkew
+	BaseHandler.EnrollAgents = *enrollAgents
+	BaseHandler.GlobalKey = *globalKey
+	BaseHandler.RequireSigned = *requireSigned
+	BaseHandler.MetricsToken = *metricsToken
+	BaseHandler.MetricsAllow, err = parseMetricsAllow(*metricsAllow)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// limits for the checks of the agents
+	limits, err := satagent.ParseTypeLimits(*typeLimits)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// todo generate random key
 	// if no function is enabled, quit right now
@@ -65,10 +153,56 @@ func main() {
 		return
 	}
 
-	// Start satellite agent
-	if *agent {
+	// SIGINT and SIGTERM start the shutdown, a second signal quits right away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Start exporter, a satellite agent with the services of a local file, that is scraped by Prometheus
+	if *agent && !*server && *exporterAddr != "" {
+		s := satagent.CreateSatAgent(*serverURL, *agentName, *agentLocation, *agentOnlyLocation, BaseHandler)
+		if err = s.SetExporter(*exporterConfig); err != nil {
+			log.Fatal(err)
+		}
+		s.SetPool(*workers, *queueSize, limits)
+		s.SetJitter(*jitter)
+		exporterServer := &http.Server{Addr: *exporterAddr, Handler: s.ExporterHandler()}
+		servers = append(servers, exporterServer)
+		serve(func() error {
+			log.Println("satagent: Starting exporter listener on", *exporterAddr)
+			return exporterServer.ListenAndServe()
+		})
+		agentShutdowns = append(agentShutdowns, s.Shutdown)
+		go s.Run()
+	}
+
+	// Start remote satellite agent, the embedded agent is started with the server
+	if *agent && !*server && *exporterAddr == "" {
 		s := satagent.CreateSatAgent(*serverURL, *agentName, *agentLocation, *agentOnlyLocation, BaseHandler)
-		wg.Add(1)
+		s.SatToken = *agentToken
+		s.SatSecretFile = *agentSecret
+		// a key passed on the command line replaces the saved secret, when the server refuses it
+		keyPassed := false
+		flag.Visit(func(f *flag.Flag) { keyPassed = keyPassed || f.Name == "agentkey" })
+		s.LoadSecret(keyPassed)
+		s.SetSpool(*spoolFile, *spoolSize)
+		s.SetConfigCache(*configCache)
+		s.SetPool(*workers, *queueSize, limits)
+		s.SetJitter(*jitter)
+		s.SetLongPoll(*longPoll)
+		s.SetHeartbeat(*heartbeat)
+		if *agentSignKey != "" {
+			if err = s.LoadSigningKey(*agentSignKey); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *agentCert != "" {
+			tlsConfig, err := satca.ClientTLSConfig(*agentCert, *agentCertKey, *serverCA)
+			if err != nil {
+				log.Fatal(err)
+			}
+			s.SetTLSConfig(tlsConfig)
+		}
+		agentShutdowns = append(agentShutdowns, s.Shutdown)
 		go s.Run()
 	}
 
@@ -85,15 +219,48 @@ func main() {
 		BaseHandler.DB.SetMaxOpenConns(1)
 		// close on exit
 		defer BaseHandler.DB.Close()
+		// add the tables and columns of newer releases to an older database
+		err = satsql.UpgradeSchema(BaseHandler, *agentName)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		// Start embedded satellite agent, registered with its own key
+		if *agent {
+			publicKey, signingKey, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				log.Panic(err)
+			}
+			key, err := localAgentKey(BaseHandler, *agentName, *agentLocation, base64.StdEncoding.EncodeToString(publicKey))
+			if errors.Is(err, errAgentNameTaken) {
+				// the server runs without the embedded agent, so the admin can fix it on the agents page
+				log.Println("Not starting the embedded agent:", err)
+			} else if err != nil {
+				log.Panic(err)
+			} else {
+				agentHandler := BaseHandler
+				agentHandler.SatKey = key
+				s := satagent.CreateSatAgent(*serverURL, *agentName, *agentLocation, *agentOnlyLocation, agentHandler)
+				s.SatSigningKey = signingKey
+				s.SetPool(*workers, *queueSize, limits)
+				s.SetJitter(*jitter)
+				s.SetLongPoll(*longPoll)
+				s.SetHeartbeat(*heartbeat)
+				agentShutdowns = append(agentShutdowns, s.Shutdown)
+				go s.Run()
+			}
+		}
 
 		// init resultsChannel
 		// with buffer till 100 messages
 		sattypes.ResultsChannel = make(chan sattypes.ServiceResult, 128)
+		// init agentChannel, agents are dropped, when full
+		sattypes.AgentChannel = make(chan sattypes.AgentSeen, 128)
 
 		// HTTP server will contain the  sat analytics thread,
 		// so we need to create one
 		satAnalytics := satanalytics.CreateSatAnalytics("main", BaseHandler)
-		wg.Add(1)
+		analyticsShutdown = satAnalytics.Shutdown
 		go satAnalytics.Run()
 
 		// Compile and parse all templates for the web-panel
@@ -119,6 +286,8 @@ func main() {
 		http.HandleFunc("/service_delete", func(writer http.ResponseWriter, request *http.Request) { serviceDelete(writer, request, BaseHandler) })
 		// function to reset the service to unknown
 		http.HandleFunc("/service_reset", func(writer http.ResponseWriter, request *http.Request) { serviceReset(writer, request, BaseHandler) })
+		// function to acknowledge a service incident from the notification mail
+		http.HandleFunc("/service_ack", func(writer http.ResponseWriter, request *http.Request) { serviceAck(writer, request, BaseHandler) })
 		// function to list user services
 		http.HandleFunc("/services", func(writer http.ResponseWriter, request *http.Request) { services(writer, request, BaseHandler) })
 		// function to handle the services_log call
@@ -137,6 +306,42 @@ func main() {
 		http.HandleFunc("/alertgroup_delete", func(writer http.ResponseWriter, request *http.Request) {
 			alertgroupDelete(writer, request, BaseHandler)
 		})
+		// add a notification schedule to an alert group
+		http.HandleFunc("/alertgroup_schedule_add", func(writer http.ResponseWriter, request *http.Request) {
+			alertgroupScheduleAdd(writer, request, BaseHandler)
+		})
+		// delete a notification schedule of an alert group
+		http.HandleFunc("/alertgroup_schedule_delete", func(writer http.ResponseWriter, request *http.Request) {
+			alertgroupScheduleDelete(writer, request, BaseHandler)
+		})
+		// function to list on-call rotations
+		http.HandleFunc("/rotations", func(writer http.ResponseWriter, request *http.Request) { rotations(writer, request, BaseHandler) })
+		// function to add on-call rotations
+		http.HandleFunc("/rotation_add", func(writer http.ResponseWriter, request *http.Request) { rotationAdd(writer, request, BaseHandler) })
+		// function to edit on-call rotations
+		http.HandleFunc("/rotation_edit", func(writer http.ResponseWriter, request *http.Request) { rotationAdd(writer, request, BaseHandler) })
+		// function to delete on-call rotations
+		http.HandleFunc("/rotation_delete", func(writer http.ResponseWriter, request *http.Request) {
+			rotationDelete(writer, request, BaseHandler)
+		})
+		// add an override to an on-call rotation
+		http.HandleFunc("/rotation_override_add", func(writer http.ResponseWriter, request *http.Request) {
+			rotationOverrideAdd(writer, request, BaseHandler)
+		})
+		// delete an override of an on-call rotation
+		http.HandleFunc("/rotation_override_delete", func(writer http.ResponseWriter, request *http.Request) {
+			rotationOverrideDelete(writer, request, BaseHandler)
+		})
+		// function to manage the satellite agents (admins only)
+		http.HandleFunc("/satagents", func(writer http.ResponseWriter, request *http.Request) { satAgents(writer, request, BaseHandler) })
+		// function to handle the JSON api
+		http.HandleFunc("/api/v1/", func(writer http.ResponseWriter, request *http.Request) { api(writer, request, BaseHandler) })
+		// function to export metrics for Prometheus, off without token and allowed addresses
+		if BaseHandler.MetricsToken != "" || len(BaseHandler.MetricsAllow) > 0 {
+			http.HandleFunc("/metrics", func(writer http.ResponseWriter, request *http.Request) {
+				metrics(writer, request, BaseHandler, satAnalytics.Metrics)
+			})
+		}
 		// function to handle requests to "/"
 		http.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
 			// redirect to /services-dashboard, if path is ending with /
@@ -149,20 +354,93 @@ func main() {
 		})
 
 		// functions to handle GET and POST calls by our monitoring satellite agents
+		// handler to take version, OS and check types of the agent
+		http.HandleFunc("/agents/hello", func(writer http.ResponseWriter, request *http.Request) { agentsHello(writer, request, BaseHandler) })
+		// handler to take the health of the agent
+		http.HandleFunc("/agents/heartbeat", func(writer http.ResponseWriter, request *http.Request) { agentsHeartbeat(writer, request, BaseHandler) })
 		// handler to send satellite configuration
 		http.HandleFunc("/agents/config", func(writer http.ResponseWriter, request *http.Request) { agentsConfig(writer, request, BaseHandler) })
 		// handler to  retrieve service results
 		http.HandleFunc("/agents/results", func(writer http.ResponseWriter, request *http.Request) { agentsResults(writer, request, BaseHandler) })
 
-		// start http listener socket
-		log.Println("satserver: Starting listener")
-		err = http.ListenAndServe(*httpAddr, nil)
-		if err != nil {
-			// can't start the HTTP server, then we better quit
-			log.Fatal(err)
+		// start mutual TLS listener for agents with client certificates
+		if *agentTLS != "" {
+			tlsConfig, err := satca.ServerTLSConfig(*agentTLSCert, *agentTLSKey, *agentCA, *agentCRL)
+			if err != nil {
+				log.Fatal(err)
+			}
+			agentMux := http.NewServeMux()
+			agentMux.HandleFunc("/agents/hello", func(writer http.ResponseWriter, request *http.Request) { agentsHello(writer, request, BaseHandler) })
+			agentMux.HandleFunc("/agents/heartbeat", func(writer http.ResponseWriter, request *http.Request) { agentsHeartbeat(writer, request, BaseHandler) })
+			agentMux.HandleFunc("/agents/config", func(writer http.ResponseWriter, request *http.Request) { agentsConfig(writer, request, BaseHandler) })
+			agentMux.HandleFunc("/agents/results", func(writer http.ResponseWriter, request *http.Request) { agentsResults(writer, request, BaseHandler) })
+			agentServer := &http.Server{Addr: *agentTLS, Handler: agentMux, TLSConfig: tlsConfig}
+			servers = append(servers, agentServer)
+			serve(func() error {
+				log.Println("satserver: Starting mutual TLS listener for agents on", *agentTLS)
+				// certificates are already loaded into the TLS configuration
+				return agentServer.ListenAndServeTLS("", "")
+			})
+		}
+
+		// start http or https listener socket
+		panelServer := &http.Server{Addr: *httpAddr}
+		servers = append(servers, panelServer)
+		if TLSConfig.enabled() {
+			redirectServer, err := TLSConfig.setup(panelServer, *serverURL)
+			if err != nil {
+				// can't start the HTTP server, then we better quit
+				log.Fatal(err)
+			}
+			if redirectServer != nil {
+				servers = append(servers, redirectServer)
+				serve(func() error {
+					log.Println("satserver: Starting HTTP redirect listener on", redirectServer.Addr)
+					return redirectServer.ListenAndServe()
+				})
+			}
+			serve(func() error { return TLSConfig.listenAndServe(panelServer) })
+		} else {
+			serve(func() error {
+				log.Println("satserver: Starting listener")
+				return panelServer.ListenAndServe()
+			})
+		}
+	}
+
+	// Wait for SIGINT or SIGTERM
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down, waiting up to", *shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	// agents send their pending results first, while the server is still accepting them
+	for _, shutdown := range agentShutdowns {
+		if err := shutdown(shutdownCtx); err != nil {
+			log.Println("satagent:", err)
+		}
+	}
+	// listeners stop accepting and finish the running requests, agents waiting for a configuration change are answered
+	sattypes.AgentConfig.Close()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Println("satserver:", err)
+		}
+	}
+	// analytics handles the remaining results and finishes sending mails
+	if analyticsShutdown != nil {
+		if err := analyticsShutdown(shutdownCtx); err != nil {
+			log.Println("satanalytics:", err)
 		}
 	}
+}
 
-	// Wait for thread if any is still active
-	wg.Wait()
+// serve runs a listener in the background, a listener, that fails, quits the program
+func serve(listen func() error) {
+	go func() {
+		if err := listen(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
 }
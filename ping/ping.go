@@ -3,9 +3,11 @@ package ping
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"os/exec"
 	"runtime"
 	"strings"
@@ -87,8 +89,23 @@ func CreatePing(hostname string, toSendPkts int) (*Pinger, error) {
 
 }
 
-// CreatePing creates and returns Ping object
+// Available returns true, if the ping program for this OS is installed
+func Available() bool {
+	p, err := CreatePing("127.0.0.1", 1)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(p.ExecPath)
+	return err == nil
+}
+
+// Run runs the ping program till all packets are sent
 func (p *Pinger) Run() (pingStats, error) {
+	return p.RunContext(context.Background())
+}
+
+// RunContext runs the ping program, the program is killed, when the context is done
+func (p *Pinger) RunContext(ctx context.Context) (pingStats, error) {
 	// error and return value
 	var err error
 	var stats pingStats
@@ -100,12 +117,15 @@ func (p *Pinger) Run() (pingStats, error) {
 	pingArgs = append(pingArgs, "-c", fmt.Sprintf("%d", p.ToSend), p.Hostname)
 
 	// run command
-	cmd := exec.Command(p.ExecPath, pingArgs[0:]...)
+	cmd := exec.CommandContext(ctx, p.ExecPath, pingArgs[0:]...)
 	cmd.Stdout = p.wout
 	cmd.Stderr = p.werr
 
 	// execute ping
 	if err = cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
 		if exitError, ok := err.(*exec.ExitError); ok {
 			// 1 or 2 could be the exit code for ping
 			// when host in not reachable
@@ -0,0 +1,244 @@
+package satagent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unfoldedip/sattypes"
+)
+
+// withHello answers the hello of the agent like the server and passes all other requests to handler
+func withHello(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/agents/hello" {
+			_ = json.NewEncoder(writer).Encode(sattypes.ServerHello{Protocol: sattypes.ProtocolVersion})
+			return
+		}
+		handler(writer, request)
+	})
+}
+
+func TestConfigCache(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "satagent.config")
+	services := []sattypes.Service{{ServiceID: 1, Type: "tcp", ToCheck: "127.0.0.1:1", Interval: 30}}
+
+	server := httptest.NewServer(withHello(func(writer http.ResponseWriter, request *http.Request) {
+		_ = json.NewEncoder(writer).Encode(services)
+	}))
+
+	s := CreateSatAgent(server.URL, "agent", "location", false, sattypes.BaseHandler{})
+	s.SetConfigCache(file)
+	if err := s.pullServerConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	// a new agent can not reach the server and runs from the cache
+	s = CreateSatAgent(server.URL, "agent", "location", false, sattypes.BaseHandler{})
+	s.SetConfigCache(file)
+	if err := s.pullServerConfiguration(); err == nil {
+		t.Fatal("Pulled configuration from a closed server")
+	}
+	if !s.loadConfigCache() {
+		t.Fatal("Configuration cache not loaded")
+	}
+	if len(s.satServices) != 1 || s.satServices[0].ToCheck != "127.0.0.1:1" || s.schedule.byID[1] == nil {
+		t.Errorf("Services from cache are %v", s.satServices)
+	}
+
+	// backoff doubles till the limit
+	seconds := 0
+	for _, expected := range []int{2, 4, 8, 16} {
+		if seconds = backoff(seconds); seconds != expected {
+			t.Errorf("Backoff is %d, expected %d", seconds, expected)
+		}
+	}
+	if backoff(maxRetrySeconds) != maxRetrySeconds {
+		t.Error("Backoff exceeds the limit")
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	version := sattypes.NewConfigVersion()
+	services := []sattypes.Service{{ServiceID: 1, Type: "tcp", ToCheck: "127.0.0.1:1", Interval: 30}}
+	var mutex sync.Mutex
+	var full int32
+
+	// answers like the server, unchanged configurations are not sent again
+	server := httptest.NewServer(withHello(func(writer http.ResponseWriter, request *http.Request) {
+		etag, changed := version.Current()
+		if request.Header.Get("If-None-Match") == etag && request.Header.Get("agent-wait") != "" {
+			select {
+			case <-changed:
+			case <-time.After(time.Second * 5):
+			case <-request.Context().Done():
+			}
+			etag, _ = version.Current()
+		}
+		writer.Header().Set("ETag", etag)
+		writer.Header().Set("agent-longpoll", "120")
+		if request.Header.Get("If-None-Match") == etag {
+			writer.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&full, 1)
+		mutex.Lock()
+		defer mutex.Unlock()
+		_ = json.NewEncoder(writer).Encode(services)
+	}))
+	defer server.Close()
+
+	s := CreateSatAgent(server.URL, "agent", "location", false, sattypes.BaseHandler{})
+	s.SetLongPoll(5)
+	if err := s.pullServerConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+	// the unchanged configuration is not sent again
+	if err := s.pullServerConfiguration(); err != nil || atomic.LoadInt32(&full) != 1 {
+		t.Fatalf("Unchanged configuration sent %d times, %v", full, err)
+	}
+
+	// a new service is pushed to the waiting agent
+	s.startLongPoll()
+	defer s.Stop()
+	time.Sleep(time.Millisecond * 50)
+	mutex.Lock()
+	services = append(services, sattypes.Service{ServiceID: 2, Type: "tcp", ToCheck: "127.0.0.1:2", Interval: 30})
+	mutex.Unlock()
+	start := time.Now()
+	version.Changed()
+	for time.Since(start) < time.Second*2 {
+		s.satServicesMutex.Lock()
+		n := len(s.satServices)
+		s.satServicesMutex.Unlock()
+		if n == 2 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Error("Changed configuration not received while waiting")
+}
+
+func TestHello(t *testing.T) {
+	var hello sattypes.AgentHello
+	var pulls int32
+	legacy := false
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/agents/hello" {
+			if legacy {
+				http.NotFound(writer, request)
+				return
+			}
+			_ = json.NewDecoder(request.Body).Decode(&hello)
+			_ = json.NewEncoder(writer).Encode(sattypes.ServerHello{Protocol: sattypes.ProtocolVersion})
+			return
+		}
+		atomic.AddInt32(&pulls, 1)
+		_ = json.NewEncoder(writer).Encode([]sattypes.Service{{ServiceID: 1, Type: "tcp", ToCheck: "127.0.0.1:1"}})
+	}))
+	defer server.Close()
+
+	// the hello is sent once before the first pull
+	s := CreateSatAgent(server.URL, "agent", "location", false, sattypes.BaseHandler{})
+	for i := 0; i < 2; i++ {
+		if err := s.pullServerConfiguration(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hello.Protocol != sattypes.ProtocolVersion || hello.OS == "" || len(hello.Checks) < 3 || s.serverProtocol != sattypes.ProtocolVersion {
+		t.Errorf("Hello is %+v, server protocol %d", hello, s.serverProtocol)
+	}
+
+	// servers without the hello speak protocol version 1
+	legacy = true
+	s = CreateSatAgent(server.URL, "agent", "location", false, sattypes.BaseHandler{})
+	if err := s.pullServerConfiguration(); err != nil || s.serverProtocol != 1 || len(s.satServices) != 1 {
+		t.Errorf("Pull from legacy server with protocol %d: %v", s.serverProtocol, err)
+	}
+	if pulls != 3 {
+		t.Errorf("%d pulls, expected 3", pulls)
+	}
+}
+
+// Test the key of -agentkey replacing a saved secret, that the server refuses after a rotation
+func TestRotatedKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "satagent.secret")
+	if err := os.WriteFile(file, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(withHello(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("agent-key") != "rotated" {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_ = json.NewEncoder(writer).Encode([]sattypes.Service{{ServiceID: 1, Type: "tcp", ToCheck: "127.0.0.1:1"}})
+	}))
+	defer server.Close()
+
+	// the saved secret wins over a key, that is not passed explicitly
+	s := CreateSatAgent(server.URL, "agent", "location", false, sattypes.BaseHandler{SatKey: "rotated"})
+	s.SatSecretFile = file
+	s.LoadSecret(false)
+	if s.SatKey != "old" || s.satNextKey != "" {
+		t.Fatalf("Key is %q, next key %q", s.SatKey, s.satNextKey)
+	}
+
+	s = CreateSatAgent(server.URL, "agent", "location", false, sattypes.BaseHandler{SatKey: "rotated"})
+	s.SatSecretFile = file
+	s.LoadSecret(true)
+	if s.SatKey != "old" {
+		t.Fatalf("Key is %q before the server refused it", s.SatKey)
+	}
+	if err := s.pullServerConfiguration(); err == nil {
+		t.Fatal("Server accepted the old secret")
+	}
+	if err := s.pullServerConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+	if secret, _ := os.ReadFile(file); string(secret) != "rotated\n" {
+		t.Errorf("Secret file holds %q", secret)
+	}
+}
+
+func TestEnrollThenPull(t *testing.T) {
+	var mutex sync.Mutex
+	enrolled := false
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		// like the server, tokens enroll unknown agents only
+		if token := request.Header.Get("agent-token"); token != "" {
+			if token != "token" || enrolled {
+				writer.WriteHeader(http.StatusForbidden)
+				return
+			}
+			enrolled = true
+			writer.Header().Set("agent-secret", "own")
+		} else if request.Header.Get("agent-key") != "own" {
+			writer.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if request.URL.Path == "/agents/hello" {
+			_ = json.NewEncoder(writer).Encode(sattypes.ServerHello{Protocol: sattypes.ProtocolVersion})
+			return
+		}
+		_ = json.NewEncoder(writer).Encode([]sattypes.Service{{ServiceID: 1, Type: "tcp", ToCheck: "127.0.0.1:1"}})
+	}))
+	defer server.Close()
+
+	// the hello enrolls the agent, the pull right after it uses the own secret
+	s := CreateSatAgent(server.URL, "agent", "location", false, sattypes.BaseHandler{})
+	s.SatToken = "token"
+	if err := s.pullServerConfiguration(); err != nil {
+		t.Fatal(err)
+	}
+	if s.SatKey != "own" || s.SatToken != "" || len(s.satServices) != 1 {
+		t.Errorf("Agent has key %q, token %q and %d services", s.SatKey, s.SatToken, len(s.satServices))
+	}
+}
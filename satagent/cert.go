@@ -1,6 +1,7 @@
 package satagent
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"strings"
@@ -8,20 +9,23 @@ import (
 	"unfoldedip/sattypes"
 )
 
-// TLSCertCheck runs a TLS dial against a target and checks the certificate chain
-func (s *satAgent) TLSCertCheck(service sattypes.Service) sattypes.ServiceResult {
+// TLSCertCheck runs a TLS dial against a target and checks the certificate chain, till the context is done
+func (s *satAgent) TLSCertCheck(ctx context.Context, service sattypes.Service) sattypes.ServiceResult {
 	// prepare result set
 	var sResult sattypes.ServiceResult
 	sResult.Status = sattypes.ServiceUP
 	sResult.ServiceID = service.ServiceID
 
-	// build up tls connection with TCP
-	conn, err := tls.Dial("tcp", service.ToCheck, nil)
+	// build up tls connection with TCP, the timeout is set by the context
+	var tlsDialer tls.Dialer
+	netConn, err := tlsDialer.DialContext(ctx, "tcp", service.ToCheck)
 	if err != nil {
 		sResult.Status = sattypes.ServiceDown
 		sResult.Message = err.Error()
 		return sResult
 	}
+	conn := netConn.(*tls.Conn)
+	defer conn.Close()
 
 	// split host and port path for hostname verification
 	hostPort := strings.Split(service.ToCheck, ":")
@@ -0,0 +1,247 @@
+package satagent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unfoldedip/sattypes"
+)
+
+// exporter keeps the last result of every service from a local configuration file
+// for scraping by Prometheus, the agent never talks to a server
+type exporter struct {
+	// services from the configuration file
+	services []sattypes.Service
+	// last result and the number of checks per service
+	mutex  sync.Mutex
+	last   map[int64]sattypes.ServiceResult
+	checks map[int64]int64
+}
+
+// SetExporter runs the services of the local configuration file instead of pulling them from the server,
+// the results are kept for the handler of ExporterHandler, must be called before Run
+func (s *satAgent) SetExporter(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var services []sattypes.Service
+	err = json.Unmarshal(data, &services)
+	if err != nil {
+		return fmt.Errorf("invalid exporter configuration %s: %w", file, err)
+	}
+
+	e := &exporter{last: make(map[int64]sattypes.ServiceResult), checks: make(map[int64]int64)}
+	ids := make(map[int64]bool)
+	for i, service := range services {
+		// services without id are numbered by their position
+		if service.ServiceID == 0 {
+			service.ServiceID = int64(i + 1)
+		}
+		if ids[service.ServiceID] {
+			return fmt.Errorf("duplicate service id %d in exporter configuration %s", service.ServiceID, file)
+		}
+		ids[service.ServiceID] = true
+		if !s.canRun(service.Type) {
+			log.Println(s.hello(), "skipping service", service.ServiceID, "with unsupported check type", service.Type)
+			continue
+		}
+		e.services = append(e.services, service)
+	}
+	s.exporter = e
+	return nil
+}
+
+// probeSlots limits the probes running at the same time like the worker pool, in total and per check type
+type probeSlots struct {
+	all   chan struct{}
+	types map[string]chan struct{}
+}
+
+// newProbeSlots returns the limits for the number of workers and the limits per check type of the pool
+func newProbeSlots(workers int, typeLimits map[string]int) *probeSlots {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	p := &probeSlots{all: make(chan struct{}, workers), types: make(map[string]chan struct{})}
+	for checkType, limit := range typeLimits {
+		if limit > 0 {
+			p.types[checkType] = make(chan struct{}, limit)
+		}
+	}
+	return p
+}
+
+// acquire waits for a free slot of the check type till ctx is done, release frees the slot again
+func (p *probeSlots) acquire(ctx context.Context, checkType string) (release func(), err error) {
+	typeSlots := p.types[checkType]
+	if typeSlots != nil {
+		select {
+		case typeSlots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	select {
+	case p.all <- struct{}{}:
+	case <-ctx.Done():
+		if typeSlots != nil {
+			<-typeSlots
+		}
+		return nil, ctx.Err()
+	}
+	return func() {
+		<-p.all
+		if typeSlots != nil {
+			<-typeSlots
+		}
+	}, nil
+}
+
+// ExporterHandler returns the handler for /metrics with the results of the configured services
+// and for /probe?target=...&type=... running a single check on demand, must be called after SetPool
+func (s *satAgent) ExporterHandler() http.Handler {
+	s.probes = newProbeSlots(s.poolWorkers, s.poolTypeLimits)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.exporterMetrics)
+	mux.HandleFunc("/probe", s.exporterProbe)
+	return mux
+}
+
+// canRun returns true, if the agent can run checks of the type
+func (s *satAgent) canRun(checkType string) bool {
+	for _, check := range s.checks {
+		if check == checkType {
+			return true
+		}
+	}
+	return false
+}
+
+// record keeps the result of a check
+func (e *exporter) record(result sattypes.ServiceResult) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.last[result.ServiceID] = result
+	e.checks[result.ServiceID]++
+}
+
+// exporterMetrics writes the last results of the configured services in the Prometheus text format
+func (s *satAgent) exporterMetrics(writer http.ResponseWriter, request *http.Request) {
+	e := s.exporter
+	e.mutex.Lock()
+	last := make(map[int64]sattypes.ServiceResult, len(e.last))
+	checks := make(map[int64]int64, len(e.checks))
+	for id, result := range e.last {
+		last[id] = result
+		checks[id] = e.checks[id]
+	}
+	e.mutex.Unlock()
+
+	// services without a result yet are left out
+	var services []sattypes.Service
+	for _, service := range e.services {
+		if _, ok := last[service.ServiceID]; ok {
+			services = append(services, service)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ServiceID < services[j].ServiceID })
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetric(writer, "probe_success", "gauge", "1, if the last check of the service was successful")
+	for _, service := range services {
+		fmt.Fprintf(writer, "probe_success{%s} %d\n", exporterLabels(service), probeSuccess(last[service.ServiceID]))
+	}
+	writeMetric(writer, "probe_duration_seconds", "gauge", "duration of the last check of the service")
+	for _, service := range services {
+		fmt.Fprintf(writer, "probe_duration_seconds{%s} %s\n", exporterLabels(service),
+			strconv.FormatFloat(last[service.ServiceID].Latency, 'f', -1, 64))
+	}
+	writeMetric(writer, "probe_last_run_timestamp_seconds", "gauge", "end of the last check of the service as unix time")
+	for _, service := range services {
+		fmt.Fprintf(writer, "probe_last_run_timestamp_seconds{%s} %d\n", exporterLabels(service), last[service.ServiceID].Time.Unix())
+	}
+	writeMetric(writer, "probe_checks_total", "counter", "checks of the service since the start of the agent")
+	for _, service := range services {
+		fmt.Fprintf(writer, "probe_checks_total{%s} %d\n", exporterLabels(service), checks[service.ServiceID])
+	}
+}
+
+// exporterProbe runs a single check for the target and the type of the query, like the blackbox exporter,
+// expected and timeout in seconds are optional, the probes are limited like the worker pool
+func (s *satAgent) exporterProbe(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	service := sattypes.Service{
+		Name:     query.Get("target"),
+		Type:     query.Get("type"),
+		ToCheck:  query.Get("target"),
+		Expected: query.Get("expected"),
+	}
+	if service.ToCheck == "" {
+		http.Error(writer, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if !s.canRun(service.Type) {
+		http.Error(writer, fmt.Sprintf("unsupported type %q, supported are %s", service.Type, strings.Join(s.checks, ", ")),
+			http.StatusBadRequest)
+		return
+	}
+	if timeout := query.Get("timeout"); timeout != "" {
+		seconds, err := strconv.Atoi(timeout)
+		if err != nil || seconds < 1 || seconds > sattypes.MaxTimeout {
+			http.Error(writer, fmt.Sprintf("timeout must be between 1 and %d seconds", sattypes.MaxTimeout),
+				http.StatusBadRequest)
+			return
+		}
+		service.Timeout = seconds
+	}
+
+	// the check waits for a free slot and is cancelled, when Prometheus gives up
+	release, err := s.probes.acquire(request.Context(), service.Type)
+	if err != nil {
+		http.Error(writer, "too many probes", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+	result, ok := s.checkService(request.Context(), service)
+	if !ok {
+		return
+	}
+	if s.debug {
+		log.Println(s.hello(), "probe", service.Type, service.ToCheck, result.Status, result.Message)
+	}
+
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetric(writer, "probe_success", "gauge", "1, if the check was successful")
+	fmt.Fprintf(writer, "probe_success %d\n", probeSuccess(result))
+	writeMetric(writer, "probe_duration_seconds", "gauge", "duration of the check")
+	fmt.Fprintf(writer, "probe_duration_seconds %s\n", strconv.FormatFloat(result.Latency, 'f', -1, 64))
+}
+
+// probeSuccess returns 1 for a successful result
+func probeSuccess(result sattypes.ServiceResult) int {
+	if result.Status == sattypes.ServiceUP {
+		return 1
+	}
+	return 0
+}
+
+// writeMetric writes the HELP and TYPE lines of a metric
+func writeMetric(writer io.Writer, name, kind, help string) {
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// exporterLabels returns the labels of a service with quoted and escaped values
+func exporterLabels(service sattypes.Service) string {
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return fmt.Sprintf(`service_id="%d",service="%s",type="%s",target="%s"`, service.ServiceID,
+		quote.Replace(service.Name), quote.Replace(service.Type), quote.Replace(service.ToCheck))
+}
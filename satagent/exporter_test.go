@@ -0,0 +1,114 @@
+package satagent
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unfoldedip/sattypes"
+)
+
+func TestExporter(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	file := filepath.Join(t.TempDir(), "exporter.json")
+	config := `[{"name":"open","type":"tcp","tocheck":"` + listener.Addr().String() + `"},
+		{"name":"unknown","type":"gopher","tocheck":"127.0.0.1:1"}]`
+	if err = os.WriteFile(file, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := CreateSatAgent("", "agent", "location", false, sattypes.BaseHandler{})
+	if err = s.SetExporter(file); err != nil {
+		t.Fatal(err)
+	}
+	// services without id are numbered, unsupported types are skipped
+	if len(s.exporter.services) != 1 || s.exporter.services[0].ServiceID != 1 {
+		t.Fatalf("Exporter services are %v", s.exporter.services)
+	}
+
+	server := httptest.NewServer(s.ExporterHandler())
+	defer server.Close()
+	get := func(path string) string {
+		response, err := server.Client().Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+
+	// results of the scheduled checks are exported with the labels of the service
+	s.runServiceCheck(s.ctx, s.exporter.services[0])
+	metrics := get("/metrics")
+	if !strings.Contains(metrics, `probe_success{service_id="1",service="open",type="tcp",target="`+listener.Addr().String()+`"} 1`) ||
+		!strings.Contains(metrics, `probe_checks_total{service_id="1"`) {
+		t.Errorf("Metrics are\n%s", metrics)
+	}
+	if len(s.results) != 0 {
+		t.Errorf("Exporter keeps %d results for the server", len(s.results))
+	}
+
+	// probes run on demand
+	if probe := get("/probe?type=tcp&target=" + listener.Addr().String()); !strings.Contains(probe, "probe_success 1") {
+		t.Errorf("Probe of an open port is\n%s", probe)
+	}
+	if probe := get("/probe?type=tcp&target=127.0.0.1:1"); !strings.Contains(probe, "probe_success 0") {
+		t.Errorf("Probe of a closed port is\n%s", probe)
+	}
+	if probe := get("/probe?type=gopher&target=127.0.0.1:1"); !strings.Contains(probe, "unsupported type") {
+		t.Errorf("Probe of an unsupported type is\n%s", probe)
+	}
+	for _, timeout := range []string{"0", "61", "-1", "x"} {
+		if probe := get("/probe?type=tcp&target=127.0.0.1:1&timeout=" + timeout); !strings.Contains(probe, "timeout must be") {
+			t.Errorf("Probe with timeout %s is\n%s", timeout, probe)
+		}
+	}
+}
+
+func TestProbeSlots(t *testing.T) {
+	p := newProbeSlots(2, map[string]int{"ping": 1})
+	busy := func(checkType string) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+		release, err := p.acquire(ctx, checkType)
+		if err != nil {
+			return true
+		}
+		release()
+		return false
+	}
+
+	// the limit of a type holds its probes, other types run
+	release, err := p.acquire(context.Background(), "ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !busy("ping") || busy("tcp") {
+		t.Error("Limit of the type is not kept")
+	}
+
+	// the limit of all probes holds every type
+	releaseTCP, err := p.acquire(context.Background(), "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !busy("http") {
+		t.Error("Probe started above the number of workers")
+	}
+	release()
+	releaseTCP()
+	if busy("ping") || busy("http") {
+		t.Error("Released slots are still taken")
+	}
+}
@@ -1,17 +1,17 @@
 package satagent
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strings"
-	"time"
 	"unfoldedip/sattypes"
 )
 
-// HTTPCheck runs a HTTP Get query against a target
-func (s *satAgent) HTTPCheck(service sattypes.Service) sattypes.ServiceResult {
+// HTTPCheck runs a HTTP Get query against a target, till the context is done
+func (s *satAgent) HTTPCheck(ctx context.Context, service sattypes.Service) sattypes.ServiceResult {
 	var expandedMessage string
 	if s.debug {
 		log.Println(s.hello(), "HTTP Check", service.ToCheck, service.ServiceID)
@@ -21,14 +21,13 @@ func (s *satAgent) HTTPCheck(service sattypes.Service) sattypes.ServiceResult {
 	var sResult sattypes.ServiceResult
 	sResult.ServiceID = service.ServiceID
 
-	// generate HTTP client
+	// generate HTTP client, the timeout is set by the context
 	client := http.Client{
 		Transport: http.DefaultTransport,
-		Timeout:   time.Second * 5,
 	}
 
 	// add path to server url
-	request, err := http.NewRequest("GET", service.ToCheck, nil)
+	request, err := http.NewRequestWithContext(ctx, "GET", service.ToCheck, nil)
 	if err != nil {
 		sResult.Status = sattypes.ServiceDown
 		sResult.Message = err.Error()
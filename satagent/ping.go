@@ -1,13 +1,14 @@
 package satagent
 
 import (
+	"context"
 	"log"
 	"unfoldedip/ping"
 	"unfoldedip/sattypes"
 )
 
-// PingCheck runs icmp ping echo against a target
-func (s *satAgent) PingCheck(service sattypes.Service) sattypes.ServiceResult {
+// PingCheck runs icmp ping echo against a target, the ping program is killed, when the context is done
+func (s *satAgent) PingCheck(ctx context.Context, service sattypes.Service) sattypes.ServiceResult {
 	log.Println(s.hello(), "Ping Check", service.ToCheck)
 
 	var r sattypes.ServiceResult = sattypes.ServiceResult{ServiceID: service.ServiceID}
@@ -20,7 +21,7 @@ func (s *satAgent) PingCheck(service sattypes.Service) sattypes.ServiceResult {
 	}
 
 	// Start the pinger
-	stats, err := pinger.Run()
+	stats, err := pinger.RunContext(ctx)
 	if err != nil {
 		log.Println(err)
 		r.Message = err.Error()
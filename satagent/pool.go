@@ -0,0 +1,194 @@
+package satagent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unfoldedip/sattypes"
+)
+
+// default limits for the worker pool
+const (
+	defaultWorkers   = 32
+	defaultQueueSize = 1024
+)
+
+// poolJob is a queued check with its context and the time, it was due at
+type poolJob struct {
+	ctx     context.Context
+	service sattypes.Service
+	due     time.Time
+}
+
+// workerPool runs the due service checks with a limited number of workers,
+// optional limits per check type keep e.g. the number of ping processes small
+type workerPool struct {
+	// queue of the check types without limit
+	queue chan poolJob
+	// queues of the check types with limit, each served by as many workers as the limit,
+	// so a backlog of a limited type never holds the workers of the other types
+	typeQueues map[string]chan poolJob
+	// slots limits the running checks of all types to the number of workers
+	slots chan struct{}
+	// services, that are queued or running, with the function to cancel their check
+	active      map[int64]context.CancelFunc
+	activeMutex sync.Mutex
+	// context of all checks
+	ctx context.Context
+	// function, that runs a single check
+	check   func(context.Context, sattypes.Service)
+	workers int
+	// counters for the self-metrics
+	running, completed, skipped, overrun int64
+	// maximum delay in nanoseconds between a check being due and its start since the last call of takeMaxLag
+	maxLag int64
+}
+
+// newWorkerPool starts workers, that call check for every submitted service, the checks are
+// cancelled with ctx
+func newWorkerPool(ctx context.Context, workers, queueSize int, typeLimits map[string]int, check func(context.Context, sattypes.Service)) *workerPool {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	p := &workerPool{
+		queue:      make(chan poolJob, queueSize),
+		typeQueues: make(map[string]chan poolJob),
+		slots:      make(chan struct{}, workers),
+		active:     make(map[int64]context.CancelFunc),
+		ctx:        ctx,
+		check:      check,
+		workers:    workers,
+	}
+	for checkType, limit := range typeLimits {
+		if limit > 0 {
+			queue := make(chan poolJob, queueSize)
+			p.typeQueues[checkType] = queue
+			for i := 0; i < limit; i++ {
+				go p.work(queue)
+			}
+		}
+	}
+	for i := 0; i < workers; i++ {
+		go p.work(p.queue)
+	}
+	return p
+}
+
+// submit queues a service, that is due since due, a service, that is still queued or running, is counted as overrun,
+// a service, that does not fit into the queue, is skipped
+func (p *workerPool) submit(service sattypes.Service, due time.Time) {
+	p.activeMutex.Lock()
+	defer p.activeMutex.Unlock()
+	if p.active[service.ServiceID] != nil {
+		atomic.AddInt64(&p.overrun, 1)
+		return
+	}
+	queue := p.queue
+	if typeQueue := p.typeQueues[service.Type]; typeQueue != nil {
+		queue = typeQueue
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	select {
+	case queue <- poolJob{ctx: ctx, service: service, due: due}:
+		p.active[service.ServiceID] = cancel
+	default:
+		cancel()
+		atomic.AddInt64(&p.skipped, 1)
+		log.Println("pool: queue full, skipping check", service.ServiceID)
+	}
+}
+
+// work runs checks from a queue
+func (p *workerPool) work(queue chan poolJob) {
+	for job := range queue {
+		service := job.service
+		p.slots <- struct{}{}
+		// checks cancelled while queued are not run
+		if job.ctx.Err() == nil {
+			p.recordLag(time.Since(job.due))
+			atomic.AddInt64(&p.running, 1)
+			p.check(job.ctx, service)
+			atomic.AddInt64(&p.running, -1)
+			atomic.AddInt64(&p.completed, 1)
+		}
+		<-p.slots
+
+		p.activeMutex.Lock()
+		if cancel := p.active[service.ServiceID]; cancel != nil {
+			cancel()
+			delete(p.active, service.ServiceID)
+		}
+		p.activeMutex.Unlock()
+	}
+}
+
+// cancelRemoved cancels the queued and running checks of services, that are not in services
+func (p *workerPool) cancelRemoved(services []sattypes.Service) {
+	keep := make(map[int64]bool, len(services))
+	for _, service := range services {
+		keep[service.ServiceID] = true
+	}
+	p.activeMutex.Lock()
+	defer p.activeMutex.Unlock()
+	for serviceID, cancel := range p.active {
+		if !keep[serviceID] {
+			cancel()
+		}
+	}
+}
+
+// recordLag keeps the maximum delay of a check start
+func (p *workerPool) recordLag(lag time.Duration) {
+	for {
+		max := atomic.LoadInt64(&p.maxLag)
+		if int64(lag) <= max || atomic.CompareAndSwapInt64(&p.maxLag, max, int64(lag)) {
+			return
+		}
+	}
+}
+
+// takeMaxLag returns the maximum delay of a check start since the last call
+func (p *workerPool) takeMaxLag() time.Duration {
+	return time.Duration(atomic.SwapInt64(&p.maxLag, 0))
+}
+
+// stats returns the self-metrics of the pool
+func (p *workerPool) stats() sattypes.AgentPoolStats {
+	depth := len(p.queue)
+	for _, queue := range p.typeQueues {
+		depth += len(queue)
+	}
+	return sattypes.AgentPoolStats{
+		Workers:    p.workers,
+		QueueDepth: depth,
+		Running:    atomic.LoadInt64(&p.running),
+		Completed:  atomic.LoadInt64(&p.completed),
+		Skipped:    atomic.LoadInt64(&p.skipped),
+		Overrun:    atomic.LoadInt64(&p.overrun),
+	}
+}
+
+// ParseTypeLimits parses limits per check type in the form "ping=8,http=16"
+func ParseTypeLimits(limits string) (map[string]int, error) {
+	typeLimits := make(map[string]int)
+	for _, limit := range strings.Split(limits, ",") {
+		if strings.TrimSpace(limit) == "" {
+			continue
+		}
+		checkType, value, found := strings.Cut(limit, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if !found || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid limit %q, expected type=number", limit)
+		}
+		typeLimits[strings.TrimSpace(checkType)] = n
+	}
+	return typeLimits, nil
+}
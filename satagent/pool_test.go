@@ -0,0 +1,193 @@
+package satagent
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unfoldedip/sattypes"
+)
+
+func TestWorkerPool(t *testing.T) {
+	var running, maxPing int64
+	release := make(chan struct{})
+	var done sync.WaitGroup
+
+	check := func(ctx context.Context, service sattypes.Service) {
+		defer done.Done()
+		if service.Type == "ping" {
+			n := atomic.AddInt64(&running, 1)
+			for {
+				max := atomic.LoadInt64(&maxPing)
+				if n <= max || atomic.CompareAndSwapInt64(&maxPing, max, n) {
+					break
+				}
+			}
+			<-release
+			atomic.AddInt64(&running, -1)
+		}
+	}
+
+	p := newWorkerPool(context.Background(), 4, 10, map[string]int{"ping": 2}, check)
+	done.Add(6)
+	for i := 1; i <= 6; i++ {
+		p.submit(sattypes.Service{ServiceID: int64(i), Type: "ping"}, time.Now())
+	}
+	// still queued or running
+	p.submit(sattypes.Service{ServiceID: 1, Type: "ping"}, time.Now())
+	if stats := p.stats(); stats.Overrun != 1 {
+		t.Errorf("Overrun is %d, expected 1", stats.Overrun)
+	}
+
+	// other types are not blocked by the ping limit
+	done.Add(1)
+	p.submit(sattypes.Service{ServiceID: 7, Type: "tcp"}, time.Now())
+
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	done.Wait()
+
+	// the checks waiting for a ping slot started late
+	if lag := p.takeMaxLag(); lag < time.Millisecond*40 || p.takeMaxLag() != 0 {
+		t.Errorf("Maximum lag is %s, expected the wait for the ping slots", lag)
+	}
+
+	if maxPing != 2 {
+		t.Errorf("%d ping checks ran at the same time, expected 2", maxPing)
+	}
+	if stats := p.stats(); stats.Completed != 7 || stats.Skipped != 0 {
+		t.Errorf("Stats are %+v, expected 7 completed", stats)
+	}
+
+	// a full queue skips checks
+	block := make(chan struct{})
+	p = newWorkerPool(context.Background(), 1, 1, nil, func(context.Context, sattypes.Service) { <-block })
+	for i := 1; i <= 4; i++ {
+		p.submit(sattypes.Service{ServiceID: int64(i), Type: "tcp"}, time.Now())
+		time.Sleep(time.Millisecond * 10)
+	}
+	if stats := p.stats(); stats.Skipped != 2 || stats.QueueDepth != 1 {
+		t.Errorf("Stats are %+v, expected 2 skipped and 1 queued", stats)
+	}
+	close(block)
+}
+
+// Test checks of other types running during a backlog of a limited type
+func TestWorkerPoolTypeBacklog(t *testing.T) {
+	release := make(chan struct{})
+	tcpDone := make(chan int64, 10)
+	check := func(ctx context.Context, service sattypes.Service) {
+		if service.Type == "ping" {
+			<-release
+			return
+		}
+		tcpDone <- service.ServiceID
+	}
+
+	// more queued pings than workers
+	p := newWorkerPool(context.Background(), 4, 100, map[string]int{"ping": 2}, check)
+	defer close(release)
+	for i := 1; i <= 20; i++ {
+		p.submit(sattypes.Service{ServiceID: int64(i), Type: "ping"}, time.Now())
+	}
+	for i := 21; i <= 30; i++ {
+		p.submit(sattypes.Service{ServiceID: int64(i), Type: "tcp"}, time.Now())
+	}
+
+	for i := 0; i < 10; i++ {
+		select {
+		case <-tcpDone:
+		case <-time.After(time.Second):
+			t.Fatalf("Only %d of 10 tcp checks ran during the ping backlog, stats %+v", i, p.stats())
+		}
+	}
+	// the limit still holds for the pings
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond * 5) {
+		stats := p.stats()
+		if stats.Running == 2 && stats.QueueDepth == 18 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Stats are %+v, expected 2 running and 18 queued pings", stats)
+		}
+	}
+}
+
+func TestWorkerPoolCancel(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	cancelled := make(chan int64, 2)
+	check := func(ctx context.Context, service sattypes.Service) {
+		<-ctx.Done()
+		cancelled <- service.ServiceID
+	}
+
+	p := newWorkerPool(ctx, 2, 10, nil, check)
+	p.submit(sattypes.Service{ServiceID: 1, Type: "tcp"}, time.Now())
+	p.submit(sattypes.Service{ServiceID: 2, Type: "tcp"}, time.Now())
+	time.Sleep(time.Millisecond * 20)
+
+	// service 2 is removed from the configuration
+	p.cancelRemoved([]sattypes.Service{{ServiceID: 1}})
+	select {
+	case id := <-cancelled:
+		if id != 2 {
+			t.Errorf("Check of service %d cancelled, expected 2", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Check of removed service not cancelled")
+	}
+
+	// the agent stops
+	stop()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Check not cancelled on stop")
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	// a listener, that never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		<-request.Context().Done()
+	}))
+	defer server.Close()
+
+	s := CreateSatAgent("", "agent", "location", false, sattypes.BaseHandler{})
+	service := sattypes.Service{ServiceID: 1, Type: "http", ToCheck: server.URL, Timeout: 1}
+	start := time.Now()
+	s.runServiceCheck(context.Background(), service)
+	if elapsed := time.Since(start); elapsed > time.Second*3 {
+		t.Errorf("Check took %s with a timeout of 1s", elapsed)
+	}
+	if len(s.results) != 1 || s.results[0].Status != sattypes.ServiceDown || s.results[0].Reason != sattypes.ReasonTimeout {
+		t.Fatalf("Results are %+v, expected a timeout", s.results)
+	}
+
+	// a cancelled check reports nothing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.runServiceCheck(ctx, sattypes.Service{ServiceID: 2, Type: "tcp", ToCheck: listener.Addr().String(), Timeout: 1})
+	if len(s.results) != 1 {
+		t.Errorf("Cancelled check reported %+v", s.results[1:])
+	}
+}
+
+func TestParseTypeLimits(t *testing.T) {
+	limits, err := ParseTypeLimits("ping=8, http=16,")
+	if err != nil || limits["ping"] != 8 || limits["http"] != 16 {
+		t.Errorf("Parsed limits are %v, %v", limits, err)
+	}
+	if _, err = ParseTypeLimits("ping"); err == nil {
+		t.Error("Limit without number accepted")
+	}
+}
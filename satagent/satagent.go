@@ -6,21 +6,48 @@ package satagent
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unfoldedip/ping"
 	"unfoldedip/sattypes"
 )
 
 // satAgent object with all necessary information
 type satAgent struct {
-	// access key that is loaded from command line
+	// access key that is loaded from command line, replaced by the own secret after the enrollment
 	SatKey string
+	// one time enrollment token, used till the agent received its own secret
+	SatToken string
+	// file for persisting the own secret, empty = no persistence
+	SatSecretFile string
+	// Ed25519 key for signing result batches, nil = unsigned
+	SatSigningKey ed25519.PrivateKey
+	// key of -agentkey, tried once when the server refuses the saved secret, e.g. after a rotation by an admin
+	satNextKey string
+	// satKeyUnsaved is true, till the server accepted the key of -agentkey and it was written to the secret file
+	satKeyUnsaved bool
+	// mutex to protect key and token, that are replaced by the server
+	satKeyMutex sync.Mutex
 	// URL for the server
 	SatServerURL string
+	// transport for all requests to the server, carries the client certificate for mutual TLS
+	satTransport http.RoundTripper
 	// name of this client
 	SatName string
 	// Location of this client
@@ -33,19 +60,62 @@ type satAgent struct {
 	satServicesMutex sync.Mutex
 	// bool, that shows, if configuration has been loaded
 	satServerLoaded bool
-	// saving the next service check interval
-	serviceInterval map[int64]int
+	// scheduler for the service checks and the channel, that wakes the busy loop after a configuration change
+	schedule    *scheduler
+	rescheduled chan struct{}
 	// different values, when to block and
 	// when to refresh configuration
 	blockTime             time.Duration
 	blockSeconds          int
 	refreshSeconds        int
 	refreshSecondsDefault int
+	// backoff for pulling the configuration after failures
+	retrySeconds int
+	// file with the services of the last successful pull, empty = no cache
+	satConfigFile string
+	// ETag of the last pulled configuration and if the server can hold the pull till a change
+	configETag     string
+	serverLongPoll bool
+	configMutex    sync.Mutex
+	// protocol version of the server after the hello, 0 = no hello yet
+	serverProtocol int
+	// check types, this agent can run
+	checks []string
+	// seconds, the server may hold a pull till a change, 0 = periodic pulls only
+	longPollSeconds int
+	longPolling     atomic.Bool
 	// will be used to protect the results array
 	// while collecting results before posting
 	// to server
 	resultsMutex sync.Mutex
 	results      []sattypes.ServiceResult
+	// context of the agent, cancelled by Stop, stopped is closed, when Run returns
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	// worker pool for running the checks and its limits
+	pool           *workerPool
+	poolMutex      sync.Mutex
+	poolWorkers    int
+	poolQueueSize  int
+	poolTypeLimits map[string]int
+	// unsent results, that are replayed in order, when the server is reachable again
+	spool *spool
+	// semaphore to run only one post to the server at the same time, Shutdown waits for it till its context is done
+	postLock chan struct{}
+	// backoff for posting results after failures
+	postRetrySeconds int
+	postRetryAt      time.Time
+	// self-metrics for the heartbeats
+	started              time.Time
+	failedPosts          int64
+	heartbeatInterval    time.Duration
+	lastHeartbeat        time.Time
+	heartbeatUnsupported atomic.Bool
+	// exporter keeps the results of a local configuration instead of posting them, nil = server mode
+	exporter *exporter
+	// limits of the probes of the exporter
+	probes *probeSlots
 	// debug mode is on?
 	debug bool
 }
@@ -63,15 +133,214 @@ func CreateSatAgent(url, name, location string, locationOnly bool, H sattypes.Ba
 	s.SatLocation = location
 	s.SatLocationOnly = locationOnly
 	s.SatServerURL = url + "/agents/"
+	s.satTransport = http.DefaultTransport
 	s.blockSeconds = 1
 	s.blockTime = time.Second * time.Duration(s.blockSeconds)
 	s.refreshSecondsDefault = 45
 	s.refreshSeconds = s.refreshSecondsDefault
-	s.serviceInterval = make(map[int64]int)
+	s.schedule = newScheduler(0)
+	s.rescheduled = make(chan struct{}, 1)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.stopped = make(chan struct{})
+	s.postLock = make(chan struct{}, 1)
 	s.debug = H.Debug
+	s.spool = newSpool("", defaultSpoolSize)
+	s.checks = supportedChecks()
+	s.started = time.Now()
 	return &s
 }
 
+// supportedChecks returns the check types, that can be run on this system
+func supportedChecks() []string {
+	checks := []string{"http", "tcp", "tls"}
+	if ping.Available() {
+		checks = append(checks, "ping")
+	}
+	return checks
+}
+
+// backoff limits for pulling the configuration
+const (
+	minRetrySeconds = 2
+	maxRetrySeconds = 300
+)
+
+// SetConfigCache saves the services of every successful pull in file and runs them on start,
+// when the server is not reachable
+func (s *satAgent) SetConfigCache(file string) {
+	s.satConfigFile = file
+}
+
+// SetPool limits the number of concurrent checks, in total and per check type, and the number of queued checks
+func (s *satAgent) SetPool(workers, queueSize int, typeLimits map[string]int) {
+	s.poolWorkers = workers
+	s.poolQueueSize = queueSize
+	s.poolTypeLimits = typeLimits
+}
+
+// SetLongPoll lets the server hold a configuration pull up to seconds till the configuration changes,
+// 0 pulls the configuration periodically only
+func (s *satAgent) SetLongPoll(seconds int) {
+	s.longPollSeconds = seconds
+}
+
+// SetHeartbeat sends the health of the agent to the server every interval, 0 disables the heartbeats
+func (s *satAgent) SetHeartbeat(interval time.Duration) {
+	s.heartbeatInterval = interval
+}
+
+// SetJitter delays every check by a random part of its interval up to fraction, must be called before Run
+func (s *satAgent) SetJitter(fraction float64) {
+	s.schedule = newScheduler(fraction)
+}
+
+// SetSpool keeps up to maxResults unsent results in file, empty file keeps them in memory only
+func (s *satAgent) SetSpool(file string, maxResults int) {
+	s.spool = newSpool(file, maxResults)
+	if pending := s.spool.pending(); pending > 0 {
+		log.Println(s.hello(), "replaying", pending, "spooled results")
+	}
+}
+
+// LoadSecret reads the own secret from the secret file, if the agent has been enrolled before,
+// a different key passed with -agentkey is tried, when the server refuses the secret
+func (s *satAgent) LoadSecret(keyPassed bool) {
+	if s.SatSecretFile == "" {
+		return
+	}
+	secret, err := os.ReadFile(s.SatSecretFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(s.hello(), err)
+		}
+		return
+	}
+	if key := strings.TrimSpace(string(secret)); key != "" {
+		if keyPassed && key != s.SatKey {
+			s.satNextKey = s.SatKey
+		}
+		s.SatKey = key
+		s.SatToken = ""
+	}
+}
+
+// SetTLSConfig uses the TLS configuration with the client certificate for all requests to the server
+func (s *satAgent) SetTLSConfig(config *tls.Config) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	s.satTransport = transport
+}
+
+// LoadSigningKey reads the Ed25519 key for signing results from file, a new key is generated and saved on the first start
+func (s *satAgent) LoadSigningKey(file string) error {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+		if err != nil {
+			return err
+		}
+		s.SatSigningKey = key
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("no PEM data in %s", file)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	signingKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return fmt.Errorf("no Ed25519 key in %s", file)
+	}
+	s.SatSigningKey = signingKey
+	return nil
+}
+
+// setHeaders adds key or token, name, location and version of the agent to a request
+func (s *satAgent) setHeaders(request *http.Request) {
+	s.satKeyMutex.Lock()
+	if s.SatToken != "" {
+		request.Header.Set("agent-token", s.SatToken)
+	} else {
+		request.Header.Set("agent-key", s.SatKey)
+	}
+	s.satKeyMutex.Unlock()
+	// transport my and location inside http header
+	request.Header.Set("agent-location", s.SatLocation)
+	request.Header.Set("agent-name", s.SatName)
+	request.Header.Set("agent-version", sattypes.Version)
+	// self-metrics of the worker pool
+	if s.pool != nil {
+		if stats, err := json.Marshal(s.pool.stats()); err == nil {
+			request.Header.Set("agent-stats", string(stats))
+		}
+	}
+	// the public key is registered by the server on the first contact after the enrollment
+	if s.SatSigningKey != nil {
+		request.Header.Set("agent-pubkey",
+			base64.StdEncoding.EncodeToString(s.SatSigningKey.Public().(ed25519.PublicKey)))
+	}
+}
+
+// receiveSecret takes over the own secret, that the server hands out once after the approval,
+// and saves the key of -agentkey, after the server accepted it instead of the saved secret
+func (s *satAgent) receiveSecret(resp *http.Response) {
+	secret := resp.Header.Get("agent-secret")
+	s.satKeyMutex.Lock()
+	if secret == "" && !s.satKeyUnsaved {
+		s.satKeyMutex.Unlock()
+		return
+	}
+	if secret == "" {
+		secret = s.SatKey
+		log.Println(s.hello(), "server accepted the key of -agentkey, replacing the saved secret")
+	} else {
+		log.Println(s.hello(), "received own secret from the server")
+	}
+	s.SatKey = secret
+	s.SatToken = ""
+	s.satNextKey = ""
+	s.satKeyUnsaved = false
+	s.satKeyMutex.Unlock()
+
+	if s.SatSecretFile == "" {
+		return
+	}
+	err := os.WriteFile(s.SatSecretFile, []byte(secret+"\n"), 0600)
+	if err != nil {
+		log.Println(s.hello(), "cant persist own secret", err)
+	}
+}
+
+// keyRefused switches to the key of -agentkey, when the server refuses the saved secret
+func (s *satAgent) keyRefused(resp *http.Response) {
+	if resp.StatusCode != http.StatusForbidden {
+		return
+	}
+	s.satKeyMutex.Lock()
+	defer s.satKeyMutex.Unlock()
+	if s.satNextKey == "" {
+		return
+	}
+	log.Println(s.hello(), "server refused the saved secret, trying the key of -agentkey")
+	s.SatKey = s.satNextKey
+	s.satNextKey = ""
+	s.satKeyUnsaved = true
+}
+
 // print prefix for logging
 func (s *satAgent) hello() string {
 	return fmt.Sprintf("--- satagent %s (%s): ", s.SatName, s.SatLocation)
@@ -79,37 +348,80 @@ func (s *satAgent) hello() string {
 
 // print startup message of the day
 func (s *satAgent) motd() {
+	if s.exporter != nil {
+		log.Printf("%s Exporting %d services from the local configuration", s.hello(), len(s.exporter.services))
+		return
+	}
 	log.Printf("%s Pull tests with access key %s from %s", s.hello(),
 		s.SatKey, s.SatServerURL)
 }
 
 // pull configuration from server
 func (s *satAgent) pullServerConfiguration() error {
+	return s.pullConfiguration(s.ctx, 0)
+}
+
+// pullConfiguration pulls the configuration, an unchanged configuration is not sent again,
+// with wait > 0 the server holds the pull till the configuration changes or wait seconds are over
+func (s *satAgent) pullConfiguration(ctx context.Context, wait int) error {
 	client := http.Client{
-		Transport: http.DefaultTransport,
-		Timeout:   time.Second * 20,
+		Transport: s.satTransport,
+		Timeout:   time.Second * time.Duration(20+wait),
+	}
+	// tell the server version, OS and check types first
+	s.configMutex.Lock()
+	protocol := s.serverProtocol
+	s.configMutex.Unlock()
+	if protocol == 0 {
+		if err := s.sayHello(ctx); err != nil {
+			return err
+		}
 	}
+
 	// add path to server url
-	request, err := http.NewRequest("GET", s.SatServerURL+"config", nil)
+	request, err := http.NewRequestWithContext(ctx, "GET", s.SatServerURL+"config", nil)
 	if err != nil {
 		return err
 	}
 
-	// set access key / token
-	request.Header.Set("agent-key", s.SatKey)
-	// transport my and location inside http header
-	request.Header.Set("agent-location", s.SatLocation)
-	request.Header.Set("agent-name", s.SatName)
+	// set access key / token, name, location and version, after the hello, that may have enrolled the agent
+	s.setHeaders(request)
 
 	if s.SatLocationOnly {
 		request.Header.Set("agent-onlylocation", "YES")
 	}
 
+	// send the version of the running configuration
+	s.configMutex.Lock()
+	if s.configETag != "" {
+		request.Header.Set("If-None-Match", s.configETag)
+		if wait > 0 {
+			request.Header.Set("agent-wait", strconv.Itoa(wait))
+		}
+	}
+	s.configMutex.Unlock()
+
 	// do the request
 	resp, err := client.Do(request)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
+
+	// the configuration has not changed
+	if resp.StatusCode == http.StatusNotModified {
+		if s.debug {
+			log.Println(s.hello(), "configuration unchanged")
+		}
+		return nil
+	}
+
+	// pending, disabled or unknown agents are refused
+	if resp.StatusCode != http.StatusOK {
+		s.keyRefused(resp)
+		return fmt.Errorf("server answered %s", resp.Status)
+	}
+	s.receiveSecret(resp)
 
 	// Read response and try to parse
 	var agentServices []sattypes.Service
@@ -127,57 +439,257 @@ func (s *satAgent) pullServerConfiguration() error {
 
 	if len(agentServices) == 0 {
 		log.Println(s.hello() + "No services found")
-		time.Sleep(time.Second * 10)
+	}
+	// slow down periodic pulls of an empty configuration, a waiting pull gets the next change right away
+	if len(agentServices) == 0 && wait == 0 {
+		select {
+		case <-time.After(time.Second * 10):
+		case <-s.ctx.Done():
+		}
 	}
 
-	// lock configuration by holding satServicesMutex
-	// replace live configured services
-	// this needs to be tricky,
-	// because we need to retain the NextInterval for existing check, else the agent
-	// could miss certain intervals, this is very sensitive from performance view
-	// set starting next interval for the check
-	s.satServicesMutex.Lock()
+	s.applyServices(agentServices)
+	s.saveConfigCache(agentServices)
 
-	for i := range agentServices {
-		// service is old, retain old next interval
-		if val, ok := s.serviceInterval[agentServices[i].ServiceID]; ok {
-			agentServices[i].NextInterval = val
-			if s.debug {
-				log.Println("Retain", val, "for ", agentServices[i].ServiceID)
-			}
-		} else {
-			// take default
-			agentServices[i].NextInterval = agentServices[i].Interval
+	s.configMutex.Lock()
+	s.configETag = resp.Header.Get("ETag")
+	s.serverLongPoll = resp.Header.Get("agent-longpoll") != ""
+	s.configMutex.Unlock()
+
+	// some helpful message
+	log.Println(s.hello(), "reloaded / refreshing services", agentServices)
+
+	return nil
+}
+
+// sayHello sends version, OS and check types of the agent to the server, servers without
+// the hello speak protocol version 1 and assign all check types
+func (s *satAgent) sayHello(ctx context.Context) error {
+	client := http.Client{
+		Transport: s.satTransport,
+		Timeout:   time.Second * 20,
+	}
+
+	hello := sattypes.AgentHello{
+		Protocol: sattypes.ProtocolVersion,
+		Version:  sattypes.Version,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Checks:   s.checks,
+	}
+	b := new(bytes.Buffer)
+	err := json.NewEncoder(b).Encode(hello)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", s.SatServerURL+"hello", b)
+	if err != nil {
+		return err
+	}
+	s.setHeaders(request)
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var serverHello sattypes.ServerHello
+	switch resp.StatusCode {
+	case http.StatusOK:
+		s.receiveSecret(resp)
+		err = json.NewDecoder(resp.Body).Decode(&serverHello)
+		if err != nil {
+			return err
+		}
+	case http.StatusNotFound:
+		serverHello.Protocol = 1
+	default:
+		// pending, disabled or unknown agents are refused
+		s.keyRefused(resp)
+		return fmt.Errorf("server answered %s", resp.Status)
+	}
+	if serverHello.Protocol < 1 {
+		return fmt.Errorf("server answered invalid protocol version %d", serverHello.Protocol)
+	}
+
+	log.Println(s.hello(), "server speaks protocol version", serverHello.Protocol, "agent can run", s.checks)
+	s.configMutex.Lock()
+	s.serverProtocol = serverHello.Protocol
+	s.configMutex.Unlock()
+	return nil
+}
+
+// startLongPoll starts waiting for configuration changes, if enabled and the server supports it
+func (s *satAgent) startLongPoll() {
+	s.configMutex.Lock()
+	supported := s.serverLongPoll
+	s.configMutex.Unlock()
+	if s.longPollSeconds > 0 && supported && s.longPolling.CompareAndSwap(false, true) {
+		go s.watchConfiguration()
+	}
+}
+
+// watchConfiguration pulls the configuration again and again, the server answers after a change
+// or after longPollSeconds, till the agent stops
+func (s *satAgent) watchConfiguration() {
+	defer s.longPolling.Store(false)
+	if s.debug {
+		log.Println(s.hello(), "waiting for configuration changes")
+	}
+
+	retrySeconds := 0
+	for s.ctx.Err() == nil {
+		err := s.pullConfiguration(s.ctx, s.longPollSeconds)
+		if err == nil {
+			retrySeconds = 0
+			continue
+		}
+		if s.ctx.Err() != nil {
+			return
+		}
+		// keep running the last configuration and retry with backoff
+		retrySeconds = backoff(retrySeconds)
+		log.Println(s.hello(), err, "retry in", retrySeconds, "seconds")
+		select {
+		case <-time.After(time.Second * time.Duration(retrySeconds)):
+		case <-s.ctx.Done():
+			return
 		}
 	}
+}
+
+// applyServices replaces the live configured services, services with an unchanged interval keep their slots
+func (s *satAgent) applyServices(agentServices []sattypes.Service) {
+	s.schedule.update(agentServices, time.Now())
+
+	// cancel running checks of removed services
+	s.poolMutex.Lock()
+	if s.pool != nil {
+		s.pool.cancelRemoved(agentServices)
+	}
+	s.poolMutex.Unlock()
 
 	// overwrite services
-	s.satServices = nil
+	s.satServicesMutex.Lock()
 	s.satServices = agentServices
 	s.satServerLoaded = true
-	// unlockMutex
 	s.satServicesMutex.Unlock()
 
-	// some helpful message
-	log.Println(s.hello(), "reloaded / refreshing services", s.satServices)
+	// wake up the busy loop for the new first slot
+	select {
+	case s.rescheduled <- struct{}{}:
+	default:
+	}
+}
 
-	return nil
+// saveConfigCache saves the services of the last successful pull for starting without the server
+func (s *satAgent) saveConfigCache(agentServices []sattypes.Service) {
+	if s.satConfigFile == "" {
+		return
+	}
+	data, err := json.Marshal(agentServices)
+	if err == nil {
+		// replace the file in one step, a crash leaves the old or the new configuration
+		err = os.WriteFile(s.satConfigFile+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(s.satConfigFile+".tmp", s.satConfigFile)
+	}
+	if err != nil {
+		log.Println(s.hello(), "cant save configuration cache", err)
+	}
+}
+
+// loadConfigCache runs the services of the last successful pull, returns false without a cache
+func (s *satAgent) loadConfigCache() bool {
+	if s.satConfigFile == "" {
+		return false
+	}
+	data, err := os.ReadFile(s.satConfigFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(s.hello(), err)
+		}
+		return false
+	}
+	var agentServices []sattypes.Service
+	err = json.Unmarshal(data, &agentServices)
+	if err != nil {
+		log.Println(s.hello(), "invalid configuration cache", err)
+		return false
+	}
+	s.applyServices(agentServices)
+	log.Println(s.hello(), "running", len(agentServices), "services from configuration cache")
+	return true
+}
+
+// backoff doubles the waiting time after a failure between minRetrySeconds and maxRetrySeconds
+func backoff(seconds int) int {
+	seconds *= 2
+	if seconds < minRetrySeconds {
+		seconds = minRetrySeconds
+	}
+	if seconds > maxRetrySeconds {
+		seconds = maxRetrySeconds
+	}
+	return seconds
 }
 
-// postResults sends the array of results back to the client
+// postResults moves the collected results into the spool and sends the spooled results
+// in order back to the server, a batch is only removed from the spool after the server accepted it
 func (s *satAgent) postResults() {
+	// only one post at the same time, the next tick tries again
+	select {
+	case s.postLock <- struct{}{}:
+		defer func() { <-s.postLock }()
+	default:
+		return
+	}
+
+	// move results into the spool
+	s.spoolResults()
 
+	// wait for the backoff after a failed post
+	if time.Now().Before(s.postRetryAt) {
+		return
+	}
+
+	// a post to a hanging server is cancelled by Stop
+	if err := s.postSpool(s.ctx); err != nil {
+		atomic.AddInt64(&s.failedPosts, 1)
+		s.postRetrySeconds = backoff(s.postRetrySeconds)
+		s.postRetryAt = time.Now().Add(time.Second * time.Duration(s.postRetrySeconds))
+		log.Println(s.hello(), s.spool.pending(), "results stay in spool, retry in", s.postRetrySeconds, "seconds:", err)
+		return
+	}
+	s.postRetrySeconds = 0
+}
+
+// spoolResults moves the collected results into the spool
+func (s *satAgent) spoolResults() {
 	// copy results, then nil/empty the slice, unlock the mutex
 	s.resultsMutex.Lock()
 	localResults := s.results
 	s.results = nil
 	s.resultsMutex.Unlock()
+	s.spool.add(localResults)
+}
 
-	if len(localResults) == 0 {
-		log.Println("Nothing to post back")
-		return
+// postSpool sends the spooled results in batches, a batch is dropped after the server accepted it
+func (s *satAgent) postSpool(ctx context.Context) error {
+	for s.spool.pending() > 0 {
+		batch := s.spool.peek(postBatchSize)
+		if err := s.postBatch(ctx, batch); err != nil {
+			return err
+		}
+		s.spool.drop(len(batch))
 	}
+	return nil
+}
 
+// postBatch sends one batch of results to the server
+func (s *satAgent) postBatch(ctx context.Context, localResults []sattypes.ServiceResult) error {
 	// debug prints
 	if s.debug {
 		log.Println(s.hello(), "POST ", localResults)
@@ -185,7 +697,7 @@ func (s *satAgent) postResults() {
 
 	/* post back to satserver */
 	client := http.Client{
-		Transport: http.DefaultTransport,
+		Transport: s.satTransport,
 		Timeout:   time.Second * 10,
 	}
 
@@ -193,23 +705,23 @@ func (s *satAgent) postResults() {
 	b := new(bytes.Buffer)
 	err := json.NewEncoder(b).Encode(localResults)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 
 	// add path to server url
 	// add json
-	request, err := http.NewRequest("POST", s.SatServerURL+"results", b)
+	request, err := http.NewRequestWithContext(ctx, "POST", s.SatServerURL+"results", b)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 
-	// set access key / token
-	request.Header.Set("agent-key", s.SatKey)
-	// transport my and location inside http header
-	request.Header.Set("agent-location", s.SatLocation)
-	request.Header.Set("agent-name", s.SatName)
+	// set access key / token, name, location and version
+	s.setHeaders(request)
+
+	// sign the batch
+	if s.SatSigningKey != nil {
+		request.Header.Set("agent-signature", base64.StdEncoding.EncodeToString(ed25519.Sign(s.SatSigningKey, b.Bytes())))
+	}
 
 	// set type to json
 	request.Header.Set("Content-Type", "application/json")
@@ -217,100 +729,270 @@ func (s *satAgent) postResults() {
 	// do the request
 	resp, err := client.Do(request)
 	if err != nil {
-		log.Println(err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		s.keyRefused(resp)
+		return fmt.Errorf("server answered %s", resp.Status)
+	}
+	s.receiveSecret(resp)
+	return nil
+}
+
+// health returns the self-metrics of the agent for the heartbeat
+func (s *satAgent) health() sattypes.AgentHealth {
+	health := sattypes.AgentHealth{
+		Uptime:      int64(time.Since(s.started).Seconds()),
+		FailedPosts: atomic.LoadInt64(&s.failedPosts),
+		Spooled:     s.spool.pending(),
+		Goroutines:  runtime.NumGoroutine(),
+	}
+	s.poolMutex.Lock()
+	if s.pool != nil {
+		health.Checks = s.pool.stats().Completed
+		health.SchedulerLag = s.pool.takeMaxLag().Seconds()
+	}
+	s.poolMutex.Unlock()
+	health.Time = time.Now()
+	return health
+}
+
+// sendHeartbeat posts the health of the agent to the server
+func (s *satAgent) sendHeartbeat() {
+	client := http.Client{
+		Transport: s.satTransport,
+		Timeout:   time.Second * 10,
+	}
+
+	b := new(bytes.Buffer)
+	err := json.NewEncoder(b).Encode(s.health())
+	if err != nil {
+		log.Println(s.hello(), err)
 		return
 	}
-	err = resp.Body.Close()
+	request, err := http.NewRequestWithContext(s.ctx, "POST", s.SatServerURL+"heartbeat", b)
 	if err != nil {
-		log.Println(err)
+		log.Println(s.hello(), err)
+		return
 	}
+	s.setHeaders(request)
+
+	resp, err := client.Do(request)
+	if err != nil {
+		if s.debug {
+			log.Println(s.hello(), "heartbeat failed", err)
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// older servers do not take heartbeats
+		log.Println(s.hello(), "server does not take heartbeats, stopping them")
+		s.heartbeatUnsupported.Store(true)
+	default:
+		log.Println(s.hello(), "heartbeat failed, server answered", resp.Status)
+	}
+}
+
+// runServiceCheck runs the check of a service and keeps the result for the server or the exporter
+func (s *satAgent) runServiceCheck(ctx context.Context, service sattypes.Service) {
+	result, ok := s.checkService(ctx, service)
+	if !ok {
+		return
+	}
+
+	// exporters keep the last result for scraping
+	if s.exporter != nil {
+		s.exporter.record(result)
+		return
+	}
+
+	// add result to local array
+	// could also be a channel, that holds the mutex (better performance?)
+	s.resultsMutex.Lock()
+	s.results = append(s.results, result)
+	s.resultsMutex.Unlock()
+
 }
 
-// runServiceCheck decides which service function is to be called
-func (s *satAgent) runServiceCheck(service sattypes.Service) {
+// checkService decides which service function is to be called, the check is cancelled after the timeout
+// of the service, when the service is removed from the configuration or when the agent stops,
+// returns false for cancelled checks
+func (s *satAgent) checkService(ctx context.Context, service sattypes.Service) (sattypes.ServiceResult, bool) {
+	timeout := service.TimeoutDuration()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
 	var result sattypes.ServiceResult
+	start := time.Now()
 	if service.Type == "http" {
-		result = s.HTTPCheck(service)
+		result = s.HTTPCheck(ctx, service)
 	} else if service.Type == "ping" {
-		result = s.PingCheck(service)
+		result = s.PingCheck(ctx, service)
 	} else if service.Type == "tcp" {
-		result = s.TCPCheck(service)
+		result = s.TCPCheck(ctx, service)
 	} else if service.Type == "tls" {
-		result = s.TLSCertCheck(service)
+		result = s.TLSCertCheck(ctx, service)
 	} else {
 		log.Println("Unknown check", result)
 	}
 
+	switch ctx.Err() {
+	case context.Canceled:
+		// the service has been removed or the agent stops, nobody waits for the result
+		if s.debug {
+			log.Println(s.hello(), "cancelled check", service.ServiceID)
+		}
+		return result, false
+	case context.DeadlineExceeded:
+		if result.Status != sattypes.ServiceUP {
+			result.Status = sattypes.ServiceDown
+			result.Reason = sattypes.ReasonTimeout
+			result.Message = fmt.Sprintf("Timeout after %s: %s", timeout, result.Message)
+		}
+	}
+
 	result.TestNode = s.SatLocation
 	result.Time = time.Now()
+	result.Latency = result.Time.Sub(start).Seconds()
+	return result, true
+}
 
-	// add result to local array
-	// could also be a channel, that holds the mutex (better performance?)
-	s.resultsMutex.Lock()
-	s.results = append(s.results, result)
-	s.resultsMutex.Unlock()
+// Stop cancels the running checks and ends Run
+func (s *satAgent) Stop() {
+	s.cancel()
+}
+
+// Shutdown stops the agent and sends the pending results to the server till the context is done,
+// results, that could not be sent, stay in the spool
+func (s *satAgent) Shutdown(ctx context.Context) error {
+	s.Stop()
+	select {
+	case <-s.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
+	// wait for a running post, then send the rest
+	select {
+	case s.postLock <- struct{}{}:
+		defer func() { <-s.postLock }()
+	case <-ctx.Done():
+		return fmt.Errorf("%d results stay in spool: %w", s.spool.pending(), ctx.Err())
+	}
+	s.spoolResults()
+	if err := s.postSpool(ctx); err != nil {
+		return fmt.Errorf("%d results stay in spool: %w", s.spool.pending(), err)
+	}
+	log.Println(s.hello(), "stopped")
+	return nil
 }
 
 // Run the satagent thread, got called from outside in a non-blocking go thread function
 func (s *satAgent) Run() {
+	defer close(s.stopped)
 	// print hello
 	s.motd()
-	// sleep for a while, then pull initial configuration
+	// exporters run the services of the local configuration only
+	if s.exporter != nil {
+		s.applyServices(s.exporter.services)
+	}
+	// pull initial configuration, run from the configuration cache, when the server is not reachable
 	for !s.satServerLoaded {
 		err := s.pullServerConfiguration()
-		if err != nil {
-			log.Printf("%s Connection to web panel %s\n", s.hello(), err)
-			time.Sleep(time.Second * 2)
-		} else {
+		if err == nil {
 			log.Printf("%s retrieved configuration", s.hello())
+			break
+		}
+		log.Printf("%s Connection to web panel %s\n", s.hello(), err)
+		if s.loadConfigCache() {
+			// keep retrying from the busy loop
+			s.retrySeconds = backoff(s.retrySeconds)
+			s.refreshSeconds = s.retrySeconds
+			break
+		}
+		s.retrySeconds = backoff(s.retrySeconds)
+		select {
+		case <-time.After(time.Second * time.Duration(s.retrySeconds)):
+		case <-s.ctx.Done():
+			return
 		}
 	}
 
-	// busy loop, installing timer for waiting for checks
+	// workers for running the checks
+	s.poolMutex.Lock()
+	s.pool = newWorkerPool(s.ctx, s.poolWorkers, s.poolQueueSize, s.poolTypeLimits, s.runServiceCheck)
+	s.poolMutex.Unlock()
+
+	// get configuration changes right away
+	s.startLongPoll()
+
+	// busy loop, installing timers for waiting for checks and for the configuration and results
 	idleTimer := time.NewTicker(s.blockTime)
+	checkTimer := time.NewTimer(s.schedule.wait(time.Now(), s.blockTime))
 	for {
 		// send some fancy message, that this thread is running
 		s.keepalive()
 		select {
-		// wait a specific time called blocktime then run pending serviceChecks
-		case <-idleTimer.C:
-			idleTimer.Reset(s.blockTime)
-			// lock mutex as we are working on it
-			// for every service that is stored in our slice
-			s.satServicesMutex.Lock()
-			for i, service := range s.satServices {
-				localService := service
-				// decrement next check interval with the number of blocked and waited seconds
-				s.satServices[i].NextInterval -= s.blockSeconds
-				// save next interval for possible configuration change
-				s.serviceInterval[s.satServices[i].ServiceID] = s.satServices[i].NextInterval
-				// if we reached our threshold, we need to run the check
-				if s.satServices[i].NextInterval <= 0 {
-					if s.debug {
-						log.Println(s.hello(), "service check due", s.satServices[i].ServiceID,
-							s.satServices[i].NextInterval)
-					}
-					// reset the service interval for next check
-					s.satServices[i].NextInterval = s.satServices[i].Interval
-					// start service check in a go thread, copy the object
-					// runServiceCheck will write the result into the results slice
-					go s.runServiceCheck(localService)
+		// the agent stops, running checks are cancelled by the context
+		case <-s.ctx.Done():
+			idleTimer.Stop()
+			checkTimer.Stop()
+			return
+		// run the service checks, that are due
+		case <-checkTimer.C:
+			for _, check := range s.schedule.due(time.Now()) {
+				if s.debug {
+					log.Println(s.hello(), "service check due", check.service.ServiceID)
+				}
+				// queue the service check for the worker pool
+				// runServiceCheck will write the result into the results slice
+				s.pool.submit(check.service, check.due)
+			}
+			checkTimer.Reset(s.schedule.wait(time.Now(), s.blockTime))
+		// the configuration has changed, wait for the new first slot
+		case <-s.rescheduled:
+			if !checkTimer.Stop() {
+				select {
+				case <-checkTimer.C:
+				default:
 				}
 			}
-			s.satServicesMutex.Unlock()
-			// try to refresh our configuration around every refreshSecondsDefault
+			checkTimer.Reset(s.schedule.wait(time.Now(), s.blockTime))
+		// wait a specific time called blocktime then refresh the configuration and post results
+		case <-idleTimer.C:
+			// exporters never talk to a server
+			if s.exporter != nil {
+				break
+			}
+			// try to refresh our configuration around every refreshSecondsDefault, unless waiting for changes
 			s.refreshSeconds -= s.blockSeconds
-			if s.refreshSeconds <= 0 {
+			if s.refreshSeconds <= 0 && !s.longPolling.Load() {
 				s.refreshSeconds = s.refreshSecondsDefault
 				err := s.pullServerConfiguration()
 				if err != nil {
-					log.Println(err)
+					// keep running the last configuration and retry with backoff
+					s.retrySeconds = backoff(s.retrySeconds)
+					s.refreshSeconds = s.retrySeconds
+					log.Println(s.hello(), err, "retry in", s.refreshSeconds, "seconds")
+				} else {
+					s.retrySeconds = 0
+					s.startLongPoll()
 				}
 			}
-			if len(s.results) >= 1 {
+			// send the health of the agent
+			if s.heartbeatInterval > 0 && time.Since(s.lastHeartbeat) >= s.heartbeatInterval && !s.heartbeatUnsupported.Load() {
+				s.lastHeartbeat = time.Now()
+				go s.sendHeartbeat()
+			}
+			if len(s.results) >= 1 || s.spool.pending() > 0 {
 				if s.debug {
-					log.Println("Size of results to send back to home is", len(s.results))
+					log.Println("Size of results to send back to home is", len(s.results), "spooled", s.spool.pending())
 				}
 				go s.postResults()
 			}
@@ -1,6 +1,7 @@
 package satagent_test
 
 import (
+	"context"
 	"net/http"
 	"runtime"
 	"testing"
@@ -23,7 +24,7 @@ func TestServiceCert(t *testing.T) {
 		ToCheck:   "google.com:443",
 		Expected:  "Google",
 	}
-	result := s.TLSCertCheck(service)
+	result := s.TLSCertCheck(context.Background(), service)
 
 	if result.Status != sattypes.ServiceUP {
 		t.Errorf("Status of cert check for google.com returned %s: %s", result.Status, result.Message)
@@ -44,7 +45,7 @@ func TestServiceCheckHTTP(t *testing.T) {
 		ToCheck:   "https://www.google.com",
 		Expected:  "Google",
 	}
-	result := s.HTTPCheck(service)
+	result := s.HTTPCheck(context.Background(), service)
 
 	if result.Status != sattypes.ServiceUP {
 		t.Errorf("Status of http check for google.com returned %s", result.Status)
@@ -63,7 +64,7 @@ func TestServiceCheckTCP(t *testing.T) {
 		Type:      "TCP",
 		ToCheck:   "www.google.com:80",
 	}
-	result := s.TCPCheck(service)
+	result := s.TCPCheck(context.Background(), service)
 
 	if result.Status != sattypes.ServiceUP {
 		t.Errorf("Status of TCP check for google.com returned %s", result.Status)
@@ -85,7 +86,7 @@ func TestServiceCheckPing(t *testing.T) {
 
 	// Ping only supported on Linux and Darwin
 	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
-		result := s.PingCheck(service)
+		result := s.PingCheck(context.Background(), service)
 		if result.Status != sattypes.ServiceUP {
 			t.Errorf("Status of Ping check for google.com returned %s", result.Status)
 		}
@@ -0,0 +1,175 @@
+package satagent
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+	"unfoldedip/sattypes"
+)
+
+// default interval for services without a valid interval
+const defaultInterval = time.Minute
+
+// scheduleEntry is a service with its next slot and the time, it is fired after the jitter
+type scheduleEntry struct {
+	service  sattypes.Service
+	interval time.Duration
+	slot     time.Time
+	fire     time.Time
+	index    int
+}
+
+// scheduleHeap orders the entries by fire time
+type scheduleHeap []*scheduleEntry
+
+func (h scheduleHeap) Len() int           { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool { return h[i].fire.Before(h[j].fire) }
+func (h scheduleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *scheduleHeap) Push(x any) {
+	entry := x.(*scheduleEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+func (h *scheduleHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// scheduler fires every service at fixed slots, the slots of a service are spread by a
+// phase offset from the hash of the service id, so services added at the same time do not
+// fire in the same second, slots are advanced by the interval and do not drift under load
+type scheduler struct {
+	entries scheduleHeap
+	byID    map[int64]*scheduleEntry
+	// jitter delays every run by up to this fraction of the interval, 0 = off
+	jitter float64
+	random *rand.Rand
+	mutex  sync.Mutex
+}
+
+// newScheduler returns an empty scheduler
+func newScheduler(jitter float64) *scheduler {
+	return &scheduler{
+		byID:   make(map[int64]*scheduleEntry),
+		jitter: jitter,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// phaseOffset returns the deterministic offset of a service inside its interval
+func phaseOffset(serviceID int64, interval time.Duration) time.Duration {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(strconv.FormatInt(serviceID, 10)))
+	return time.Duration(h.Sum64() % uint64(interval))
+}
+
+// nextSlot returns the first slot of a service after now
+func nextSlot(serviceID int64, interval time.Duration, now time.Time) time.Time {
+	offset := phaseOffset(serviceID, interval)
+	// slots are offset + n * interval since the unix epoch
+	elapsed := time.Duration(now.UnixNano()) - offset
+	n := elapsed / interval
+	if elapsed >= 0 {
+		n++
+	}
+	return time.Unix(0, int64(offset+n*interval))
+}
+
+// serviceInterval returns the interval of a service
+func serviceInterval(service sattypes.Service) time.Duration {
+	if service.Interval <= 0 {
+		return defaultInterval
+	}
+	return time.Second * time.Duration(service.Interval)
+}
+
+// update replaces the scheduled services, services with an unchanged interval keep their slots
+func (sc *scheduler) update(services []sattypes.Service, now time.Time) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	byID := make(map[int64]*scheduleEntry, len(services))
+	entries := make(scheduleHeap, 0, len(services))
+	for _, service := range services {
+		interval := serviceInterval(service)
+		entry, ok := sc.byID[service.ServiceID]
+		if !ok || entry.interval != interval {
+			entry = &scheduleEntry{interval: interval, slot: nextSlot(service.ServiceID, interval, now)}
+			entry.fire = sc.withJitter(entry.slot, interval)
+		}
+		entry.service = service
+		byID[service.ServiceID] = entry
+		entries = append(entries, entry)
+	}
+	for i := range entries {
+		entries[i].index = i
+	}
+	heap.Init(&entries)
+	sc.entries = entries
+	sc.byID = byID
+}
+
+// dueCheck is a service, that is due, with the time, it was due at
+type dueCheck struct {
+	service sattypes.Service
+	due     time.Time
+}
+
+// due returns all services, that are due at now, and schedules their next slots
+func (sc *scheduler) due(now time.Time) []dueCheck {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	var services []dueCheck
+	for len(sc.entries) > 0 && !sc.entries[0].fire.After(now) {
+		entry := sc.entries[0]
+		services = append(services, dueCheck{service: entry.service, due: entry.fire})
+		entry.slot = entry.slot.Add(entry.interval)
+		// slots missed under load are not caught up
+		if !entry.slot.After(now) {
+			entry.slot = nextSlot(entry.service.ServiceID, entry.interval, now)
+		}
+		entry.fire = sc.withJitter(entry.slot, entry.interval)
+		heap.Fix(&sc.entries, 0)
+	}
+	return services
+}
+
+// wait returns the duration till the next service is due, maxWait without services
+func (sc *scheduler) wait(now time.Time, maxWait time.Duration) time.Duration {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if len(sc.entries) == 0 {
+		return maxWait
+	}
+	wait := sc.entries[0].fire.Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	if wait > maxWait {
+		return maxWait
+	}
+	return wait
+}
+
+// withJitter delays a slot by a random part of the interval, the mutex must be held
+func (sc *scheduler) withJitter(slot time.Time, interval time.Duration) time.Time {
+	if sc.jitter <= 0 {
+		return slot
+	}
+	maxJitter := int64(float64(interval) * sc.jitter)
+	if maxJitter <= 0 {
+		return slot
+	}
+	return slot.Add(time.Duration(sc.random.Int63n(maxJitter)))
+}
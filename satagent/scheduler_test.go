@@ -0,0 +1,96 @@
+package satagent
+
+import (
+	"testing"
+	"time"
+	"unfoldedip/sattypes"
+)
+
+func TestSchedulerSpread(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	var services []sattypes.Service
+	for i := 1; i <= 60; i++ {
+		services = append(services, sattypes.Service{ServiceID: int64(i), Interval: 60})
+	}
+
+	sc := newScheduler(0)
+	sc.update(services, now)
+
+	// services added together are spread over the interval
+	seconds := make(map[int64]bool)
+	for _, entry := range sc.byID {
+		if entry.slot.Before(now) || !entry.slot.Before(now.Add(time.Minute)) {
+			t.Errorf("Slot %s of service %d is outside the first interval", entry.slot, entry.service.ServiceID)
+		}
+		seconds[entry.slot.Unix()] = true
+	}
+	if len(seconds) < 20 {
+		t.Errorf("60 services fire in only %d different seconds", len(seconds))
+	}
+
+	// the phase offset is deterministic
+	if nextSlot(7, time.Minute, now) != sc.byID[7].slot || phaseOffset(7, time.Minute) != phaseOffset(7, time.Minute) {
+		t.Error("Slot of service 7 changed")
+	}
+
+	// an unchanged service keeps its slot on reload, a changed interval gets a new one
+	slot := sc.byID[1].slot
+	services[1].Interval = 120
+	sc.update(services[:30], now.Add(time.Second*30))
+	if sc.byID[1].slot != slot || len(sc.byID) != 30 {
+		t.Errorf("Reload changed slot of service 1 or kept removed services")
+	}
+	if sc.byID[2].interval != time.Minute*2 {
+		t.Errorf("Interval of service 2 is %s after reload", sc.byID[2].interval)
+	}
+}
+
+func TestSchedulerDrift(t *testing.T) {
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	sc := newScheduler(0)
+	sc.update([]sattypes.Service{{ServiceID: 42, Interval: 10}}, start)
+	first := sc.byID[42].slot
+
+	// the loop wakes up late every time, the slots stay on the grid
+	now := first
+	var runs int
+	for i := 0; i < 100; i++ {
+		now = now.Add(time.Second*10 + time.Millisecond*300)
+		runs += len(sc.due(now))
+	}
+	if expected := first.Add(time.Second * 10 * 104); sc.byID[42].slot != expected {
+		t.Errorf("Slot drifted to %s, expected %s", sc.byID[42].slot, expected)
+	}
+	// a run every 10.3 seconds misses 3 slots in 100 runs, they are not caught up
+	if runs != 100 {
+		t.Errorf("%d runs, expected 100", runs)
+	}
+
+	// a long stall does not fire the missed slots
+	now = now.Add(time.Minute * 5)
+	if due := sc.due(now); len(due) != 1 {
+		t.Errorf("%d checks fired after stall, expected 1", len(due))
+	}
+	if wait := sc.wait(now, time.Minute); wait <= 0 || wait > time.Second*10 {
+		t.Errorf("Wait after stall is %s", wait)
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	sc := newScheduler(0.1)
+	sc.update([]sattypes.Service{{ServiceID: 1, Interval: 100}}, now)
+
+	for i := 0; i < 50; i++ {
+		entry := sc.byID[1]
+		if delay := entry.fire.Sub(entry.slot); delay < 0 || delay >= time.Second*10 {
+			t.Fatalf("Jitter of %s exceeds 10%% of the interval", delay)
+		}
+		slot := entry.slot
+		sc.due(entry.fire)
+		// the jitter does not move the slots
+		if sc.byID[1].slot != slot.Add(time.Second*100) {
+			t.Fatalf("Slot moved by jitter to %s", sc.byID[1].slot)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package satagent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unfoldedip/sattypes"
+)
+
+// default limits for the spool
+const (
+	defaultSpoolSize = 10000
+	postBatchSize    = 500
+)
+
+// compactMinLines is the number of stale lines in the spool file, after that it may be rewritten
+const compactMinLines = 1000
+
+// spool keeps unsent results in order till the server accepted them,
+// the results are appended to a file with one JSON result per line, so they survive a restart of the agent.
+// Dropped and evicted results are appended as a "drop n" line, the file is only rewritten without
+// them, when the spool is empty or the stale lines outnumber the results
+type spool struct {
+	// file for persisting, empty = memory only
+	file string
+	// maximum number of results, the oldest are evicted first
+	maxResults int
+	results    []sattypes.ServiceResult
+	// stale is the number of result lines in the file, that were dropped or evicted
+	stale int
+	mutex sync.Mutex
+}
+
+// newSpool creates a spool and loads the results left over in file
+func newSpool(file string, maxResults int) *spool {
+	sp := &spool{file: file, maxResults: maxResults}
+	if file == "" {
+		return sp
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("spool:", err)
+		}
+		return sp
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if n, ok := dropLine(scanner.Text()); ok {
+			if n > len(sp.results) {
+				n = len(sp.results)
+			}
+			sp.results = sp.results[n:]
+			sp.stale += n
+			continue
+		}
+		var result sattypes.ServiceResult
+		// a line cut by a crash is skipped
+		if json.Unmarshal(scanner.Bytes(), &result) == nil {
+			sp.results = append(sp.results, result)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		log.Println("spool:", err)
+	}
+	sp.results = append([]sattypes.ServiceResult(nil), sp.results...)
+	sp.evict()
+	// start with a file without stale lines and without a last line cut by a crash,
+	// that would be glued to the next appended line
+	if sp.stale > 0 || !endsWithNewline(f) {
+		sp.compact()
+	}
+	return sp
+}
+
+// endsWithNewline returns false for a file, whose last line has no newline
+func endsWithNewline(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return true
+	}
+	last := make([]byte, 1)
+	if _, err = f.ReadAt(last, info.Size()-1); err != nil {
+		return true
+	}
+	return last[0] == '\n'
+}
+
+// dropLine returns the number of the "drop n" line of the spool file
+func dropLine(line string) (int, bool) {
+	count, ok := strings.CutPrefix(line, "drop ")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(count)
+	return n, err == nil && n >= 0
+}
+
+// add appends results, evicts the oldest above the limit and appends them to the file
+func (sp *spool) add(results []sattypes.ServiceResult) {
+	if len(results) == 0 {
+		return
+	}
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	sp.results = append(sp.results, results...)
+
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	for i := range results {
+		if err := encoder.Encode(results[i]); err != nil {
+			log.Println("spool:", err)
+			return
+		}
+	}
+	if evicted := sp.evict(); evicted > 0 {
+		fmt.Fprintf(&b, "drop %d\n", evicted)
+	}
+	sp.append(b.Bytes())
+}
+
+// peek returns up to n of the oldest results
+func (sp *spool) peek(n int) []sattypes.ServiceResult {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	if n > len(sp.results) {
+		n = len(sp.results)
+	}
+	batch := make([]sattypes.ServiceResult, n)
+	copy(batch, sp.results[:n])
+	return batch
+}
+
+// drop removes the n oldest results, after the server accepted them
+func (sp *spool) drop(n int) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	if n > len(sp.results) {
+		n = len(sp.results)
+	}
+	if n == 0 {
+		return
+	}
+	sp.results = append([]sattypes.ServiceResult(nil), sp.results[n:]...)
+	sp.stale += n
+	if len(sp.results) == 0 || (sp.stale >= compactMinLines && sp.stale > len(sp.results)) {
+		sp.compact()
+		return
+	}
+	sp.append([]byte(fmt.Sprintf("drop %d\n", n)))
+}
+
+// pending returns the number of unsent results
+func (sp *spool) pending() int {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	return len(sp.results)
+}
+
+// evict removes the oldest results above the limit and returns their number, the mutex must be held
+func (sp *spool) evict() int {
+	if sp.maxResults <= 0 || len(sp.results) <= sp.maxResults {
+		return 0
+	}
+	evicted := len(sp.results) - sp.maxResults
+	log.Println("spool: full, evicting", evicted, "oldest results")
+	sp.results = append([]sattypes.ServiceResult(nil), sp.results[evicted:]...)
+	sp.stale += evicted
+	return evicted
+}
+
+// append writes lines to the end of the spool file, the mutex must be held
+func (sp *spool) append(lines []byte) {
+	if sp.file == "" {
+		return
+	}
+	f, err := os.OpenFile(sp.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Println("spool:", err)
+		return
+	}
+	_, err = f.Write(lines)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Println("spool:", err)
+	}
+}
+
+// compact rewrites the spool file with the pending results only, the mutex must be held
+func (sp *spool) compact() {
+	if sp.file == "" {
+		return
+	}
+
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	for i := range sp.results {
+		if err := encoder.Encode(sp.results[i]); err != nil {
+			log.Println("spool:", err)
+			return
+		}
+	}
+
+	// replace the file in one step, so a crash leaves the old or the new spool
+	tmp := sp.file + ".tmp"
+	err := os.WriteFile(tmp, b.Bytes(), 0600)
+	if err == nil {
+		err = os.Rename(tmp, sp.file)
+	}
+	if err != nil {
+		log.Println("spool:", err)
+		return
+	}
+	sp.stale = 0
+}
@@ -0,0 +1,255 @@
+package satagent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unfoldedip/sattypes"
+)
+
+// results returns n results with ascending service ids starting at first
+func results(first, n int) []sattypes.ServiceResult {
+	var r []sattypes.ServiceResult
+	for i := 0; i < n; i++ {
+		r = append(r, sattypes.ServiceResult{ServiceID: int64(first + i), Status: sattypes.ServiceUP})
+	}
+	return r
+}
+
+func TestSpool(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "satagent.spool")
+
+	sp := newSpool(file, 5)
+	sp.add(results(1, 3))
+	sp.add(results(4, 4))
+	if sp.pending() != 5 {
+		t.Fatalf("Spool holds %d results, expected 5", sp.pending())
+	}
+	// the oldest are evicted
+	if batch := sp.peek(2); batch[0].ServiceID != 3 || batch[1].ServiceID != 4 {
+		t.Errorf("Oldest results in spool are %v, expected 3 and 4", batch)
+	}
+
+	sp.drop(2)
+	// a new spool loads the left over results in order
+	sp = newSpool(file, 5)
+	batch := sp.peek(10)
+	if len(batch) != 3 || batch[0].ServiceID != 5 || batch[2].ServiceID != 7 {
+		t.Errorf("Reloaded spool holds %v, expected 5 till 7", batch)
+	}
+}
+
+func TestSpoolAppend(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "satagent.spool")
+	lines := func() []string {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	// adds and drops are appended, the results are not written again
+	sp := newSpool(file, 10)
+	sp.add(results(1, 4))
+	sp.drop(1)
+	sp.add(results(5, 8))
+	if got := lines(); len(got) != 14 || got[4] != "drop 1" || got[13] != "drop 1" {
+		t.Fatalf("Spool file is %q", got)
+	}
+
+	// a new spool replays drops and evictions and starts with a compacted file
+	sp = newSpool(file, 10)
+	if batch := sp.peek(20); len(batch) != 10 || batch[0].ServiceID != 3 || batch[9].ServiceID != 12 {
+		t.Errorf("Reloaded spool holds %v, expected 3 till 12", batch)
+	}
+	if got := lines(); len(got) != 10 {
+		t.Errorf("Reloaded spool file has %d lines, expected 10", len(got))
+	}
+
+	// many stale lines are compacted away
+	sp = newSpool(file, 0)
+	sp.drop(10)
+	sp.add(results(100, compactMinLines+10))
+	for i := 0; i < compactMinLines/2; i++ {
+		sp.drop(1)
+	}
+	if got := len(lines()); got != compactMinLines+10+compactMinLines/2 {
+		t.Errorf("Spool file has %d lines before compaction", got)
+	}
+	sp.drop(compactMinLines / 2)
+	if got := len(lines()); got != 10 {
+		t.Errorf("Spool file has %d lines after compaction, expected 10", got)
+	}
+
+	// an empty spool leaves an empty file
+	sp.drop(10)
+	if data, _ := os.ReadFile(file); len(data) != 0 {
+		t.Errorf("Empty spool left %q", data)
+	}
+}
+
+func TestSpoolTornLine(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "satagent.spool")
+	sp := newSpool(file, 0)
+	sp.add(results(1, 2))
+
+	// a crash cut the last line, the next results are still readable after a restart
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(file, data[:len(data)-10], 0600); err != nil {
+		t.Fatal(err)
+	}
+	sp = newSpool(file, 0)
+	sp.add(results(3, 1))
+	sp = newSpool(file, 0)
+	if batch := sp.peek(10); len(batch) != 2 || batch[0].ServiceID != 1 || batch[1].ServiceID != 3 {
+		t.Errorf("Spool after a torn line holds %v, expected 1 and 3", batch)
+	}
+}
+
+func TestSpoolReplay(t *testing.T) {
+	var mutex sync.Mutex
+	var received []int64
+	var requests int
+	down := true
+
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		if down {
+			writer.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var batch []sattypes.ServiceResult
+		if err := json.NewDecoder(request.Body).Decode(&batch); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for i := range batch {
+			received = append(received, batch[i].ServiceID)
+		}
+	}))
+	defer server.Close()
+
+	s := CreateSatAgent(server.URL, "agent", "location", false, sattypes.BaseHandler{})
+	s.SetSpool(filepath.Join(t.TempDir(), "satagent.spool"), 1000)
+
+	// results of an outage stay in the spool, the next post waits for the backoff
+	s.results = results(1, 300)
+	s.postResults()
+	s.results = results(301, 300)
+	s.postResults()
+	if s.spool.pending() != 600 {
+		t.Fatalf("Spool holds %d results during outage, expected 600", s.spool.pending())
+	}
+	if requests != 1 {
+		t.Errorf("Server got %d requests during backoff, expected 1", requests)
+	}
+
+	// and are replayed in order after the backoff
+	mutex.Lock()
+	down = false
+	mutex.Unlock()
+	s.postRetryAt = time.Time{}
+	s.results = results(601, 10)
+	s.postResults()
+
+	if s.spool.pending() != 0 {
+		t.Errorf("Spool holds %d results after replay", s.spool.pending())
+	}
+	if len(received) != 610 {
+		t.Fatalf("Server received %d results, expected 610", len(received))
+	}
+	for i, id := range received {
+		if id != int64(i+1) {
+			t.Fatalf("Result %d has service id %d, replay is out of order", i, id)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	var received []sattypes.ServiceResult
+	var mutex sync.Mutex
+	server := httptest.NewServer(withHello(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method == "POST" {
+			var r []sattypes.ServiceResult
+			_ = json.NewDecoder(request.Body).Decode(&r)
+			mutex.Lock()
+			received = append(received, r...)
+			mutex.Unlock()
+			return
+		}
+		_ = json.NewEncoder(writer).Encode([]sattypes.Service{{ServiceID: 1, Type: "tcp", ToCheck: "127.0.0.1:1", Interval: 3600}})
+	}))
+	defer server.Close()
+
+	s := CreateSatAgent(server.URL, "agent", "location", false, sattypes.BaseHandler{})
+	go s.Run()
+	time.Sleep(time.Millisecond * 100)
+
+	// results collected since the last post are sent on shutdown
+	s.resultsMutex.Lock()
+	s.results = append(s.results, results(1, 3)...)
+	s.resultsMutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(received) != 3 || s.spool.pending() != 0 {
+		t.Errorf("Server received %d results, %d pending, expected 3 and 0", len(received), s.spool.pending())
+	}
+}
+
+func TestShutdownHangingServer(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(withHello(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method == "POST" {
+			// the server hangs, till the test is done
+			select {
+			case <-release:
+			case <-request.Context().Done():
+			}
+			return
+		}
+		_ = json.NewEncoder(writer).Encode([]sattypes.Service{{ServiceID: 1, Type: "tcp", ToCheck: "127.0.0.1:1", Interval: 3600}})
+	}))
+	defer server.Close()
+	defer close(release)
+
+	s := CreateSatAgent(server.URL, "agent", "location", false, sattypes.BaseHandler{})
+	close(s.stopped)
+
+	// a running post holds the lock, while the server hangs
+	s.results = results(1, 3)
+	go s.postResults()
+	time.Sleep(time.Millisecond * 100)
+
+	// the shutdown ends with its context and keeps the results in the spool
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	start := time.Now()
+	if err := s.Shutdown(ctx); err == nil {
+		t.Error("Shutdown succeeded with a hanging server")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*2 {
+		t.Errorf("Shutdown took %v", elapsed)
+	}
+	if s.spool.pending() != 3 {
+		t.Errorf("Spool holds %d results, expected 3", s.spool.pending())
+	}
+}
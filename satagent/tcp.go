@@ -1,24 +1,24 @@
 package satagent
 
 import (
+	"context"
 	"log"
 	"net"
-	"time"
 	"unfoldedip/sattypes"
 )
 
-// TCPCheck checks a service for a successful tcp connection
-func (s *satAgent) TCPCheck(service sattypes.Service) sattypes.ServiceResult {
+// TCPCheck checks a service for a successful tcp connection, till the context is done
+func (s *satAgent) TCPCheck(ctx context.Context, service sattypes.Service) sattypes.ServiceResult {
 	log.Println(s.hello(), "TCP Check", service.ToCheck, service.ServiceID)
 
 	// prepare result set
 	var sResult sattypes.ServiceResult
 	sResult.ServiceID = service.ServiceID
 
-	// generate TCP connection with timeout
-	tcpDialer := net.Dialer{Timeout: time.Second * 5}
+	// generate TCP connection, the timeout is set by the context
+	var tcpDialer net.Dialer
 
-	conn, err := tcpDialer.Dial("tcp", service.ToCheck)
+	conn, err := tcpDialer.DialContext(ctx, "tcp", service.ToCheck)
 	if err != nil {
 		sResult.Status = sattypes.ServiceDown
 		sResult.Message = err.Error()
@@ -0,0 +1,298 @@
+package satanalytics
+
+// notify contains the code to pitch the alert messages,
+// either directly, collected as digest for an alert group,
+// deferred to the schedule of a recipient or once a day as summary,
+// dead agents are reported to the admin alert group
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unfoldedip/satsql"
+	"unfoldedip/sattypes"
+)
+
+// pendingDigest collects the notifications of an alert group during the aggregation window
+type pendingDigest struct {
+	group         sattypes.AlertGroup
+	notifications []sattypes.ServiceNotification
+	due           time.Time
+}
+
+// deferredNotification holds back the notifications for a recipient till the start of the next window
+type deferredNotification struct {
+	group         sattypes.AlertGroup
+	recipient     string
+	notifications []sattypes.ServiceNotification
+	due           time.Time
+}
+
+// recipients returns the cleaned up email addresses of an alert group
+// and the member of the rotation, that is on call right now
+func (s *satanalytics) recipients(group sattypes.AlertGroup) []string {
+	var emails []string
+	seen := make(map[string]bool)
+	add := func(email string) {
+		email = strings.TrimSpace(email)
+		if email != "" && !seen[strings.ToLower(email)] {
+			seen[strings.ToLower(email)] = true
+			emails = append(emails, email)
+		}
+	}
+
+	for _, email := range strings.Split(group.Emails, ",") {
+		add(email)
+	}
+
+	if group.RotationID != 0 {
+		rotation, err := satsql.SelectRotation(s.H, group.RotationID)
+		if err != nil {
+			log.Println(err)
+			return emails
+		}
+		overrides, err := satsql.ReadRotationOverrides(s.H, group.RotationID)
+		if err != nil {
+			log.Println(err)
+		}
+		add(rotation.OnCall(time.Now(), overrides))
+	}
+	return emails
+}
+
+// notify sends or collects the notification for a service transition
+func (s *satanalytics) notify(r sattypes.ServiceResult) {
+	service, err := satsql.SelectService(s.H, "service_id", fmt.Sprintf("%d", r.ServiceID), 0)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if !s.HasSMTPConfig || service.ContactGroup == 0 {
+		log.Println("Don't have working SMTP-configuration for sending alert")
+		log.Println("Service changed up/down", s.Tracker[r.ServiceID], r.Status)
+		log.Println(service, r)
+		return
+	}
+
+	group, err := satsql.SelectAlertGroup(s.H, "contact_id", fmt.Sprintf("%d", service.ContactGroup))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	notification := s.serviceNotification(service, r)
+
+	// no aggregation window, send right now
+	if group.DigestSeconds <= 0 {
+		s.dispatch(group, []sattypes.ServiceNotification{notification})
+		return
+	}
+
+	// open a new window or collect into the running one
+	digest, ok := s.digests[group.ContactID]
+	if !ok {
+		digest = &pendingDigest{group: group, due: time.Now().Add(time.Second * time.Duration(group.DigestSeconds))}
+		s.digests[group.ContactID] = digest
+	}
+	digest.notifications = append(digest.notifications, notification)
+}
+
+// flushDigests sends out all digests, whose aggregation window is over
+func (s *satanalytics) flushDigests(now time.Time) {
+	for groupID, digest := range s.digests {
+		if now.Before(digest.due) {
+			continue
+		}
+		delete(s.digests, groupID)
+		s.dispatch(digest.group, digest.notifications)
+	}
+}
+
+// dispatch sends the notifications to every recipient of the alert group, notifications
+// outside the schedule of a recipient are deferred to the next window, unless one is critical
+func (s *satanalytics) dispatch(group sattypes.AlertGroup, notifications []sattypes.ServiceNotification) {
+	schedules, err := satsql.ReadNotificationSchedules(s.H, group.ContactID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	now := time.Now()
+	for _, recipient := range s.recipients(group) {
+		due := nextWindow(schedules, recipient, now)
+		if due.After(now) && !critical(notifications) {
+			key := fmt.Sprintf("%d/%s", group.ContactID, recipient)
+			deferred, ok := s.deferred[key]
+			if !ok {
+				deferred = &deferredNotification{group: group, recipient: recipient, due: due}
+				s.deferred[key] = deferred
+			}
+			deferred.notifications = append(deferred.notifications, notifications...)
+			if s.H.Debug {
+				log.Println("Deferring notification for", recipient, "till", due)
+			}
+			continue
+		}
+		s.send(group, recipient, notifications)
+	}
+}
+
+// flushDeferred sends out all deferred notifications, whose recipients are back in their schedule
+func (s *satanalytics) flushDeferred(now time.Time) {
+	for key, deferred := range s.deferred {
+		if now.Before(deferred.due) {
+			continue
+		}
+		delete(s.deferred, key)
+		s.send(deferred.group, deferred.recipient, deferred.notifications)
+	}
+}
+
+// send sends the notifications to a recipient, a single notification is sent as service mail, more as digest
+func (s *satanalytics) send(group sattypes.AlertGroup, recipient string, notifications []sattypes.ServiceNotification) {
+	s.outbox.Add(1)
+	go func() {
+		defer s.outbox.Done()
+		var err error
+		if len(notifications) == 1 {
+			err = s.H.SMTPConfiguration.SendServiceMail(notifications[0], recipient)
+			s.mailed("service", err)
+			if err == nil {
+				s.openThread(notifications[0])
+			}
+		} else {
+			err = s.H.SMTPConfiguration.SendDigestMail(sattypes.DigestNotification{
+				AlertGroup:    group,
+				Notifications: notifications,
+				ServerURL:     s.H.URL,
+			}, recipient)
+			s.mailed("digest", err)
+		}
+		if err != nil {
+			log.Println("SMTP-failed", err)
+			log.Println("Don't have working SMTP-configuration for sending alert to", recipient)
+		}
+	}()
+}
+
+// nextWindow returns the earliest time, the recipient wants to be notified, recipients without
+// any schedule are notified right now
+func nextWindow(schedules []sattypes.NotificationSchedule, recipient string, now time.Time) time.Time {
+	var next time.Time
+	for _, ns := range schedules {
+		if !strings.EqualFold(ns.Email, recipient) {
+			continue
+		}
+		window := ns.NextWindow(now)
+		if next.IsZero() || window.Before(next) {
+			next = window
+		}
+	}
+	if next.IsZero() {
+		return now
+	}
+	return next
+}
+
+// critical returns true, if one of the notifications is for a critical service
+func critical(notifications []sattypes.ServiceNotification) bool {
+	for _, n := range notifications {
+		if n.Service.Severity == sattypes.SeverityCritical {
+			return true
+		}
+	}
+	return false
+}
+
+// agentNotify sends the dead or recovered agent event to the admin alert group
+func (s *satanalytics) agentNotify(name string, agent agentTracking) {
+	s.sendAgentNotification(sattypes.AgentNotification{
+		Name:      name,
+		Location:  agent.location,
+		Down:      agent.down,
+		LastSeen:  agent.lastSeen,
+		Silence:   s.H.AgentSilence,
+		ServerURL: s.H.URL,
+	})
+}
+
+// agentHealthNotify sends the unhealthy or healthy again event of an agent to the admin alert group
+func (s *satanalytics) agentHealthNotify(name string, agent agentTracking, problem string, unhealthy bool) {
+	s.sendAgentNotification(sattypes.AgentNotification{
+		Name:      name,
+		Location:  agent.location,
+		Down:      unhealthy,
+		LastSeen:  agent.lastSeen,
+		ServerURL: s.H.URL,
+		Problem:   problem,
+	})
+}
+
+// sendAgentNotification sends an agent event to every recipient of the admin alert group
+func (s *satanalytics) sendAgentNotification(notification sattypes.AgentNotification) {
+	if !s.HasSMTPConfig || s.H.AdminAlertGroup == 0 {
+		return
+	}
+
+	group, err := satsql.SelectAlertGroup(s.H, "contact_id", fmt.Sprintf("%d", s.H.AdminAlertGroup))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, recipient := range s.recipients(group) {
+		s.outbox.Add(1)
+		go func(recipient string) {
+			defer s.outbox.Done()
+			err := s.H.SMTPConfiguration.SendAgentMail(notification, recipient)
+			s.mailed("agent", err)
+			if err != nil {
+				log.Println("SMTP-failed", err)
+			}
+		}(recipient)
+	}
+}
+
+// dailySummary sends the summary once a day at the configured hour
+func (s *satanalytics) dailySummary(now time.Time) {
+	if s.H.SummaryHour < 0 || now.Hour() != s.H.SummaryHour || !s.HasSMTPConfig {
+		return
+	}
+	today := now.Format("2006-01-02")
+	if s.lastSummary == today {
+		return
+	}
+	s.lastSummary = today
+
+	groups, err := satsql.ReadSummaryAlertGroups(s.H)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	since := now.Add(-time.Hour * 24)
+	for _, group := range groups {
+		summary := sattypes.SummaryNotification{AlertGroup: group, Since: since, ServerURL: s.H.URL}
+		summary.Services, err = satsql.ReadAlertGroupServices(s.H, group.ContactID)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		summary.Logs, err = satsql.ReadAlertGroupLogsSince(s.H, group.ContactID, since)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, recipient := range s.recipients(group) {
+			s.outbox.Add(1)
+			go func(summary sattypes.SummaryNotification, recipient string) {
+				defer s.outbox.Done()
+				err := s.H.SMTPConfiguration.SendSummaryMail(summary, recipient)
+				s.mailed("summary", err)
+				if err != nil {
+					log.Println("SMTP-failed", err)
+				}
+			}(summary, recipient)
+		}
+	}
+}
@@ -7,11 +7,11 @@ package satanalytics
 // - pitching the alert messages
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"runtime"
-	"strconv"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 	"unfoldedip/satsql"
@@ -28,12 +28,31 @@ type serviceTracking struct {
 	// for the last 8 bits
 	stateHistory uint64
 	lastSeen     time.Time
+	// last result for every location, that reported this service
+	lastResults map[string]sattypes.ServiceResult
+	// message id of the mail, that opened the current incident
+	threadID string
+	// number of state changes since the start
+	transitions int64
 }
 
 type agentTracking struct {
 	lastSeen time.Time
+	location string
+	// down is set, after the agent was silent for the silence period
+	down bool
+	// overloaded and skewed are set from the heartbeats, when the agent exceeds the limits
+	overloaded bool
+	skewed     bool
+	// heartbeats in a row, that disagree with overloaded and skewed
+	overloadedChanges int
+	skewedChanges     int
 }
 
+// agentHealthHeartbeats is the number of heartbeats in a row, that must exceed a limit or stay below it again,
+// before the event is raised or cleared, so an agent near the limit doesn't flap
+const agentHealthHeartbeats = 3
+
 // satanalytics object with all necessary information
 type satanalytics struct {
 	Name              string
@@ -44,6 +63,20 @@ type satanalytics struct {
 	H                 sattypes.BaseHandler
 	HasSMTPConfig     bool
 	ReadMessages      int64
+	// digests collects notifications per alert group during the aggregation window
+	digests map[int64]*pendingDigest
+	// deferred holds back notifications per alert group and recipient outside of their schedule
+	deferred map[string]*deferredNotification
+	// day of the last daily summary
+	lastSummary string
+	// mails, that are still being sent
+	outbox sync.WaitGroup
+	// sent and failed mails per kind
+	mails      map[string]*sattypes.MailMetrics
+	mailsMutex sync.Mutex
+	// stop ends Run, stopped is closed, when Run returns
+	stop    chan struct{}
+	stopped chan struct{}
 }
 
 // keepalive
@@ -53,6 +86,8 @@ func (s *satanalytics) keepalive() {
 
 // keepalive
 func (s *satanalytics) GetReadMessages() int64 {
+	s.TrackerMutex.Lock()
+	defer s.TrackerMutex.Unlock()
 	return s.ReadMessages
 }
 
@@ -60,11 +95,14 @@ func (s *satanalytics) GetReadMessages() int64 {
 func CreateSatAnalytics(name string, H sattypes.BaseHandler) *satanalytics {
 	s := satanalytics{Name: name}
 	s.Tracker = make(map[int64]*serviceTracking)
+	s.AgentTracker = make(map[string]*agentTracking)
+	s.digests = make(map[int64]*pendingDigest)
+	s.deferred = make(map[string]*deferredNotification)
+	s.mails = make(map[string]*sattypes.MailMetrics)
+	s.stop = make(chan struct{})
+	s.stopped = make(chan struct{})
 	s.H = H
-	if len(H.SMTPConfiguration.SmtpSender) != 0 && len(H.SMTPConfiguration.SmtpUser) != 0 &&
-		len(H.SMTPConfiguration.SmtpPassword) != 0 && len(H.SMTPConfiguration.SmtpServer) != 0 {
-		s.HasSMTPConfig = true
-	}
+	s.HasSMTPConfig = H.SMTPConfiguration.Configured()
 	return &s
 }
 
@@ -88,34 +126,109 @@ func (s *satanalytics) load() {
 	}
 
 	// Load agent nodes
-	//agents, err := satsql.ReadAgents(s.H)
-	//if err != nil && err != sql.ErrNoRows {
-	//	log.Println("Cant load initial configuration", err)
-	//	return
-	//}
-	// Walk every service and create a tracker
-	// this is optimistic currently, because we update lastSeen with current time and not with the actual
-	// value from the database (sqlite issue)
-	//for _, agent := range agents {
-	//	s.AgentTracker[agent.SatAgentID] = &agentTracking{lastSeen: time.Now()}
-	//}
+	agents, err := satsql.ReadAgents(s.H)
+	if err != nil {
+		log.Println("Cant load agents", err)
+		return
+	}
+	// Walk every agent and create a tracker with the last seen time from the database,
+	// agents, that are already silent, are considered down without a notification
+	for _, agent := range agents {
+		lastSeen, err := time.ParseInLocation("2006-01-02 15:04:05", agent.LastSeen, time.UTC)
+		if err != nil {
+			lastSeen = time.Now()
+		}
+		s.AgentTracker[agent.SatAgentName] = &agentTracking{
+			lastSeen: lastSeen,
+			location: agent.SatAgentLocation,
+			down:     s.H.AgentSilence > 0 && time.Since(lastSeen) > s.H.AgentSilence,
+		}
+	}
+}
+
+// agentSeen updates the last seen time of an agent and raises the recovered event for dead agents
+func (s *satanalytics) agentSeen(a sattypes.AgentSeen) {
+	s.AgentTrackerMutex.Lock()
+	defer s.AgentTrackerMutex.Unlock()
+
+	agent, ok := s.AgentTracker[a.Name]
+	if !ok {
+		agent = &agentTracking{}
+		s.AgentTracker[a.Name] = agent
+	}
+	agent.lastSeen = a.Time
+	agent.location = a.Location
 
+	if agent.down {
+		agent.down = false
+		log.Println("Node", a.Name, "has recovered")
+		s.agentNotify(a.Name, *agent)
+	}
+
+	if a.Health != nil {
+		s.agentHealth(a.Name, agent, *a.Health)
+	}
+}
+
+// agentHealth raises and clears the overloaded and the skewed clock events of an agent
+func (s *satanalytics) agentHealth(name string, agent *agentTracking, health sattypes.AgentHealth) {
+	lag := time.Duration(health.SchedulerLag * float64(time.Second)).Round(time.Second)
+	overloaded := s.H.AgentMaxLag > 0 && lag > s.H.AgentMaxLag
+	if healthChanged(agent.overloaded, overloaded, &agent.overloadedChanges) {
+		agent.overloaded = overloaded
+		problem := fmt.Sprintf("is overloaded, checks start up to %s late, limit %s", lag, s.H.AgentMaxLag)
+		if !overloaded {
+			problem = fmt.Sprintf("is not overloaded anymore, checks start up to %s late, limit %s", lag, s.H.AgentMaxLag)
+		}
+		log.Println("Node", name, problem)
+		s.agentHealthNotify(name, *agent, problem, overloaded)
+	}
+
+	offset := time.Duration(health.ClockOffset * float64(time.Second)).Round(time.Second)
+	skewed := s.H.AgentMaxSkew > 0 && (offset > s.H.AgentMaxSkew || -offset > s.H.AgentMaxSkew)
+	if healthChanged(agent.skewed, skewed, &agent.skewedChanges) {
+		agent.skewed = skewed
+		problem := fmt.Sprintf("has a clock %s off the server clock, limit %s", offset, s.H.AgentMaxSkew)
+		if !skewed {
+			problem = fmt.Sprintf("has a clock in sync again, %s off the server clock, limit %s", offset, s.H.AgentMaxSkew)
+		}
+		log.Println("Node", name, problem)
+		s.agentHealthNotify(name, *agent, problem, skewed)
+	}
+}
+
+// healthChanged counts the heartbeats in a row, whose measured state differs from the current state,
+// and returns true after agentHealthHeartbeats of them
+func healthChanged(current, measured bool, changes *int) bool {
+	if current == measured {
+		*changes = 0
+		return false
+	}
+	*changes++
+	if *changes < agentHealthHeartbeats {
+		return false
+	}
+	*changes = 0
+	return true
 }
 
 // The dead node detection
-// will send mail to admin, if a node did not contact the server for a long period
-func (s *satanalytics) deadNodeSwitch() {
+// will send mail to admin, if a node did not contact the server for the silence period
+func (s *satanalytics) deadNodeSwitch(now time.Time) {
+	if s.H.AgentSilence <= 0 {
+		return
+	}
+
 	s.AgentTrackerMutex.Lock()
+	defer s.AgentTrackerMutex.Unlock()
 
-	for i := range s.AgentTracker {
-		// everything over 60 minutes is suspicious
-		if int(time.Since(s.AgentTracker[i].lastSeen)/time.Second) > 3600 {
-			// FIXME, send mail to $x  or raise alert
-			log.Println("Node with ID ", i, "seems to be dead ")
+	for name, agent := range s.AgentTracker {
+		if !agent.down && now.Sub(agent.lastSeen) > s.H.AgentSilence {
+			agent.down = true
+			log.Println("Node", name, "seems to be dead")
+			s.agentNotify(name, *agent)
 		}
 	}
-
-	s.AgentTrackerMutex.Unlock()
 }
 
 // The dead service thread
@@ -148,6 +261,7 @@ func (s *satanalytics) deadServiceSwitch() {
 
 // Run the analytics thread
 func (s *satanalytics) Run() {
+	defer close(s.stopped)
 	// load initial configuration
 	s.load()
 
@@ -155,96 +269,26 @@ func (s *satanalytics) Run() {
 	// result will be stored and then the "state" of the service
 	// will be calculated in kind of "quorom" - decision
 	idleTimer := time.NewTicker(time.Second * 10)
+	notifyTimer := time.NewTicker(time.Second)
 	for {
 		select {
+		case <-s.stop:
+			idleTimer.Stop()
+			notifyTimer.Stop()
+			s.drain()
+			return
 		case r := <-sattypes.ResultsChannel:
 			idleTimer.Reset(time.Second * 10)
-			s.ReadMessages++
-			var sendNotification = false
-			if s.H.Debug && r.Status != sattypes.ServiceUP {
-				log.Println("Received from", r.TestNode, r.Message)
-			}
-			// if this is a new service, it is necessary to allocate some memory for tracking
-			if _, ok := s.Tracker[r.ServiceID]; !ok {
-				if s.H.Debug {
-					log.Println("Create new structure for unknown service")
-					log.Println(s.Tracker[r.ServiceID])
-				}
-				s.TrackerMutex.Lock()
-				s.Tracker[r.ServiceID] = &serviceTracking{state: ""}
-				s.TrackerMutex.Unlock()
-			}
-
-			// update lastseen attribute to "now"
-			s.Tracker[r.ServiceID].lastSeen = time.Now()
-			err := satsql.UpdateServiceLastSeenNow(s.H, r.ServiceID)
-			if err != nil {
-				log.Println(err)
-			}
-
-			// shift a 0, if the service is up
-			// shift a 1 if the service is down
-			if r.Status == sattypes.ServiceDown {
-				s.Tracker[r.ServiceID].stateHistory =
-					(s.Tracker[r.ServiceID].stateHistory << 1) | 0x1
-			} else if r.Status == sattypes.ServiceUP {
-				s.Tracker[r.ServiceID].stateHistory =
-					s.Tracker[r.ServiceID].stateHistory << 1
-			}
-
-			var changeState bool
-			// check if we were down or up for more than four requests
-			if (r.Status == sattypes.ServiceDown && s.Tracker[r.ServiceID].stateHistory&0x0F == 0x0F) ||
-				(r.Status == sattypes.ServiceUP && s.Tracker[r.ServiceID].stateHistory&0x0F == 0x0) {
-				changeState = true
-			}
-
-			// possible changeState? From down to up?
-			// or RapidChange Event? For example, when hitting a stalled service
-			if changeState && r.Status != s.Tracker[r.ServiceID].state || r.RapidChange {
-				s.Tracker[r.ServiceID].state = r.Status
-				// and also in persistent in DB
-				err := satsql.UpdateServiceState(s.H, r.ServiceID, r.Status)
-				if err != nil {
-					log.Println(err)
-				}
-				sendNotification = true
-				err = satsql.InsertServiceChange(s.H, r)
-				if err != nil {
-					log.Println(err)
-				}
-			}
-			// sendNotification
-			if sendNotification {
-				serviceID := strconv.FormatInt(r.ServiceID, 10)
-				service, err := satsql.SelectService(s.H, "service_id", serviceID, 0)
-				if err == nil {
-					if s.HasSMTPConfig && service.ContactGroup != 0 {
-						contactGroups, err := satsql.SelectAlertGroup(s.H, "contact_id", fmt.Sprintf("%d", service.ContactGroup))
-						if err == nil {
-							emails := strings.Split(contactGroups.Emails, ",")
-							for i := range emails {
-								go func(recipient string) {
-									err := s.H.SMTPConfiguration.SendServiceMail(service, r, recipient)
-									if err != nil {
-										log.Println("SMTP-failed", err)
-										log.Println("Don't have working SMTP-configuration for sending alert")
-										log.Println("Service changed up/down", s.Tracker[r.ServiceID], r.Status)
-									}
-								}(emails[i])
-							}
-
-						}
-					} else {
-						log.Println("Don't have working SMTP-configuration for sending alert")
-						log.Println("Service changed up/down", s.Tracker[r.ServiceID], r.Status)
-						log.Println(service, r)
-					}
-				}
-				if s.H.Debug {
-					log.Println("Service changed up/down", s.Tracker[r.ServiceID], r.Status)
-				}
-			}
+			s.handleResult(r)
+		case a := <-sattypes.AgentChannel:
+			s.agentSeen(a)
+		case now := <-notifyTimer.C:
+			// find dead agents
+			s.deadNodeSwitch(now)
+			// send digests after their aggregation window, deferred notifications and the daily summary
+			s.flushDigests(now)
+			s.flushDeferred(now)
+			s.dailySummary(now)
 		case <-idleTimer.C:
 			runtime.GC()
 			// Do other work, like searching zombie services
@@ -254,6 +298,226 @@ func (s *satanalytics) Run() {
 	}
 }
 
+// drain handles the results and agents left in the channels and sends the pending digests
+// and the due deferred notifications, notifications deferred outside a schedule are logged and dropped
+func (s *satanalytics) drain() {
+	for {
+		select {
+		case r := <-sattypes.ResultsChannel:
+			s.handleResult(r)
+		case a := <-sattypes.AgentChannel:
+			s.agentSeen(a)
+		default:
+			// digests are sent before the end of their window, but may be deferred by the schedules of
+			// the recipients, so deferred notifications are sent last and only when they are due
+			now := time.Now()
+			s.flushDigests(now.AddDate(100, 0, 0))
+			s.flushDeferred(now)
+			for _, deferred := range s.deferred {
+				log.Printf("Dropping %d notifications for %s of %s, deferred till %s by the schedule",
+					len(deferred.notifications), deferred.recipient, deferred.group.GroupName, deferred.due.Format(time.RFC3339))
+			}
+			return
+		}
+	}
+}
+
+// Shutdown stops the analytics thread after draining the channels and waits for the mails,
+// that are still being sent, till the context is done
+func (s *satanalytics) Shutdown(ctx context.Context) error {
+	close(s.stop)
+	select {
+	case <-s.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		s.outbox.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		log.Printf("--- satanalytics thread %s stopped ---", s.Name)
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("mails still being sent: %w", ctx.Err())
+	}
+}
+
+// handleResult stores a result and calculates the state of the service
+// in kind of "quorom" - decision, transitions are notified
+func (s *satanalytics) handleResult(r sattypes.ServiceResult) {
+	s.TrackerMutex.Lock()
+	defer s.TrackerMutex.Unlock()
+
+	s.ReadMessages++
+	var sendNotification = false
+	if s.H.Debug && r.Status != sattypes.ServiceUP {
+		log.Println("Received from", r.TestNode, r.Message)
+	}
+	// if this is a new service, it is necessary to allocate some memory for tracking
+	if _, ok := s.Tracker[r.ServiceID]; !ok {
+		if s.H.Debug {
+			log.Println("Create new structure for unknown service")
+			log.Println(s.Tracker[r.ServiceID])
+		}
+		s.Tracker[r.ServiceID] = &serviceTracking{state: ""}
+	}
+
+	// update lastseen attribute to "now" and remember the result for the location
+	s.Tracker[r.ServiceID].lastSeen = time.Now()
+	if s.Tracker[r.ServiceID].lastResults == nil {
+		s.Tracker[r.ServiceID].lastResults = make(map[string]sattypes.ServiceResult)
+	}
+	s.Tracker[r.ServiceID].lastResults[r.TestNode] = r
+	err := satsql.UpdateServiceLastSeenNow(s.H, r.ServiceID)
+	if err != nil {
+		log.Println(err)
+	}
+
+	// shift a 0, if the service is up
+	// shift a 1 if the service is down
+	if r.Status == sattypes.ServiceDown {
+		s.Tracker[r.ServiceID].stateHistory =
+			(s.Tracker[r.ServiceID].stateHistory << 1) | 0x1
+	} else if r.Status == sattypes.ServiceUP {
+		s.Tracker[r.ServiceID].stateHistory =
+			s.Tracker[r.ServiceID].stateHistory << 1
+	}
+
+	var changeState bool
+	// check if we were down or up for more than four requests
+	if (r.Status == sattypes.ServiceDown && s.Tracker[r.ServiceID].stateHistory&0x0F == 0x0F) ||
+		(r.Status == sattypes.ServiceUP && s.Tracker[r.ServiceID].stateHistory&0x0F == 0x0) {
+		changeState = true
+	}
+
+	// possible changeState? From down to up?
+	// or RapidChange Event? For example, when hitting a stalled service
+	if changeState && r.Status != s.Tracker[r.ServiceID].state || r.RapidChange {
+		s.Tracker[r.ServiceID].state = r.Status
+		s.Tracker[r.ServiceID].transitions++
+		// and also in persistent in DB
+		err := satsql.UpdateServiceState(s.H, r.ServiceID, r.Status)
+		if err != nil {
+			log.Println(err)
+		}
+		sendNotification = true
+		err = satsql.InsertServiceChange(s.H, r)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	// sendNotification
+	if sendNotification {
+		s.notify(r)
+		if s.H.Debug {
+			log.Println("Service changed up/down", s.Tracker[r.ServiceID], r.Status)
+		}
+	}
+}
+
+// serviceNotification prepares the notification for a service transition and
+// keeps track of the message ids, so recovery mails thread with the mail of the incident
+func (s *satanalytics) serviceNotification(service sattypes.Service, r sattypes.ServiceResult) sattypes.ServiceNotification {
+	n := sattypes.ServiceNotification{
+		Service:   service,
+		Result:    r,
+		ServerURL: s.H.URL,
+		MessageID: s.H.SMTPConfiguration.NewMessageID(),
+	}
+
+	// collect the last results of all locations, sorted by location
+	tracker := s.Tracker[r.ServiceID]
+	for _, lastResult := range tracker.lastResults {
+		n.LastResults = append(n.LastResults, lastResult)
+	}
+	sort.Slice(n.LastResults, func(i, j int) bool { return n.LastResults[i].TestNode < n.LastResults[j].TestNode })
+
+	// the service mail, that was sent first for the incident, opens the thread, the recovery closes it,
+	// notifications in a digest don't open a thread, their Message-ID is never sent
+	n.ThreadID = tracker.threadID
+	if service.ServiceState == sattypes.ServiceUP {
+		tracker.threadID = ""
+	}
+
+	return n
+}
+
+// openThread makes the sent service mail of a down service the start of the thread of the incident,
+// unless another mail opened it already or the service recovered meanwhile
+func (s *satanalytics) openThread(n sattypes.ServiceNotification) {
+	if n.ThreadID != "" || n.Service.ServiceState == sattypes.ServiceUP {
+		return
+	}
+	s.TrackerMutex.Lock()
+	defer s.TrackerMutex.Unlock()
+	tracker, ok := s.Tracker[n.Service.ServiceID]
+	if ok && tracker.threadID == "" && tracker.state == sattypes.ServiceDown {
+		tracker.threadID = n.MessageID
+	}
+}
+
+// Metrics returns a snapshot of the read messages, the services, the agents and the sent mails
+func (s *satanalytics) Metrics() sattypes.AnalyticsMetrics {
+	var m sattypes.AnalyticsMetrics
+
+	s.TrackerMutex.Lock()
+	m.ReadMessages = s.ReadMessages
+	for id, tracker := range s.Tracker {
+		service := sattypes.ServiceMetrics{ServiceID: id, Transitions: tracker.transitions}
+		for _, r := range tracker.lastResults {
+			service.LastResults = append(service.LastResults, r)
+		}
+		sort.Slice(service.LastResults, func(i, j int) bool {
+			return service.LastResults[i].TestNode < service.LastResults[j].TestNode
+		})
+		m.Services = append(m.Services, service)
+	}
+	s.TrackerMutex.Unlock()
+	sort.Slice(m.Services, func(i, j int) bool { return m.Services[i].ServiceID < m.Services[j].ServiceID })
+
+	s.AgentTrackerMutex.Lock()
+	for name, agent := range s.AgentTracker {
+		m.Agents = append(m.Agents, sattypes.AgentMetrics{
+			Name:     name,
+			Location: agent.location,
+			LastSeen: agent.lastSeen,
+			Down:     agent.down,
+		})
+	}
+	s.AgentTrackerMutex.Unlock()
+	sort.Slice(m.Agents, func(i, j int) bool { return m.Agents[i].Name < m.Agents[j].Name })
+
+	s.mailsMutex.Lock()
+	m.Mails = make(map[string]sattypes.MailMetrics)
+	for kind, mails := range s.mails {
+		m.Mails[kind] = *mails
+	}
+	s.mailsMutex.Unlock()
+
+	return m
+}
+
+// mailed counts a sent or failed mail of a kind
+func (s *satanalytics) mailed(kind string, err error) {
+	s.mailsMutex.Lock()
+	defer s.mailsMutex.Unlock()
+
+	mails, ok := s.mails[kind]
+	if !ok {
+		mails = &sattypes.MailMetrics{}
+		s.mails[kind] = mails
+	}
+	if err != nil {
+		mails.Failed++
+	} else {
+		mails.Sent++
+	}
+}
+
 // Return tracking information for debugging
 func (s *satanalytics) GetServicesTrack() map[int64]*serviceTracking {
 	return s.Tracker
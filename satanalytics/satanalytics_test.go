@@ -0,0 +1,71 @@
+package satanalytics
+
+import (
+	"testing"
+	"time"
+	"unfoldedip/sattypes"
+)
+
+// Test, that only a sent service mail opens the thread of an incident
+func TestServiceNotificationThread(t *testing.T) {
+	s := CreateSatAnalytics("test", sattypes.BaseHandler{})
+	s.Tracker[1] = &serviceTracking{state: sattypes.ServiceDown}
+	down := sattypes.Service{ServiceID: 1, ServiceState: sattypes.ServiceDown}
+	up := sattypes.Service{ServiceID: 1, ServiceState: sattypes.ServiceUP}
+
+	// a notification collected into a digest leaves no thread behind
+	digested := s.serviceNotification(down, sattypes.ServiceResult{ServiceID: 1})
+	if digested.ThreadID != "" || s.Tracker[1].threadID != "" {
+		t.Fatalf("Digested notification opened thread %q", s.Tracker[1].threadID)
+	}
+
+	// the first sent mail opens it, the next mails of the incident reply to it
+	sent := s.serviceNotification(down, sattypes.ServiceResult{ServiceID: 1})
+	s.openThread(sent)
+	again := s.serviceNotification(down, sattypes.ServiceResult{ServiceID: 1})
+	s.openThread(again)
+	if s.Tracker[1].threadID != sent.MessageID || again.ThreadID != sent.MessageID {
+		t.Errorf("Thread is %q, second mail replies to %q, expected %q", s.Tracker[1].threadID, again.ThreadID, sent.MessageID)
+	}
+
+	// the recovery closes it
+	s.Tracker[1].state = sattypes.ServiceUP
+	recovery := s.serviceNotification(up, sattypes.ServiceResult{ServiceID: 1})
+	s.openThread(recovery)
+	if recovery.ThreadID != sent.MessageID || s.Tracker[1].threadID != "" {
+		t.Errorf("Recovery replies to %q, thread is %q", recovery.ThreadID, s.Tracker[1].threadID)
+	}
+
+	// a mail of the incident, that is sent after the recovery, opens no new thread
+	s.openThread(digested)
+	if s.Tracker[1].threadID != "" {
+		t.Errorf("Mail sent after the recovery opened thread %q", s.Tracker[1].threadID)
+	}
+}
+
+// Test, that the overloaded event of an agent near the limit doesn't flap
+func TestAgentHealthFlapping(t *testing.T) {
+	s := CreateSatAnalytics("test", sattypes.BaseHandler{AgentMaxLag: time.Second * 30, AgentMaxSkew: time.Second * 10})
+	agent := &agentTracking{}
+	lags := []struct {
+		lag        float64
+		overloaded bool
+	}{
+		{40, false}, {40, false}, {20, false}, // a spike is ignored
+		{40, false}, {40, false}, {40, true}, // raised after three heartbeats
+		{20, true}, {40, true}, {20, true}, {20, true}, {20, false}, // cleared after three heartbeats
+	}
+	for i, l := range lags {
+		s.agentHealth("muc1", agent, sattypes.AgentHealth{SchedulerLag: l.lag})
+		if agent.overloaded != l.overloaded {
+			t.Errorf("Heartbeat %d with lag %v: overloaded is %v", i, l.lag, agent.overloaded)
+		}
+	}
+
+	for i := 0; i < agentHealthHeartbeats; i++ {
+		s.agentHealth("muc1", agent, sattypes.AgentHealth{ClockOffset: -15})
+	}
+	if !agent.skewed {
+		t.Error("Agent is not skewed after three heartbeats 15s off")
+	}
+}
@@ -0,0 +1,398 @@
+package satca
+
+// satca is a small built-in certificate authority, that issues
+// and revokes the client certificates of the satellite agents
+// and the server certificate for the mutual TLS listener
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// file names inside the CA directory
+const (
+	CACert = "ca.crt"
+	CAKey  = "ca.key"
+	CACRL  = "ca.crl"
+)
+
+// reservedNames would overwrite the files of the CA
+var reservedNames = []string{"ca", "crl"}
+
+// validity of the CA, the issued certificates and the revocation list
+const (
+	caValidity   = time.Hour * 24 * 365 * 10
+	certValidity = time.Hour * 24 * 365 * 2
+	crlValidity  = time.Hour * 24 * 365
+)
+
+// Init creates a new CA with key, certificate and an empty revocation list in dir
+func Init(dir, name string) error {
+	if _, err := os.Stat(filepath.Join(dir, CAKey)); err == nil {
+		return fmt.Errorf("CA already exists in %s", dir)
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"unfolded"}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	err = writeKey(filepath.Join(dir, CAKey), key)
+	if err != nil {
+		return err
+	}
+	err = writePEM(filepath.Join(dir, CACert), "CERTIFICATE", der, 0644)
+	if err != nil {
+		return err
+	}
+	return writeCRL(dir, nil)
+}
+
+// Issue creates a key and a certificate signed by the CA in dir and saves them as <name>.key and <name>.crt,
+// agent certificates carry the agent name as common name and the location as organizational unit,
+// server certificates are valid for the given hosts
+func Issue(dir, name, location string, server bool, hosts []string) (string, string, error) {
+	if err := checkName(name); err != nil {
+		return "", "", err
+	}
+	caCert, caKey, err := load(dir)
+	if err != nil {
+		return "", "", err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return "", "", err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"unfolded"}},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if location != "" {
+		template.Subject.OrganizationalUnit = []string{location}
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		for _, host := range hosts {
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	err = writeKey(keyFile, key)
+	if err != nil {
+		return "", "", err
+	}
+	err = writePEM(certFile, "CERTIFICATE", der, 0644)
+	if err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// Revoke adds the certificate <name>.crt in dir to the revocation list of the CA
+func Revoke(dir, name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name+".crt"))
+	if err != nil {
+		return err
+	}
+	cert, err := parseCertificate(data)
+	if err != nil {
+		return err
+	}
+
+	crl, err := readCRL(filepath.Join(dir, CACRL))
+	if err != nil {
+		return err
+	}
+	revoked := crl.RevokedCertificates
+	for _, entry := range revoked {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return fmt.Errorf("certificate %s is already revoked", name)
+		}
+	}
+	revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()})
+	return writeCRL(dir, revoked)
+}
+
+// ServerTLSConfig returns a TLS configuration, that requires client certificates signed by
+// the CA certificate in caFile and refuses certificates on the revocation list in crlFile
+func ServerTLSConfig(certFile, keyFile, caFile, crlFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := certPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if crlFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		caCert, err := parseCertificate(data)
+		if err != nil {
+			return nil, err
+		}
+		revocations := &Revocations{file: crlFile, ca: caCert}
+		if err = revocations.reload(); err != nil {
+			return nil, err
+		}
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			for _, chain := range chains {
+				if len(chain) > 0 && revocations.Revoked(chain[0]) {
+					return fmt.Errorf("client certificate %s is revoked", chain[0].Subject.CommonName)
+				}
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+// ClientTLSConfig returns a TLS configuration with the client certificate of an agent, caFile is optional and
+// is used for verifying the server certificate instead of the system roots
+func ClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		config.RootCAs, err = certPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// Revocations holds the serial numbers of a revocation list, the list is reloaded when the file changes
+// and is taken only with a valid signature of the CA
+type Revocations struct {
+	file     string
+	ca       *x509.Certificate
+	modified time.Time
+	serials  map[string]bool
+	mutex    sync.Mutex
+}
+
+// Revoked returns true, if the certificate is on the revocation list
+func (r *Revocations) Revoked(cert *x509.Certificate) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if info, err := os.Stat(r.file); err == nil && !info.ModTime().Equal(r.modified) {
+		// keep the old list, if the new one can not be read or is not signed by the CA
+		_ = r.reloadLocked()
+	}
+	return r.serials[cert.SerialNumber.String()]
+}
+
+// reload reads the revocation list
+func (r *Revocations) reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.reloadLocked()
+}
+
+// reloadLocked reads the revocation list, the mutex must be held
+func (r *Revocations) reloadLocked() error {
+	info, err := os.Stat(r.file)
+	if err != nil {
+		return err
+	}
+	crl, err := readCRL(r.file)
+	if err != nil {
+		return err
+	}
+	if err = crl.CheckSignatureFrom(r.ca); err != nil {
+		return fmt.Errorf("revocation list %s: %w", r.file, err)
+	}
+	r.serials = make(map[string]bool)
+	for _, entry := range crl.RevokedCertificates {
+		r.serials[entry.SerialNumber.String()] = true
+	}
+	r.modified = info.ModTime()
+	return nil
+}
+
+// checkName refuses names, that are no plain file names or that are used by the files of the CA
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid certificate name %q", name)
+	}
+	for _, reserved := range reservedNames {
+		if strings.EqualFold(name, reserved) {
+			return fmt.Errorf("certificate name %q is reserved for the CA", name)
+		}
+	}
+	return nil
+}
+
+// load reads certificate and key of the CA
+func load(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(filepath.Join(dir, CACert))
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := parseCertificate(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err = os.ReadFile(filepath.Join(dir, CAKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, errors.New("no PEM data in CA key")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// writeCRL signs and writes the revocation list of the CA in dir
+func writeCRL(dir string, revoked []pkix.RevokedCertificate) error {
+	caCert, caKey, err := load(dir)
+	if err != nil {
+		return err
+	}
+	number, err := newSerial()
+	if err != nil {
+		return err
+	}
+	template := x509.RevocationList{
+		Number:              number,
+		ThisUpdate:          time.Now(),
+		NextUpdate:          time.Now().Add(crlValidity),
+		RevokedCertificates: revoked,
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &template, caCert, caKey)
+	if err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(dir, CACRL), "X509 CRL", der, 0644)
+}
+
+// readCRL parses a PEM encoded revocation list
+func readCRL(file string) (*x509.RevocationList, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", file)
+	}
+	return x509.ParseRevocationList(block.Bytes)
+}
+
+// certPool reads a PEM file with one or more CA certificates
+func certPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// parseCertificate parses a PEM encoded certificate
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// writeKey saves a private key readable for the owner only
+func writeKey(file string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(file, "EC PRIVATE KEY", der, 0600)
+}
+
+// writePEM saves der encoded data as PEM block
+func writePEM(file, blockType string, der []byte, mode os.FileMode) error {
+	return os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), mode)
+}
+
+// newSerial returns a random 128 bit serial number
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
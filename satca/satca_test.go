@@ -0,0 +1,121 @@
+package satca
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// handshake connects a client with the given certificate to a server with the CA configuration
+func handshake(t *testing.T, serverConfig *tls.Config, dir, name string) error {
+	clientConfig, err := ClientTLSConfig(filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key"), filepath.Join(dir, CACert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig.ServerName = "localhost"
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer conn.Close()
+		server := tls.Server(conn, serverConfig)
+		err = server.Handshake()
+		if err == nil {
+			// read the first byte, so the client is finished with TLS 1.3 too
+			_, err = server.Read(make([]byte, 1))
+		}
+		result <- err
+	}()
+
+	client, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	if err == nil {
+		defer client.Close()
+		_, _ = client.Write([]byte{1})
+	}
+	return <-result
+}
+
+func TestCA(t *testing.T) {
+	dir := t.TempDir()
+	if err := Init(dir, "test CA"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Init(dir, "test CA"); err == nil {
+		t.Error("CA initialised twice")
+	}
+	if _, _, err := Issue(dir, "server", "", true, []string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	// the files of the CA are never overwritten
+	for _, name := range []string{"ca", "CA", "crl", "", "..", "../muc1"} {
+		if _, _, err := Issue(dir, name, "", false, nil); err == nil {
+			t.Errorf("Certificate issued with name %q", name)
+		}
+	}
+	for _, agent := range []string{"muc1", "ber1"} {
+		if _, _, err := Issue(dir, agent, "Munich", false, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serverConfig, err := ServerTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"),
+		filepath.Join(dir, CACert), filepath.Join(dir, CACRL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = handshake(t, serverConfig, dir, "muc1"); err != nil {
+		t.Errorf("Handshake of muc1 failed: %s", err)
+	}
+
+	if err = Revoke(dir, "muc1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = Revoke(dir, "muc1"); err == nil {
+		t.Error("Certificate revoked twice")
+	}
+
+	if err = handshake(t, serverConfig, dir, "muc1"); err == nil {
+		t.Error("Handshake of revoked muc1 succeeded")
+	}
+	if err = handshake(t, serverConfig, dir, "ber1"); err != nil {
+		t.Errorf("Handshake of ber1 failed: %s", err)
+	}
+
+	// a revocation list of another CA is refused and the old list is kept
+	other := t.TempDir()
+	if err = Init(other, "other CA"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(other, CACRL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, CACRL), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err = os.Chtimes(filepath.Join(dir, CACRL), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err = handshake(t, serverConfig, dir, "muc1"); err == nil {
+		t.Error("Handshake of revoked muc1 succeeded with the revocation list of another CA")
+	}
+	if _, err = ServerTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"),
+		filepath.Join(dir, CACert), filepath.Join(dir, CACRL)); err == nil {
+		t.Error("Revocation list of another CA accepted")
+	}
+}
@@ -0,0 +1,111 @@
+package satsql
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"unfoldedip/sattypes"
+)
+
+// schemaTables are the tables added after the first release, created by UpgradeSchema if missing
+var schemaTables = []string{
+	`CREATE TABLE IF NOT EXISTS "alertgroup_schedules" (schedule_id INTEGER not null primary key autoincrement, contact_id INTEGER,
+		email TEXT, timezone TEXT default 'UTC', days TEXT default '1,2,3,4,5', start_time TEXT default '08:00', end_time TEXT default '18:00')`,
+	`CREATE TABLE IF NOT EXISTS "rotations" (rotation_id INTEGER not null primary key autoincrement, owner_id INTEGER, name TEXT,
+		members TEXT, handoff TEXT, length_days INTEGER default 7, timezone TEXT default 'UTC')`,
+	`CREATE TABLE IF NOT EXISTS "rotation_overrides" (override_id INTEGER not null primary key autoincrement, rotation_id INTEGER,
+		email TEXT, start_time TEXT, end_time TEXT)`,
+	`CREATE TABLE IF NOT EXISTS "enrollment_tokens" (token_id INTEGER not null primary key autoincrement, token TEXT not null,
+		created TEXT default CURRENT_TIMESTAMP, used_by TEXT default '')`,
+	`CREATE TABLE IF NOT EXISTS "api_tokens" (token_id INTEGER not null primary key autoincrement, user_id INTEGER not null,
+		name TEXT not null, token_hash TEXT not null, scope TEXT default 'read', expires TEXT default '',
+		created TEXT default CURRENT_TIMESTAMP, last_used TEXT default '')`,
+}
+
+// schemaColumns are the columns added to the tables of the first release, added by UpgradeSchema if missing
+var schemaColumns = []struct {
+	table, column, definition string
+}{
+	{"alertgroup", "digest_seconds", "integer default 0"},
+	{"alertgroup", "daily_summary", "integer default 0"},
+	{"services", "severity", "text default 'normal'"},
+	{"alertgroup", "rotation_id", "integer default 0"},
+	{"satagents", "version", "varchar default ''"},
+	{"satagents", "disabled", "integer default 0"},
+	// agents known before the approval keep working
+	{"satagents", "status", "varchar default 'approved'"},
+	{"satagents", "secret_sent", "integer default 1"},
+	{"satagents", "pubkey", "TEXT default ''"},
+	{"services", "timeout", "integer default 0"},
+	{"satagents", "protocol", "integer default 0"},
+	{"satagents", "os", "varchar default ''"},
+	{"satagents", "checks", "varchar default ''"},
+	{"satagents", "health", "TEXT default ''"},
+	{"satagents", "embedded", "integer default 0"},
+}
+
+// UpgradeSchema brings the database of an older release to the schema of extra/unfolded.sql,
+// it only adds missing tables and columns and can run on every start. agentName is the name of the
+// embedded agent, older releases registered it with the global key
+func UpgradeSchema(H sattypes.BaseHandler, agentName string) error {
+	for _, table := range schemaTables {
+		if _, err := H.DB.Exec(table); err != nil {
+			return err
+		}
+	}
+
+	columns := map[string]map[string]bool{}
+	for _, c := range schemaColumns {
+		if columns[c.table] == nil {
+			names, err := tableColumns(H, c.table)
+			if err != nil {
+				return err
+			}
+			columns[c.table] = names
+		}
+		if columns[c.table][c.column] {
+			continue
+		}
+		log.Println("Upgrading the database, adding", c.table+"."+c.column)
+		if _, err := H.DB.Exec(fmt.Sprintf("ALTER TABLE %q ADD COLUMN %s %s", c.table, c.column, c.definition)); err != nil {
+			return err
+		}
+		columns[c.table][c.column] = true
+
+		// the embedded agent of an older release stays the embedded agent
+		if c.table == "satagents" && c.column == "embedded" {
+			_, err := H.DB.Exec("update satagents set embedded = 1 where satagent_name = ? and access_key = ?", agentName, H.SatKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tableColumns returns the column names of the table from PRAGMA table_info
+func tableColumns(H sattypes.BaseHandler, table string) (map[string]bool, error) {
+	rows, err := H.DB.Query(fmt.Sprintf("PRAGMA table_info(%q)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := map[string]bool{}
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, kind string
+		var defaultValue sql.NullString
+		if err = rows.Scan(&cid, &name, &kind, &notNull, &defaultValue, &primaryKey); err != nil {
+			return nil, err
+		}
+		names[name] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("table %s is missing in the database", table)
+	}
+	return names, nil
+}
@@ -0,0 +1,78 @@
+package satsql
+
+import (
+	"database/sql"
+	_ "modernc.org/sqlite"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"unfoldedip/sattypes"
+)
+
+// testSchema returns a database with the schema of the file
+func testSchema(t *testing.T, file, name string) sattypes.BaseHandler {
+	t.Helper()
+	schema, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	if _, err = db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	return sattypes.BaseHandler{DB: db}
+}
+
+// schemaOf returns the columns of every table
+func schemaOf(t *testing.T, H sattypes.BaseHandler) map[string]map[string]bool {
+	t.Helper()
+	rows, err := H.DB.Query("select name from sqlite_master where type = 'table' and name != 'sqlite_sequence'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		_ = rows.Scan(&name)
+		names = append(names, name)
+	}
+	rows.Close()
+	all := map[string]map[string]bool{}
+	for _, name := range names {
+		if all[name], err = tableColumns(H, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return all
+}
+
+// Test the upgrade of a database of the first release to the current schema
+func TestUpgradeSchema(t *testing.T) {
+	current := testSchema(t, "../extra/unfolded.sql", "current.sqlite")
+	old := testSchema(t, "testdata/unfolded-first.sql", "old.sqlite")
+	if _, err := old.DB.Exec("insert into satagents (satagent_name, access_key) values ('muc1', 'key')"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the upgrade can run on every start
+	for i := 0; i < 2; i++ {
+		if err := UpgradeSchema(old, "local"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := schemaOf(t, old), schemaOf(t, current); !reflect.DeepEqual(got, want) {
+		t.Errorf("Upgraded schema is\n%v\nshall be\n%v", got, want)
+	}
+
+	// agents of the first release keep working
+	agent, err := SelectAgent(old, "satagent_name", "muc1")
+	if err != nil || agent.Status != sattypes.AgentApproved || !agent.SecretSent {
+		t.Errorf("Upgraded agent is %+v, %v", agent, err)
+	}
+}
@@ -2,8 +2,10 @@ package satsql
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 	"unfoldedip/sattypes"
 )
@@ -12,14 +14,16 @@ import (
 func InsertService(H sattypes.BaseHandler, s *sattypes.Service) error {
 	// prepare insert query for sqlite*/
 	stmt, err := H.DB.Prepare("INSERT into services (service_type, service_name, " +
-		"service_tocheck, interval, contact_group, owner_id, service_expected, testlocations) values(?,?,?,?,?,?,?,?)")
+		"service_tocheck, interval, contact_group, owner_id, service_expected, testlocations, severity, timeout) " +
+		"values(?,?,?,?,?,?,?,?,?,?)")
 
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	res, err := stmt.Exec(s.Type, s.Name, s.ToCheck, s.Interval, s.ContactGroup, s.OwnerID, s.Expected, s.Locations)
+	res, err := stmt.Exec(s.Type, s.Name, s.ToCheck, s.Interval, s.ContactGroup, s.OwnerID, s.Expected, s.Locations, s.Severity,
+		s.Timeout)
 	if err != nil {
 		return err
 	}
@@ -29,6 +33,8 @@ func InsertService(H sattypes.BaseHandler, s *sattypes.Service) error {
 		return err
 	}
 
+	// agents pick up the new service
+	sattypes.AgentConfig.Changed()
 	return nil
 }
 
@@ -36,18 +42,22 @@ func InsertService(H sattypes.BaseHandler, s *sattypes.Service) error {
 func UpdateService(H sattypes.BaseHandler, s *sattypes.Service) error {
 	// prepare insert query for sqlite*/
 	stmt, err := H.DB.Prepare("update services set service_type=?, service_name=?, " +
-		"service_tocheck=?, interval=?, contact_group=?, service_expected=?, testlocations=? where service_id=?")
+		"service_tocheck=?, interval=?, contact_group=?, service_expected=?, testlocations=?, severity=?, timeout=? " +
+		"where service_id=?")
 
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(s.Type, s.Name, s.ToCheck, s.Interval, s.ContactGroup, s.Expected, s.Locations, s.ServiceID)
+	_, err = stmt.Exec(s.Type, s.Name, s.ToCheck, s.Interval, s.ContactGroup, s.Expected, s.Locations, s.Severity, s.Timeout,
+		s.ServiceID)
 	if err != nil {
 		return err
 	}
 
+	// agents pick up the changed service
+	sattypes.AgentConfig.Changed()
 	return nil
 }
 
@@ -56,7 +66,7 @@ func InsertAlertGroup(H sattypes.BaseHandler, c *sattypes.AlertGroup) error {
 
 	// prepare insert query for sqlite*/
 	stmt, err := H.DB.Prepare("INSERT into alertgroup (groupname, " +
-		"emails, owner_id) values(?,?,?)")
+		"emails, owner_id, digest_seconds, daily_summary, rotation_id) values(?,?,?,?,?,?)")
 
 	if err != nil {
 		return err
@@ -64,7 +74,7 @@ func InsertAlertGroup(H sattypes.BaseHandler, c *sattypes.AlertGroup) error {
 	defer stmt.Close()
 
 	// Run the query
-	res, err := stmt.Exec(c.GroupName, c.Emails, c.OwnerID)
+	res, err := stmt.Exec(c.GroupName, c.Emails, c.OwnerID, c.DigestSeconds, c.DailySummary, c.RotationID)
 	if err != nil {
 		return err
 	}
@@ -81,7 +91,7 @@ func InsertAlertGroup(H sattypes.BaseHandler, c *sattypes.AlertGroup) error {
 func UpdateAlertGroup(H sattypes.BaseHandler, c *sattypes.AlertGroup) error {
 
 	// prepare insert query for sqlite*/
-	stmt, err := H.DB.Prepare("update alertgroup set groupname=?,emails=? where contact_id=?")
+	stmt, err := H.DB.Prepare("update alertgroup set groupname=?,emails=?,digest_seconds=?,daily_summary=?,rotation_id=? where contact_id=?")
 
 	if err != nil {
 		return err
@@ -89,7 +99,7 @@ func UpdateAlertGroup(H sattypes.BaseHandler, c *sattypes.AlertGroup) error {
 	defer stmt.Close()
 
 	// Run the query
-	_, err = stmt.Exec(c.GroupName, c.Emails, c.ContactID)
+	_, err = stmt.Exec(c.GroupName, c.Emails, c.DigestSeconds, c.DailySummary, c.RotationID, c.ContactID)
 	if err != nil {
 		return err
 	}
@@ -102,10 +112,12 @@ func SelectUser(H sattypes.BaseHandler, arg string, argValue string) (sattypes.U
 	var User sattypes.UnfoldedUser
 
 	// run query
-	rows := H.DB.QueryRow(fmt.Sprintf("select id, email, password, \"true\", passwordnext, reset from users where %s = ?", arg), argValue)
+	rows := H.DB.QueryRow(fmt.Sprintf("select id, email, password, \"true\", passwordnext, reset, ifnull(admin,0) "+
+		"from users where %s = ?", arg), argValue)
 
 	// return empty user struct and error code on error
-	switch err := rows.Scan(&User.UserID, &User.Email, &User.PasswordHash, &User.Exists, &User.PasswordHashNext, &User.Reset); err {
+	switch err := rows.Scan(&User.UserID, &User.Email, &User.PasswordHash, &User.Exists, &User.PasswordHashNext, &User.Reset,
+		&User.Admin); err {
 	case sql.ErrNoRows:
 		return sattypes.UnfoldedUser{}, sql.ErrNoRows
 	case nil:
@@ -122,12 +134,14 @@ func SelectAlertGroup(H sattypes.BaseHandler, arg string, argValue string) (satt
 
 	// run query
 	rows := H.DB.QueryRow(
-		fmt.Sprintf("select contact_id, groupname, emails, owner_id, \"true\" from alertgroup where %s = ?", arg),
+		fmt.Sprintf("select contact_id, groupname, emails, owner_id, \"true\", ifnull(digest_seconds,0), "+
+			"ifnull(daily_summary,0), ifnull(rotation_id,0) from alertgroup where %s = ?", arg),
 		argValue)
 
 	// return empty user struct and error code on error
 	switch err := rows.Scan(&alertgroup.ContactID,
-		&alertgroup.GroupName, &alertgroup.Emails, &alertgroup.OwnerID, &alertgroup.Exists); err {
+		&alertgroup.GroupName, &alertgroup.Emails, &alertgroup.OwnerID, &alertgroup.Exists,
+		&alertgroup.DigestSeconds, &alertgroup.DailySummary, &alertgroup.RotationID); err {
 	case sql.ErrNoRows:
 		return sattypes.AlertGroup{}, sql.ErrNoRows
 	case nil:
@@ -149,7 +163,13 @@ func DeleteService(H sattypes.BaseHandler, argValue int64) error {
 
 	// execute prepared statement
 	_, err = stmt.Exec(argValue)
-	return err
+	if err != nil {
+		return err
+	}
+
+	// agents stop checking the service
+	sattypes.AgentConfig.Changed()
+	return nil
 }
 
 // DeleteService deletes a service record selected by its id
@@ -175,6 +195,12 @@ func DeleteAlertGroup(H sattypes.BaseHandler, argValue int64) error {
 	defer stmt.Close()
 	// execute prepared statement
 	_, err = stmt.Exec(argValue)
+	if err != nil {
+		return err
+	}
+
+	// the schedules of the members are gone with the group
+	_, err = H.DB.Exec("delete from alertgroup_schedules where contact_id = ?", argValue)
 	return err
 }
 
@@ -238,6 +264,63 @@ func ReadServicesLog(H sattypes.BaseHandler, ownerID int64) ([]sattypes.ServiceL
 
 }
 
+// ReadFilteredServicesLog returns a page of the logs of an owner, that match the filter,
+// and the number of all matching logs
+func ReadFilteredServicesLog(H sattypes.BaseHandler, filter sattypes.LogFilter) ([]sattypes.ServiceLog, int, error) {
+	var serviceLogs []sattypes.ServiceLog
+	var total int
+
+	// build the conditions, the date is saved as UTC timestamp
+	where := " where services.owner_id=?"
+	args := []any{filter.OwnerID}
+	if filter.ServiceID != 0 {
+		where += " and service_log.service_id=?"
+		args = append(args, filter.ServiceID)
+	}
+	if filter.State != "" {
+		where += " and status_to=?"
+		args = append(args, filter.State)
+	}
+	if !filter.Since.IsZero() {
+		where += " and status_date>=?"
+		args = append(args, filter.Since.UTC().Format("2006-01-02 15:04:05"))
+	}
+	if !filter.Until.IsZero() {
+		where += " and status_date<?"
+		args = append(args, filter.Until.UTC().Format("2006-01-02 15:04:05"))
+	}
+	from := " from service_log inner join services on service_log.service_id=services.service_id"
+
+	// count all matching logs for the pagination
+	err := H.DB.QueryRow("select count(*)"+from+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := H.DB.Query("select service_log.service_id, service_name, service_tocheck, status_date, "+
+		"status_from, status_to, status_why"+from+where+" order by status_date desc, service_log.rowid desc limit ? offset ?",
+		append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	// scan up all rows
+	for rows.Next() {
+		var s sattypes.ServiceLog
+		err := rows.Scan(&s.ServiceID, &s.Name, &s.ToCheck, &s.Date, &s.Status_From, &s.Status_To, &s.Why)
+		if err != nil {
+			return nil, 0, err
+		}
+		serviceLogs = append(serviceLogs, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return serviceLogs, total, nil
+}
+
 // ReadServiceLogs searches and return service logs for a service
 func ReadServiceLogs(H sattypes.BaseHandler, argValue string) ([]sattypes.ServiceLog, error) {
 	var serviceLogs []sattypes.ServiceLog
@@ -289,18 +372,20 @@ func SelectService(H sattypes.BaseHandler, arg string, argValue string, ownerid
 		// run query
 		row = H.DB.QueryRow(
 			fmt.Sprintf("select service_id, service_name, service_tocheck, service_type,"+
-				"\"true\", owner_id, service_state, service_expected, interval, ifnull(contact_group,0), testlocations  from services where %s = ? and owner_id=?", arg),
+				"\"true\", owner_id, service_state, service_expected, interval, ifnull(contact_group,0), testlocations, "+
+				"ifnull(severity,'normal'), ifnull(timeout,0) from services where %s = ? and owner_id=?", arg),
 			argValue, ownerid)
 	} else {
 		row = H.DB.QueryRow(
 			fmt.Sprintf("select service_id, service_name, service_tocheck, service_type,"+
-				"\"true\", owner_id, service_state, service_expected, interval,  ifnull(contact_group,0), testlocations from services where %s = ? and owner_id!=?", arg),
+				"\"true\", owner_id, service_state, service_expected, interval,  ifnull(contact_group,0), testlocations, "+
+				"ifnull(severity,'normal'), ifnull(timeout,0) from services where %s = ? and owner_id!=?", arg),
 			argValue, ownerid)
 	}
 
 	// return empty user struct and error code on error
 	switch err := row.Scan(&s.ServiceID, &s.Name, &s.ToCheck, &s.Type, &s.Exists, &s.OwnerID, &s.ServiceState,
-		&s.Expected, &s.Interval, &s.ContactGroup, &s.Locations); err {
+		&s.Expected, &s.Interval, &s.ContactGroup, &s.Locations, &s.Severity, &s.Timeout); err {
 	case sql.ErrNoRows:
 		return sattypes.Service{}, sql.ErrNoRows
 	case nil:
@@ -374,6 +459,24 @@ func InsertServiceChange(H sattypes.BaseHandler, r sattypes.ServiceResult) error
 	return nil
 }
 
+// InsertServiceAck logs the acknowledgement of a service incident by a user
+func InsertServiceAck(H sattypes.BaseHandler, serviceID int64, state, email string) error {
+	// prepare insert query for sqlite*/
+	stmt, err := H.DB.Prepare("INSERT into service_log (service_id, status_date, " +
+		"status_from, status_to, status_why) values(?,CURRENT_TIMESTAMP,?,'ACK',?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(serviceID, state, fmt.Sprintf("Acknowledged by %s", email))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // InsertUser inserts a User into the database
 func InsertUser(H sattypes.BaseHandler, U *sattypes.UnfoldedUser) error {
 
@@ -436,7 +539,8 @@ func ReadServices(H sattypes.BaseHandler, ownerID int64, location string, onlyLo
 	// if ownerID == 0, we will read all services
 	if ownerID == 0 {
 		var sqlStatement = "select service_id, service_type, service_name, service_tocheck, contact_group, interval, " +
-			"ifnull(contact_group,''), service_state, ifnull(service_expected,''), last_event  from services "
+			"ifnull(contact_group,''), service_state, ifnull(service_expected,''), last_event, " +
+			"ifnull(severity,'normal'), ifnull(timeout,0), owner_id, ifnull(testlocations,'') from services "
 		// expand sql on arguments
 		if location != "" && onlyLocation {
 			sqlStatement += " where (' ' || testlocations || ' ') like ?"
@@ -450,7 +554,8 @@ func ReadServices(H sattypes.BaseHandler, ownerID int64, location string, onlyLo
 	} else {
 		stmt, err = H.DB.Prepare(fmt.Sprintf("select service_id, service_type, service_name, service_tocheck, " +
 			"contact_group, interval,  ifnull(alertgroup.groupname,''), service_state, ifnull(service_expected,'')," +
-			"last_event from services left join alertgroup on services.contact_group=alertgroup.contact_id " +
+			"last_event, ifnull(severity,'normal'), ifnull(timeout,0), services.owner_id, ifnull(testlocations,'') " +
+			"from services left join alertgroup on services.contact_group=alertgroup.contact_id " +
 			"where services.owner_id = ? order by service_state, last_event desc, service_id desc"))
 	}
 
@@ -480,7 +585,8 @@ func ReadServices(H sattypes.BaseHandler, ownerID int64, location string, onlyLo
 	for rows.Next() {
 		err := rows.Scan(
 			&s.ServiceID, &s.Type, &s.Name, &s.ToCheck, &s.ContactGroup,
-			&s.Interval, &s.AlertGroupName, &s.ServiceState, &s.Expected, &s.LastEvent)
+			&s.Interval, &s.AlertGroupName, &s.ServiceState, &s.Expected, &s.LastEvent, &s.Severity, &s.Timeout,
+			&s.OwnerID, &s.Locations)
 		// return empty user struct and error code on error
 		if err != nil {
 			return nil, err
@@ -501,8 +607,8 @@ func ReadServices(H sattypes.BaseHandler, ownerID int64, location string, onlyLo
 func ReadAlertGroups(H sattypes.BaseHandler, ownerID int64) ([]sattypes.AlertGroup, error) {
 	var contacts []sattypes.AlertGroup
 
-	stmt, err := H.DB.Prepare(fmt.Sprintf("select contact_id, groupname, emails, owner_id from " +
-		"alertgroup where owner_id = ? order by  groupname asc"))
+	stmt, err := H.DB.Prepare(fmt.Sprintf("select contact_id, groupname, emails, owner_id, ifnull(digest_seconds,0), " +
+		"ifnull(daily_summary,0), ifnull(rotation_id,0) from alertgroup where owner_id = ? order by  groupname asc"))
 	defer stmt.Close()
 	// return empty user struct and error code on error
 	if err != nil {
@@ -521,7 +627,7 @@ func ReadAlertGroups(H sattypes.BaseHandler, ownerID int64) ([]sattypes.AlertGro
 	// scan up all rows
 	for rows.Next() {
 		var c sattypes.AlertGroup
-		err := rows.Scan(&c.ContactID, &c.GroupName, &c.Emails, &c.OwnerID)
+		err := rows.Scan(&c.ContactID, &c.GroupName, &c.Emails, &c.OwnerID, &c.DigestSeconds, &c.DailySummary, &c.RotationID)
 		// return empty user struct and error code on error
 		if err != nil {
 			return nil, err
@@ -538,79 +644,178 @@ func ReadAlertGroups(H sattypes.BaseHandler, ownerID int64) ([]sattypes.AlertGro
 	return contacts, nil
 }
 
-// SearchAgentAccessKey searches for valid satagent key
-func SearchAgentAccessKey(H sattypes.BaseHandler, accessNode, accessKey string) error {
-	var satAgentID int64
+// ReadSummaryAlertGroups reads all alert groups, that want to receive a daily summary
+func ReadSummaryAlertGroups(H sattypes.BaseHandler) ([]sattypes.AlertGroup, error) {
+	var contacts []sattypes.AlertGroup
+
+	stmt, err := H.DB.Prepare("select contact_id, groupname, emails, owner_id, ifnull(digest_seconds,0), " +
+		"ifnull(daily_summary,0), ifnull(rotation_id,0) from alertgroup where daily_summary = 1")
+	// return empty struct and error code on error
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
 	// run query
-	rows := H.DB.QueryRow("select satagent_id from satagents where access_key = ? and satagent_name=?",
-		accessKey, accessNode)
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
 
-	// return empty user struct and error code on error
-	switch err := rows.Scan(&satAgentID); err {
-	case sql.ErrNoRows:
-		return sql.ErrNoRows
-	case nil:
-		// return filled user struct
-		return nil
-	default:
-		return err
+	// prepare rows close on exit
+	defer rows.Close()
+	// scan up all rows
+	for rows.Next() {
+		var c sattypes.AlertGroup
+		err := rows.Scan(&c.ContactID, &c.GroupName, &c.Emails, &c.OwnerID, &c.DigestSeconds, &c.DailySummary, &c.RotationID)
+		if err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, c)
+	}
+
+	// return empty struct and error code on error
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
+
+	return contacts, nil
 }
 
-// SelectAgent searches and returns agent record by argument
-func SelectAgent(H sattypes.BaseHandler, arg string, argValue string) (sattypes.SatAgentSql, error) {
-	var Agent sattypes.SatAgentSql
+// ReadAlertGroupServices reads all services, that are alerting to an alert group
+func ReadAlertGroupServices(H sattypes.BaseHandler, contactID int64) ([]sattypes.Service, error) {
+	var services []sattypes.Service
+
+	stmt, err := H.DB.Prepare("select service_id, service_type, service_name, service_tocheck, interval, " +
+		"service_state, last_event from services where contact_group = ? order by service_state, service_name")
+	// return empty and error code on error
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
 
-	var query = fmt.Sprintf(
-		"select satagent_id, satagent_name, satagent_location, access_key, lastseen from satagents where %s = ?",
-		arg)
 	// run query
-	rows := H.DB.QueryRow(query, argValue)
+	rows, err := stmt.Query(contactID)
+	if err != nil {
+		return nil, err
+	}
 
-	// return empty user struct and error code on error
-	switch err := rows.Scan(&Agent.SatAgentID, &Agent.SatAgentName, &Agent.SatAgentLocation, &Agent.AccessKey,
-		&Agent.LastSeen); err {
-	case sql.ErrNoRows:
-		return sattypes.SatAgentSql{}, sql.ErrNoRows
-	case nil:
-		// return filled user struct
-		return Agent, nil
-	default:
-		return sattypes.SatAgentSql{}, err
+	// prepare rows close on exit
+	defer rows.Close()
+	// scan up all rows
+	for rows.Next() {
+		var s sattypes.Service
+		err := rows.Scan(&s.ServiceID, &s.Type, &s.Name, &s.ToCheck, &s.Interval, &s.ServiceState, &s.LastEvent)
+		if err != nil {
+			return nil, err
+		}
+		s.ContactGroup = int(contactID)
+		services = append(services, s)
+	}
+
+	// return empty and error code on error
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
+
+	return services, nil
 }
 
-// InsertAgent insert an agent record
-func InsertAgent(H sattypes.BaseHandler, agentName, accessKey, agentLocation string) error {
-	// prepare insert query for sqlite*/
-	stmt, err := H.DB.Prepare("INSERT into satagents" +
-		" (satagent_name, satagent_location, access_key, lastseen) values(?,?,?, datetime('NOW'))")
+// ReadAlertGroupLogsSince reads the service logs of all services of an alert group since a timepoint
+func ReadAlertGroupLogsSince(H sattypes.BaseHandler, contactID int64, since time.Time) ([]sattypes.ServiceLog, error) {
+	var serviceLogs []sattypes.ServiceLog
+
+	// status_date is written by sqlite as CURRENT_TIMESTAMP in UTC
+	stmt, err := H.DB.Prepare("select service_log.service_id, service_name, service_tocheck, status_date, " +
+		"status_from, status_to, status_why from service_log inner join services " +
+		"on service_log.service_id=services.service_id where services.contact_group=? and status_date >= ? " +
+		"order by status_date desc")
+	// return empty and error code on error
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
 
+	// run query
+	rows, err := stmt.Query(contactID, since.UTC().Format("2006-01-02 15:04:05"))
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// prepare rows close on exit
+	defer rows.Close()
+	// scan up all rows
+	for rows.Next() {
+		var s sattypes.ServiceLog
+		err := rows.Scan(&s.ServiceID, &s.Name, &s.ToCheck, &s.Date, &s.Status_From, &s.Status_To, &s.Why)
+		if err != nil {
+			return nil, err
+		}
+		serviceLogs = append(serviceLogs, s)
+	}
+
+	// return empty slice and error code on error
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return serviceLogs, nil
+}
+
+// ReadNotificationSchedules reads all schedules of the members of an alert group
+func ReadNotificationSchedules(H sattypes.BaseHandler, contactID int64) ([]sattypes.NotificationSchedule, error) {
+	var schedules []sattypes.NotificationSchedule
+
+	stmt, err := H.DB.Prepare("select schedule_id, contact_id, email, timezone, days, start_time, end_time " +
+		"from alertgroup_schedules where contact_id = ? order by email, schedule_id")
+	// return empty and error code on error
+	if err != nil {
+		return nil, err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(agentName, agentLocation, accessKey)
+	// run query
+	rows, err := stmt.Query(contactID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	// prepare rows close on exit
+	defer rows.Close()
+	// scan up all rows
+	for rows.Next() {
+		var ns sattypes.NotificationSchedule
+		err := rows.Scan(&ns.ScheduleID, &ns.ContactID, &ns.Email, &ns.TimeZone, &ns.Days, &ns.Start, &ns.End)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, ns)
+	}
+
+	// return empty and error code on error
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
 
+	return schedules, nil
 }
 
-// UpdateAgent updates a loation and lastseen of an agent
-func UpdateAgentLocation(H sattypes.BaseHandler, agentLocation, agentId string) error {
+// InsertNotificationSchedule inserts a new schedule for a member of an alert group
+func InsertNotificationSchedule(H sattypes.BaseHandler, ns *sattypes.NotificationSchedule) error {
 	// prepare insert query for sqlite*/
-	stmt, err := H.DB.Prepare(
-		"update satagents set satagent_location=?, lastseen=datetime('now') where satagent_id=?")
+	stmt, err := H.DB.Prepare("INSERT into alertgroup_schedules (contact_id, email, timezone, days, " +
+		"start_time, end_time) values(?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
 	defer stmt.Close()
+
+	res, err := stmt.Exec(ns.ContactID, ns.Email, ns.TimeZone, ns.Days, ns.Start, ns.End)
 	if err != nil {
 		return err
 	}
 
-	_, err = stmt.Exec(agentLocation, agentId)
+	ns.ScheduleID, err = res.LastInsertId()
 	if err != nil {
 		return err
 	}
@@ -618,77 +823,653 @@ func UpdateAgentLocation(H sattypes.BaseHandler, agentLocation, agentId string)
 	return nil
 }
 
-// ReadAgents  returns a slice of possible sat agents
-func ReadAgents(H sattypes.BaseHandler) ([]sattypes.SatAgentSql, error) {
-	var agents []sattypes.SatAgentSql
-	var stmt *sql.Stmt
-	var rows *sql.Rows
-	var err error
+// DeleteNotificationSchedule deletes a schedule of an alert group
+func DeleteNotificationSchedule(H sattypes.BaseHandler, contactID, scheduleID int64) error {
+	// prepare statement
+	stmt, err := H.DB.Prepare("delete from alertgroup_schedules where contact_id = ? and schedule_id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
 
-	// prepare query to show the agents, that have been active for last -5 days
-	stmt, err = H.DB.Prepare(
-		"select satagent_id, satagent_name satagent_location from satagents where lastseen >= date('now', '-5 day')")
+	// execute prepared statement
+	_, err = stmt.Exec(contactID, scheduleID)
+	return err
+}
 
+// ReadRotations reads all on-call rotations of an owner
+func ReadRotations(H sattypes.BaseHandler, ownerID int64) ([]sattypes.Rotation, error) {
+	var rotations []sattypes.Rotation
+
+	stmt, err := H.DB.Prepare("select rotation_id, owner_id, name, members, handoff, length_days, timezone " +
+		"from rotations where owner_id = ? order by name asc")
 	// return empty and error code on error
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
-	rows, err = stmt.Query()
+	// run query
+	rows, err := stmt.Query(ownerID)
+	if err != nil {
+		return nil, err
+	}
 
 	// prepare rows close on exit
 	defer rows.Close()
 	// scan up all rows
 	for rows.Next() {
-		var s sattypes.SatAgentSql
-		err := rows.Scan(
-			&s.SatAgentID, &s.SatAgentName, &s.SatAgentLocation)
-		// return empty user struct and error code on error
+		var r sattypes.Rotation
+		err := rows.Scan(&r.RotationID, &r.OwnerID, &r.Name, &r.Members, &r.Handoff, &r.LengthDays, &r.TimeZone)
 		if err != nil {
 			return nil, err
 		}
+		rotations = append(rotations, r)
 	}
 
-	// return empty slice and error code on error
+	// return empty and error code on error
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
 
-	// return filled  slice
-	return agents, nil
+	return rotations, nil
+}
+
+// SelectRotation returns an on-call rotation by its id
+func SelectRotation(H sattypes.BaseHandler, rotationID int64) (sattypes.Rotation, error) {
+	var r sattypes.Rotation
+
+	// run query
+	rows := H.DB.QueryRow("select rotation_id, owner_id, name, members, handoff, length_days, timezone "+
+		"from rotations where rotation_id = ?", rotationID)
 
+	// return empty struct and error code on error
+	switch err := rows.Scan(&r.RotationID, &r.OwnerID, &r.Name, &r.Members, &r.Handoff, &r.LengthDays, &r.TimeZone); err {
+	case sql.ErrNoRows:
+		return sattypes.Rotation{}, sql.ErrNoRows
+	case nil:
+		return r, nil
+	default:
+		return sattypes.Rotation{}, err
+	}
 }
 
-// ReadAgentLocations  returns a slice of possible sat agent regions
-func ReadAgentLocations(H sattypes.BaseHandler) ([]string, error) {
-	var locations []string
-	var location string
-	var stmt *sql.Stmt
-	var rows *sql.Rows
-	var err error
+// InsertRotation inserts a new on-call rotation
+func InsertRotation(H sattypes.BaseHandler, r *sattypes.Rotation) error {
+	// prepare insert query for sqlite*/
+	stmt, err := H.DB.Prepare("INSERT into rotations (owner_id, name, members, handoff, length_days, " +
+		"timezone) values(?,?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
 
-	// prepare query to show the agents, that have been active for last -5 days
-	stmt, err = H.DB.Prepare("select distinct satagent_location from satagents where lastseen >= date('now', '-5 day')")
+	res, err := stmt.Exec(r.OwnerID, r.Name, r.Members, r.Handoff, r.LengthDays, r.TimeZone)
+	if err != nil {
+		return err
+	}
 
-	// return empty and error code on error
+	r.RotationID, err = res.LastInsertId()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	return nil
+}
+
+// UpdateRotation updates an on-call rotation
+func UpdateRotation(H sattypes.BaseHandler, r *sattypes.Rotation) error {
+	// prepare update query
+	stmt, err := H.DB.Prepare("update rotations set name=?,members=?,handoff=?,length_days=?,timezone=? where rotation_id=?")
+	if err != nil {
+		return err
 	}
 	defer stmt.Close()
 
-	rows, err = stmt.Query()
+	_, err = stmt.Exec(r.Name, r.Members, r.Handoff, r.LengthDays, r.TimeZone, r.RotationID)
+	return err
+}
 
-	// prepare rows close on exit
-	defer rows.Close()
-	// scan up all rows
-	for rows.Next() {
-		err := rows.Scan(
-			&location)
+// DeleteRotation deletes an on-call rotation, its overrides and detaches it from the alert groups
+func DeleteRotation(H sattypes.BaseHandler, rotationID int64) error {
+	// prepare statement
+	stmt, err := H.DB.Prepare("delete from rotations where rotation_id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	// execute prepared statement
+	_, err = stmt.Exec(rotationID)
+	if err != nil {
+		return err
+	}
+
+	_, err = H.DB.Exec("delete from rotation_overrides where rotation_id = ?", rotationID)
+	if err != nil {
+		return err
+	}
+
+	_, err = H.DB.Exec("update alertgroup set rotation_id = 0 where rotation_id = ?", rotationID)
+	return err
+}
+
+// ReadRotationOverrides reads the overrides of an on-call rotation in order of creation
+func ReadRotationOverrides(H sattypes.BaseHandler, rotationID int64) ([]sattypes.RotationOverride, error) {
+	var overrides []sattypes.RotationOverride
+
+	stmt, err := H.DB.Prepare("select override_id, rotation_id, email, start_time, end_time " +
+		"from rotation_overrides where rotation_id = ? order by override_id")
+	// return empty and error code on error
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	// run query
+	rows, err := stmt.Query(rotationID)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare rows close on exit
+	defer rows.Close()
+	// scan up all rows
+	for rows.Next() {
+		var o sattypes.RotationOverride
+		err := rows.Scan(&o.OverrideID, &o.RotationID, &o.Email, &o.Start, &o.End)
+		if err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+
+	// return empty and error code on error
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return overrides, nil
+}
+
+// InsertRotationOverride inserts a new override for an on-call rotation
+func InsertRotationOverride(H sattypes.BaseHandler, o *sattypes.RotationOverride) error {
+	// prepare insert query for sqlite*/
+	stmt, err := H.DB.Prepare("INSERT into rotation_overrides (rotation_id, email, start_time, end_time) values(?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(o.RotationID, o.Email, o.Start, o.End)
+	if err != nil {
+		return err
+	}
+
+	o.OverrideID, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteRotationOverride deletes an override of an on-call rotation
+func DeleteRotationOverride(H sattypes.BaseHandler, rotationID, overrideID int64) error {
+	// prepare statement
+	stmt, err := H.DB.Prepare("delete from rotation_overrides where rotation_id = ? and override_id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	// execute prepared statement
+	_, err = stmt.Exec(rotationID, overrideID)
+	return err
+}
+
+// SelectAgent searches and returns agent record by argument
+func SelectAgent(H sattypes.BaseHandler, arg string, argValue string) (sattypes.SatAgentSql, error) {
+	var Agent sattypes.SatAgentSql
+
+	var query = fmt.Sprintf(
+		"select satagent_id, satagent_name, satagent_location, access_key, lastseen, ifnull(version,''), "+
+			"ifnull(locationfixed,0), ifnull(disabled,0), ifnull(status,'approved'), ifnull(secret_sent,1), "+
+			"ifnull(pubkey,''), ifnull(protocol,0), ifnull(os,''), ifnull(checks,''), ifnull(health,''), ifnull(embedded,0) "+
+			"from satagents where %s = ?",
+		arg)
+	var health string
+	// run query
+	rows := H.DB.QueryRow(query, argValue)
+
+	// return empty user struct and error code on error
+	switch err := rows.Scan(&Agent.SatAgentID, &Agent.SatAgentName, &Agent.SatAgentLocation, &Agent.AccessKey,
+		&Agent.LastSeen, &Agent.Version, &Agent.LocationFixed, &Agent.Disabled, &Agent.Status, &Agent.SecretSent,
+		&Agent.PublicKey, &Agent.Protocol, &Agent.OS, &Agent.Checks, &health, &Agent.Embedded); err {
+	case sql.ErrNoRows:
+		return sattypes.SatAgentSql{}, sql.ErrNoRows
+	case nil:
+		// return filled user struct
+		Agent.Health = parseAgentHealth(health)
+		return Agent, nil
+	default:
+		return sattypes.SatAgentSql{}, err
+	}
+}
+
+// InsertAgent insert an agent record
+func InsertAgent(H sattypes.BaseHandler, agent sattypes.SatAgentSql) error {
+	// prepare insert query for sqlite*/
+	stmt, err := H.DB.Prepare("INSERT into satagents" +
+		" (satagent_name, satagent_location, access_key, locationfixed, status, secret_sent, pubkey, embedded, lastseen) " +
+		"values(?,?,?,?,?,?,?,?, datetime('NOW'))")
+
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(agent.SatAgentName, agent.SatAgentLocation, agent.AccessKey, agent.LocationFixed, agent.Status,
+		agent.SecretSent, agent.PublicKey, agent.Embedded)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// UpdateAgentSeen updates location, version and lastseen of an agent, a fixed location is kept
+func UpdateAgentSeen(H sattypes.BaseHandler, agentLocation, version, agentId string) error {
+	// prepare insert query for sqlite*/
+	stmt, err := H.DB.Prepare("update satagents set satagent_location=case when locationfixed=1 then satagent_location " +
+		"else ? end, version=?, lastseen=datetime('now') where satagent_id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(agentLocation, version, agentId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateAgentHealth saves the health of the last heartbeat of an agent
+func UpdateAgentHealth(H sattypes.BaseHandler, agentID string, health sattypes.AgentHealth) error {
+	data, err := json.Marshal(health)
+	if err != nil {
+		return err
+	}
+	stmt, err := H.DB.Prepare("update satagents set health=? where satagent_id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(string(data), agentID)
+	return err
+}
+
+// parseAgentHealth returns the saved health of an agent, zero without heartbeat
+func parseAgentHealth(data string) sattypes.AgentHealth {
+	var health sattypes.AgentHealth
+	if data != "" {
+		if err := json.Unmarshal([]byte(data), &health); err != nil {
+			log.Println(err)
+		}
+	}
+	return health
+}
+
+// UpdateAgentHello saves protocol, version, OS and the check types, the agent reported with its hello
+func UpdateAgentHello(H sattypes.BaseHandler, agentID string, hello sattypes.AgentHello) error {
+	stmt, err := H.DB.Prepare("update satagents set protocol=?, version=?, os=?, checks=? where satagent_id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(hello.Protocol, hello.Version, hello.OS+"/"+hello.Arch, strings.Join(hello.Checks, ","), agentID)
+	return err
+}
+
+// UpdateAgent updates location, access key, fixed location, disabled flag, enrollment status and signing key of an agent
+func UpdateAgent(H sattypes.BaseHandler, agent sattypes.SatAgentSql) error {
+	// prepare update query
+	stmt, err := H.DB.Prepare("update satagents set satagent_location=?, access_key=?, locationfixed=?, disabled=?, " +
+		"status=?, secret_sent=?, pubkey=? where satagent_id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(agent.SatAgentLocation, agent.AccessKey, agent.LocationFixed, agent.Disabled, agent.Status,
+		agent.SecretSent, agent.PublicKey, agent.SatAgentID)
+	return err
+}
+
+// DeleteAgent deletes an agent record
+func DeleteAgent(H sattypes.BaseHandler, agentID string) error {
+	// prepare statement
+	stmt, err := H.DB.Prepare("delete from satagents where satagent_id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	// execute prepared statement
+	_, err = stmt.Exec(agentID)
+	return err
+}
+
+// ReadAllAgents returns a slice of all agents for the management page
+func ReadAllAgents(H sattypes.BaseHandler) ([]sattypes.SatAgentSql, error) {
+	var agents []sattypes.SatAgentSql
+
+	stmt, err := H.DB.Prepare("select satagent_id, satagent_name, satagent_location, access_key, lastseen, " +
+		"ifnull(version,''), ifnull(locationfixed,0), ifnull(disabled,0), ifnull(status,'approved'), " +
+		"ifnull(secret_sent,1), ifnull(pubkey,''), ifnull(protocol,0), ifnull(os,''), ifnull(checks,''), " +
+		"ifnull(health,'') from satagents order by satagent_name")
+	// return empty and error code on error
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare rows close on exit
+	defer rows.Close()
+	// scan up all rows
+	for rows.Next() {
+		var s sattypes.SatAgentSql
+		var health string
+		err := rows.Scan(&s.SatAgentID, &s.SatAgentName, &s.SatAgentLocation, &s.AccessKey, &s.LastSeen,
+			&s.Version, &s.LocationFixed, &s.Disabled, &s.Status, &s.SecretSent, &s.PublicKey, &s.Protocol, &s.OS,
+			&s.Checks, &health)
+		if err != nil {
+			return nil, err
+		}
+		s.Health = parseAgentHealth(health)
+		agents = append(agents, s)
+	}
+
+	// return empty slice and error code on error
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return agents, nil
+}
+
+// ReadEnrollmentTokens returns all unused enrollment tokens
+func ReadEnrollmentTokens(H sattypes.BaseHandler) ([]sattypes.EnrollmentToken, error) {
+	var tokens []sattypes.EnrollmentToken
+
+	stmt, err := H.DB.Prepare("select token_id, token, created from enrollment_tokens where used_by = '' order by token_id")
+	// return empty and error code on error
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare rows close on exit
+	defer rows.Close()
+	// scan up all rows
+	for rows.Next() {
+		var t sattypes.EnrollmentToken
+		err := rows.Scan(&t.TokenID, &t.Token, &t.Created)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+
+	// return empty slice and error code on error
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// InsertEnrollmentToken inserts a new enrollment token
+func InsertEnrollmentToken(H sattypes.BaseHandler, token string) error {
+	// prepare insert query for sqlite*/
+	stmt, err := H.DB.Prepare("INSERT into enrollment_tokens (token) values(?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(token)
+	return err
+}
+
+// DeleteEnrollmentToken deletes an enrollment token
+func DeleteEnrollmentToken(H sattypes.BaseHandler, tokenID int64) error {
+	// prepare statement
+	stmt, err := H.DB.Prepare("delete from enrollment_tokens where token_id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	// execute prepared statement
+	_, err = stmt.Exec(tokenID)
+	return err
+}
+
+// UseEnrollmentToken marks an unused enrollment token as used by the agent, returns sql.ErrNoRows
+// for unknown or used tokens
+func UseEnrollmentToken(H sattypes.BaseHandler, token, agentName string) error {
+	// prepare statement
+	stmt, err := H.DB.Prepare("update enrollment_tokens set used_by = ? where token = ? and used_by = ''")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(agentName, token)
+	if err != nil {
+		return err
+	}
+
+	// the update is the check, no row means no valid token
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count != 1 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ReadAPITokens returns the api tokens of the user
+func ReadAPITokens(H sattypes.BaseHandler, userID int64) ([]sattypes.APIToken, error) {
+	var tokens []sattypes.APIToken
+
+	stmt, err := H.DB.Prepare("select token_id, user_id, name, scope, expires, created, last_used from api_tokens " +
+		"where user_id = ? order by token_id")
+	// return empty and error code on error
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare rows close on exit
+	defer rows.Close()
+	// scan up all rows
+	for rows.Next() {
+		var t sattypes.APIToken
+		err := rows.Scan(&t.TokenID, &t.UserID, &t.Name, &t.Scope, &t.Expires, &t.Created, &t.LastUsed)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+
+	// return empty slice and error code on error
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// SelectAPIToken returns the api token with the hash, sql.ErrNoRows for unknown tokens
+func SelectAPIToken(H sattypes.BaseHandler, tokenHash string) (sattypes.APIToken, error) {
+	var t sattypes.APIToken
+
+	stmt, err := H.DB.Prepare("select token_id, user_id, name, token_hash, scope, expires, created, last_used from api_tokens " +
+		"where token_hash = ?")
+	if err != nil {
+		return t, err
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRow(tokenHash).Scan(&t.TokenID, &t.UserID, &t.Name, &t.TokenHash, &t.Scope, &t.Expires, &t.Created, &t.LastUsed)
+	return t, err
+}
+
+// InsertAPIToken inserts a new api token
+func InsertAPIToken(H sattypes.BaseHandler, token sattypes.APIToken) error {
+	// prepare insert query for sqlite*/
+	stmt, err := H.DB.Prepare("INSERT into api_tokens (user_id, name, token_hash, scope, expires) values(?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(token.UserID, token.Name, token.TokenHash, token.Scope, token.Expires)
+	return err
+}
+
+// DeleteAPIToken revokes an api token of the user
+func DeleteAPIToken(H sattypes.BaseHandler, userID, tokenID int64) error {
+	// prepare statement
+	stmt, err := H.DB.Prepare("delete from api_tokens where token_id = ? and user_id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	// execute prepared statement
+	_, err = stmt.Exec(tokenID, userID)
+	return err
+}
+
+// UpdateAPITokenUsed sets the last use of an api token, at most once a minute to spare the database
+func UpdateAPITokenUsed(H sattypes.BaseHandler, tokenID int64) error {
+	stmt, err := H.DB.Prepare("update api_tokens set last_used = datetime('now') where token_id = ? " +
+		"and (last_used = '' or last_used < datetime('now', '-1 minute'))")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(tokenID)
+	return err
+}
+
+// ReadAgents  returns a slice of possible sat agents
+func ReadAgents(H sattypes.BaseHandler) ([]sattypes.SatAgentSql, error) {
+	var agents []sattypes.SatAgentSql
+	var stmt *sql.Stmt
+	var rows *sql.Rows
+	var err error
+
+	// prepare query to show the agents, that have been active for last -5 days
+	stmt, err = H.DB.Prepare(
+		"select satagent_id, satagent_name, satagent_location, lastseen from satagents where lastseen >= date('now', '-5 day')")
+
+	// return empty and error code on error
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err = stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare rows close on exit
+	defer rows.Close()
+	// scan up all rows
+	for rows.Next() {
+		var s sattypes.SatAgentSql
+		err := rows.Scan(
+			&s.SatAgentID, &s.SatAgentName, &s.SatAgentLocation, &s.LastSeen)
+		// return empty user struct and error code on error
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, s)
+	}
+
+	// return empty slice and error code on error
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// return filled  slice
+	return agents, nil
+
+}
+
+// ReadAgentLocations  returns a slice of possible sat agent regions, a location is stale,
+// when none of its agents has been seen for the silence period
+func ReadAgentLocations(H sattypes.BaseHandler) ([]sattypes.AgentLocation, error) {
+	var locations []sattypes.AgentLocation
+	var stmt *sql.Stmt
+	var rows *sql.Rows
+	var err error
+
+	// prepare query to show the agents, that have been active for last -5 days
+	stmt, err = H.DB.Prepare("select satagent_location, max(lastseen) < datetime('now', ?) from satagents " +
+		"where lastseen >= date('now', '-5 day') group by satagent_location")
+
+	// return empty and error code on error
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err = stmt.Query(fmt.Sprintf("-%d seconds", int(H.AgentSilence.Seconds())))
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare rows close on exit
+	defer rows.Close()
+	// scan up all rows
+	for rows.Next() {
+		var location sattypes.AgentLocation
+		err := rows.Scan(&location.Name, &location.Stale)
 		// return empty user struct and error code on error
 		if err != nil {
 			return nil, err
 		}
+		// without a silence period, no location gets stale
+		location.Stale = location.Stale && H.AgentSilence > 0
 		locations = append(locations, location)
 	}
 
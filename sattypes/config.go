@@ -0,0 +1,55 @@
+package sattypes
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// AgentConfig is the version of the services, that are sent to the agents,
+// it is increased with every added, changed or deleted service
+var AgentConfig = NewConfigVersion()
+
+// ConfigVersion counts changes of the configuration and wakes up, who is waiting for a change
+type ConfigVersion struct {
+	mutex sync.Mutex
+	// start of the server, versions of an earlier run never match
+	epoch   int64
+	version uint64
+	// changed is closed on the next change and replaced
+	changed chan struct{}
+	closed  bool
+}
+
+// NewConfigVersion returns the first version of a configuration
+func NewConfigVersion() *ConfigVersion {
+	return &ConfigVersion{epoch: time.Now().UnixNano(), changed: make(chan struct{})}
+}
+
+// Current returns the current version and a channel, that is closed on the next change
+func (c *ConfigVersion) Current() (string, <-chan struct{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return fmt.Sprintf("%x-%d", c.epoch, c.version), c.changed
+}
+
+// Changed increases the version and wakes up everyone waiting for it
+func (c *ConfigVersion) Changed() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.version++
+	if !c.closed {
+		close(c.changed)
+		c.changed = make(chan struct{})
+	}
+}
+
+// Close wakes up everyone waiting for a change and does not let anyone wait anymore, e.g. on shutdown
+func (c *ConfigVersion) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.changed)
+	}
+}
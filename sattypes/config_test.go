@@ -0,0 +1,48 @@
+package sattypes_test
+
+import (
+	"testing"
+	"time"
+	"unfoldedip/sattypes"
+)
+
+// Test versions and waking up waiting agents
+func TestConfigVersion(t *testing.T) {
+	c := sattypes.NewConfigVersion()
+	first, changed := c.Current()
+	if again, _ := c.Current(); again != first {
+		t.Errorf("Version changed from %s to %s without a change", first, again)
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		c.Changed()
+	}()
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("Waiting for the change timed out")
+	}
+	second, changed := c.Current()
+	if second == first {
+		t.Error("Version did not change")
+	}
+
+	// versions of another server run never match
+	if other, _ := sattypes.NewConfigVersion().Current(); other == first {
+		t.Error("Version of a new configuration matches")
+	}
+
+	// closing wakes up all waiting and keeps the version
+	c.Close()
+	<-changed
+	if third, closed := c.Current(); third != second {
+		t.Error("Version changed on close")
+	} else {
+		select {
+		case <-closed:
+		default:
+			t.Error("Waiting after close is still possible")
+		}
+	}
+}
@@ -1,24 +1,48 @@
 package sattypes
 
 import (
-	"bytes"
-	"crypto/tls"
 	"database/sql"
-	"fmt"
 	"golang.org/x/crypto/bcrypt"
-	"html/template"
-	"log"
+	"net"
 	"net/mail"
-	"net/smtp"
-	"os"
 	"strings"
 	"time"
 )
 
+// Version of server and agent, the agent sends it in the agent-version header
+const Version = "1.1"
+
+// ProtocolVersion of the agent protocol, the agent sends it with its hello,
+// agents and servers without the hello speak version 1
+const ProtocolVersion = 2
+
+// CheckTypes are all service types, that can be checked by agents
+var CheckTypes = []string{"http", "ping", "tcp", "tls"}
+
+// AgentHello is sent by the agent to /agents/hello before pulling its configuration
+type AgentHello struct {
+	Protocol int    `json:"protocol"`
+	Version  string `json:"version"`
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+	// Checks are the service types, the agent can run
+	Checks []string `json:"checks"`
+}
+
+// ServerHello is the answer of the server to the hello of an agent
+type ServerHello struct {
+	Protocol int    `json:"protocol"`
+	Version  string `json:"version"`
+}
+
 // resultsChannel is the communication channel between
 // main thread and the analyzer thread
 var ResultsChannel chan ServiceResult
 
+// AgentChannel tells the analyzer thread, that an agent
+// has contacted the server
+var AgentChannel chan AgentSeen
+
 // A base handler for passing the DB connection
 type BaseHandler struct {
 	DB     *sql.DB
@@ -27,13 +51,54 @@ type BaseHandler struct {
 	SMTPConfiguration
 	URL        string
 	EndChannel struct{}
+	// SummaryHour is the local hour for sending the daily summaries, -1 = off
+	SummaryHour int
+	// AgentSilence is the period after a silent agent is considered dead, 0 = off
+	AgentSilence time.Duration
+	// AdminAlertGroup is notified about dead and recovered agents, 0 = off
+	AdminAlertGroup int64
+	// AgentMaxLag and AgentMaxSkew are the limits for overloaded agents and skewed agent clocks, 0 = off
+	AgentMaxLag  time.Duration
+	AgentMaxSkew time.Duration
+	// EnrollAgents keeps new agents pending, till an admin approves them
+	EnrollAgents bool
+	// GlobalKey allows agents to use the shared SatKey, else only own secrets and enrollment tokens are accepted
+	GlobalKey bool
+	// RequireSigned refuses result batches without a valid Ed25519 signature
+	RequireSigned bool
+	// MetricsToken and MetricsAllow grant access to /metrics by bearer token or client address,
+	// /metrics is off, when both are empty
+	MetricsToken string
+	MetricsAllow []*net.IPNet
 }
 
 // SMTP Configuration
 type SMTPConfiguration struct {
 	SmtpServer, SmtpUser, SmtpPassword, SmtpSender string
+	// SmtpMode is the transport security, one of SMTPModeNone, SMTPModeStartTLS, SMTPModeTLS
+	SmtpMode string
+	// SmtpAuth is the auth mechanism, one of SMTPAuthNone, SMTPAuthPlain, SMTPAuthLogin, SMTPAuthCRAMMD5,
+	// empty means plain, when a user is configured
+	SmtpAuth string
+	// SmtpCAFile is a PEM file with the CA for verifying the server certificate
+	SmtpCAFile string
+	// SmtpInsecure turns off the verification of the server certificate
+	SmtpInsecure bool
+	// SmtpHelo is the name presented in HELO/EHLO, empty means hostname
+	SmtpHelo string
 }
 
+// SMTP transport modes and auth mechanisms
+const (
+	SMTPModeNone     = "none"
+	SMTPModeStartTLS = "starttls"
+	SMTPModeTLS      = "tls"
+	SMTPAuthNone     = "none"
+	SMTPAuthPlain    = "plain"
+	SMTPAuthLogin    = "login"
+	SMTPAuthCRAMMD5  = "cram-md5"
+)
+
 // SessionManager is a pseudo type for managing, selecting, deleting sessions from SQL
 type SessionManager struct{}
 
@@ -48,12 +113,19 @@ type Global struct {
 	Service           Service
 	Services          []Service
 	AllowedIntervals  []int
+	AllowedDigests    []int
 	ServiceLogs       []ServiceLog
 	AlertGroup        AlertGroup
 	SatAgent          SatAgentSql
 	SatAgents         []SatAgentSql
-	SatAgentLocations []string
+	EnrollmentTokens  []EnrollmentToken
+	APITokens         []APIToken
+	SatAgentLocations []AgentLocation
 	AlertGroups       []AlertGroup
+	Schedules         []NotificationSchedule
+	Rotation          Rotation
+	Rotations         []RotationStatus
+	RotationOverrides []RotationOverride
 	CSRF              string
 	NextFunction      string
 }
@@ -75,6 +147,9 @@ type Service struct {
 	LastEvent      string    `json:"lastevent"`
 	LastSeen       time.Time `json:"lastseen"`
 	Locations      string    `json:"locations"`
+	Severity       string    `json:"severity"`
+	// Timeout of a single check in seconds, 0 = default of the check type
+	Timeout int `json:"timeout"`
 }
 
 // AlertGroup will be filled by sql driver
@@ -84,6 +159,12 @@ type AlertGroup struct {
 	GroupName string `json:"groupname"`
 	Emails    string `json:"emails"`
 	Exists    bool   `json:"exists"`
+	// DigestSeconds collects transitions for a window and sends a single digest, 0 = off
+	DigestSeconds int `json:"digestseconds"`
+	// DailySummary sends a summary of all incidents and current states once a day
+	DailySummary bool `json:"dailysummary"`
+	// RotationID adds the current on-call member of a rotation to the recipients, 0 = off
+	RotationID int64 `json:"rotationid"`
 }
 
 // ServiceResult is a struct, that will be posted back
@@ -95,6 +176,10 @@ type ServiceResult struct {
 	Time        time.Time `json:"time"`
 	TestNode    string    `json:"node"`
 	RapidChange bool      `json:"rapidchange"`
+	// Reason tells, why a check failed without an answer of the target, e.g. ReasonTimeout
+	Reason string `json:"reason,omitempty"`
+	// Latency is the duration of the check in seconds
+	Latency float64 `json:"latency,omitempty"`
 }
 
 // ServiceLog is a struct, that will  be used to
@@ -109,6 +194,17 @@ type ServiceLog struct {
 	Why         string `json:"status_why"`
 }
 
+// LogFilter selects service logs of an owner, zero values match everything
+type LogFilter struct {
+	OwnerID   int64
+	ServiceID int64
+	// State is the new state of the change, UP or DOWN
+	State        string
+	Since, Until time.Time
+	Limit        int
+	Offset       int
+}
+
 // UnfoldedUser struct is used for creating and
 // managing user objects
 type UnfoldedUser struct {
@@ -119,7 +215,9 @@ type UnfoldedUser struct {
 	Reset            string
 	LoggedIn         bool
 	Exists           bool
-	UserSession      Session
+	// Admin users can manage the satellite agents
+	Admin       bool
+	UserSession Session
 }
 
 // Session consist of userid and a CSRF token
@@ -138,252 +236,217 @@ type SatAgentSql struct {
 	SatOnlyLocation  bool
 	AccessKey        string
 	LastSeen         string
+	Version          string
+	// LocationFixed ignores the location sent by the agent
+	LocationFixed bool
+	// Disabled agents are refused by the server
+	Disabled bool
+	// Status is AgentPending or AgentApproved
+	Status string
+	// SecretSent is false, till the agent received its own secret after the approval
+	SecretSent bool
+	// PublicKey is the base64 encoded Ed25519 key for verifying signed results
+	PublicKey string
+	// Embedded marks the agent registered by the server itself, its key is replaced on every start
+	Embedded bool
+	// ResultsPerMinute is counted in memory by the server
+	ResultsPerMinute int
+	// Pool holds the last self-metrics of the agent in memory
+	Pool AgentPoolStats
+	// Protocol, OS and Checks are reported with the hello of the agent, Protocol 0 = agent without hello
+	Protocol int
+	OS       string
+	Checks   string
+	// Health of the last heartbeat, zero without heartbeat
+	Health AgentHealth
 }
 
-// Service Results state as expression
-const (
-	_              = iota
-	ServiceUP      = "SERVICE_UP"
-	ServiceDown    = "SERVICE_DOWN"
-	ServiceUnknown = "SERVICE_UNKNOWN"
-)
-
-// check password, encrypt incoming with bcrypt
-func (u *UnfoldedUser) SetEmail(email string) error {
-	_, err := mail.ParseAddress(email)
-	if err != nil {
-		return err
-	}
-	u.Email = email
-	return nil
-}
-
-// check password, encrypt incoming with bcrypt and compare to the password from the user object
-func (u UnfoldedUser) CheckPassword(password string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password))
-	if err == nil {
+// CanRun returns true, if the agent reported, that it can run checks of serviceType,
+// agents without a hello get all services, agents with a hello without usable types get none
+func (a SatAgentSql) CanRun(serviceType string) bool {
+	if a.Protocol == 0 {
 		return true
 	}
-	return false
-}
-
-// bcrypt the password, save into user object and also return directly for further processing
-func (u *UnfoldedUser) GeneratePassword(password string) (string, error) {
-	passwordBytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-	if err == nil {
-		u.PasswordHash = string(passwordBytes)
-	}
-	return "", err
-}
-
-// SendMail sends out mail using the smtp configuration from command line
-func (smtpConfig SMTPConfiguration) SendMail(subject, recipient, body string) error {
-	// split server and port away
-	authHostName := strings.Split(smtpConfig.SmtpServer, ":")[0]
-	if len(authHostName) == 0 {
-		log.Println("No server name for smtp auth")
-		return fmt.Errorf("no server name for smtp auth, given %s", smtpConfig.SmtpServer)
-	}
-
-	// create smtp auth object
-	auth := smtp.PlainAuth("", smtpConfig.SmtpUser, smtpConfig.SmtpPassword, authHostName)
-
-	// Enable TLS for Golang Dial
-	tlsconfig := &tls.Config{
-		InsecureSkipVerify: true,
-		ServerName:         smtpConfig.SmtpServer,
-	}
-
-	// Start the connection
-	c, err := smtp.Dial(smtpConfig.SmtpServer)
-	if err != nil {
-		return err
-	}
-	defer c.Close()
-
-	hostname, err := os.Hostname()
-	if err != nil {
-		return err
+	if a.Checks == "" {
+		return false
 	}
-	c.Hello(hostname)
-
-	// Upgrade to TLS
-	err = c.StartTLS(tlsconfig)
-	if err != nil {
-		return err
-	}
-
-	// Send Auth
-	err = c.Auth(auth)
-	if err != nil {
-		return err
-	}
-
-	err = c.Mail(smtpConfig.SmtpSender)
-	if err != nil {
-		return err
-	}
-
-	err = c.Rcpt(recipient)
-	if err != nil {
-		return err
+	for _, check := range strings.Split(a.Checks, ",") {
+		if check == serviceType {
+			return true
+		}
 	}
+	return false
+}
 
-	/* get current time / data */
-	t := time.Now()
+// Agent states for the enrollment
+const (
+	AgentPending  = "pending"
+	AgentApproved = "approved"
+)
 
-	/* Add header */
-	header := new(bytes.Buffer)
-	/* prepare header with from, to, subject and the current date / time */
-	fmt.Fprintf(header, "From: %s\r\n", smtpConfig.SmtpSender)
-	fmt.Fprintf(header, "To: %s\r\n", recipient)
-	fmt.Fprintf(header, "Subject:  %s\r\n", subject)
-	fmt.Fprintf(header, "Date: %s", t.Format(time.RFC1123Z))
-	fmt.Fprintf(header, "\r\n\r\n")
+// EnrollmentToken can be used once by a new agent for registering without an approval
+type EnrollmentToken struct {
+	TokenID int64
+	Token   string
+	Created string
+}
 
-	/* data begins here */
-	wc, err := c.Data()
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-	defer wc.Close()
+// Scopes of the personal api tokens
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
 
-	/* output header lines */
-	if _, err = header.WriteTo(wc); err != nil {
-		log.Println(err)
-		return err
-	}
+// APIToken authenticates requests to the JSON api for a user, only the hash of the token is stored
+type APIToken struct {
+	TokenID   int64
+	UserID    int64
+	Name      string
+	TokenHash string
+	Scope     string
+	// Expires and LastUsed are empty for never
+	Expires  string
+	Created  string
+	LastUsed string
+}
 
-	/* and output body header lines */
-	if _, err = strings.NewReader(body).WriteTo(wc); err != nil {
-		log.Println(err)
-		return err
+// Expired returns true, if the token has an expiry in the past
+func (t APIToken) Expired(now time.Time) bool {
+	if t.Expires == "" {
+		return false
 	}
-
-	// and close the curtain
-	wc.Close()
-
-	return nil
-
+	expires, err := time.Parse(time.DateTime, t.Expires)
+	return err != nil || now.UTC().After(expires)
 }
 
-// SendServiceMail templates and prepares the mail for service related information
-func (smtpConfig SMTPConfiguration) SendServiceMail(s Service, r ServiceResult, recipient string) error {
-	var state = "UNKNOWN"
-	var body bytes.Buffer
-	var message string
-	if s.ServiceState == ServiceUP {
-		state = "UP"
-		message = `
-IP-Unfolded monitoring service notification
-
-{{.S.Name}} is UP and has recovered from an error or an unknown state.
-
-Type of Check: {{.S.Type}}
-Checked: {{.S.ToCheck}}
-
-Timepoint: {{.R.Time}}
-Message: {{.R.Message}}
-
-BR
-IP Unfolded`
-	} else if s.ServiceState == ServiceDown {
-		state = "DOWN"
-		message = `
-IP-Unfolded monitoring service notification
+// AgentPoolStats are the self-metrics of the worker pool of an agent, sent in the agent-stats header
+type AgentPoolStats struct {
+	Workers    int   `json:"workers"`
+	QueueDepth int   `json:"queue"`
+	Running    int64 `json:"running"`
+	Completed  int64 `json:"completed"`
+	Skipped    int64 `json:"skipped"`
+	Overrun    int64 `json:"overrun"`
+}
 
-{{.S.Name}} is DOWN and has encountered an error.
+// AgentHealth is sent by the agent with every heartbeat
+type AgentHealth struct {
+	// Time is the local clock of the agent
+	Time time.Time `json:"time"`
+	// Uptime of the agent in seconds
+	Uptime int64 `json:"uptime"`
+	// Checks completed since the start
+	Checks int64 `json:"checks"`
+	// FailedPosts of results since the start
+	FailedPosts int64 `json:"failedposts"`
+	// Spooled results, that are not sent yet
+	Spooled int `json:"spooled"`
+	// SchedulerLag is the maximum delay in seconds between a check being due and its start since the last heartbeat
+	SchedulerLag float64 `json:"schedulerlag"`
+	Goroutines   int     `json:"goroutines"`
+	// ClockOffset is set by the server, seconds the clock of the agent is ahead of the server
+	ClockOffset float64 `json:"clockoffset"`
+	// Received is set by the server
+	Received time.Time `json:"received"`
+}
 
-Type of Check: {{.S.Type}}
-Checked: {{.S.ToCheck}}
+// UptimeString returns the uptime for humans
+func (h AgentHealth) UptimeString() string {
+	return (time.Duration(h.Uptime) * time.Second).String()
+}
 
-Timepoint: {{.R.Time}}
-Message: {{.R.Message}}
+// AgentSeen is sent by the server, when an agent has fetched its configuration or posted results,
+// Health is set for heartbeats
+type AgentSeen struct {
+	Name     string
+	Location string
+	Time     time.Time
+	Health   *AgentHealth
+}
 
-BR
-IP Unfolded
-`
-	} else if s.ServiceState == ServiceUnknown {
-		state = "UNKNOWN"
-		message = `
-IP-Unfolded monitoring service notification
+// AgentLocation is a location of the agents, stale when none of its agents has been seen for the silence period
+type AgentLocation struct {
+	Name  string `json:"name"`
+	Stale bool   `json:"stale"`
+}
 
-{{.S.Name}} is in an UNKNOWN state and unfolded not received any check results in the last 600 seconds.
+// Service Results state as expression
+const (
+	_              = iota
+	ServiceUP      = "SERVICE_UP"
+	ServiceDown    = "SERVICE_DOWN"
+	ServiceUnknown = "SERVICE_UNKNOWN"
+)
 
-Type of Check: {{.S.Type}}
-Checked: {{.S.ToCheck}}
+// Reasons for failed checks
+const (
+	ReasonTimeout = "timeout"
+)
 
-Timepoint: {{.R.Time}}
-Message: {{.R.Message}}
+// Default timeouts of the checks, ping needs more time for sending its packets
+const (
+	DefaultTimeout     = 5
+	DefaultPingTimeout = 10
+	MaxTimeout         = 60
+)
 
-BR
-IP Unfolded
-`
+// TimeoutDuration returns the timeout of a single check
+func (s Service) TimeoutDuration() time.Duration {
+	switch {
+	case s.Timeout > 0:
+		return time.Second * time.Duration(s.Timeout)
+	case s.Type == "ping":
+		return time.Second * DefaultPingTimeout
 	}
+	return time.Second * DefaultTimeout
+}
 
-	/* Custom template content */
-	type Content struct {
-		S Service
-		R ServiceResult
+// StateName returns the short state name of the service
+func (s Service) StateName() string {
+	switch s.ServiceState {
+	case ServiceUP:
+		return "UP"
+	case ServiceDown:
+		return "DOWN"
 	}
+	return "UNKNOWN"
+}
 
-	// construct template
-	tmpl1, err := template.New("Mail").Parse(message)
-
-	// Execute
-	err = tmpl1.Execute(&body, Content{S: s, R: r})
-	if err != nil {
-		return err
+// StateColor returns the color for the state of the service, as used in mails
+func (s Service) StateColor() string {
+	switch s.ServiceState {
+	case ServiceUP:
+		return "#1cc88a"
+	case ServiceDown:
+		return "#e74a3b"
 	}
+	return "#f6c23e"
+}
 
-	err = smtpConfig.SendMail(fmt.Sprintf("Your Service: %s is %s", s.Name, state), recipient, body.String())
+// check password, encrypt incoming with bcrypt
+func (u *UnfoldedUser) SetEmail(email string) error {
+	_, err := mail.ParseAddress(email)
 	if err != nil {
 		return err
 	}
-
+	u.Email = email
 	return nil
 }
 
-// SendPasswordForget templates and prepares the mail for the password forget function
-func (smtpConfig SMTPConfiguration) SendPasswordForget(recp, password, hash, serverurl string) error {
-	var body bytes.Buffer
-	var message string = `IP-Unfolded registration service
-
-Hello,
-
-Would you please follow and submit the webpage on the following link? Then we will assign a new password for ` +
-		`our monitoring service. The new password will be {{.P}}
-
-{{.U}}/forget2?hash={{.H}}
-
-BR
-IP Unfolded
-`
-
-	/* Custom template content */
-	type Content struct {
-		P string
-		H string
-		U string
-	}
-
-	// construct template
-	tmpl1, err := template.New("Mail").Parse(message)
-	if err != nil {
-		return err
-	}
-
-	// Execute
-	err = tmpl1.Execute(&body, Content{P: password, H: hash, U: serverurl})
-	if err != nil {
-		return err
+// check password, encrypt incoming with bcrypt and compare to the password from the user object
+func (u UnfoldedUser) CheckPassword(password string) bool {
+	err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password))
+	if err == nil {
+		return true
 	}
+	return false
+}
 
-	err = smtpConfig.SendMail(fmt.Sprintf("Your login information for our website"), recp, body.String())
-	if err != nil {
-		return err
+// bcrypt the password, save into user object and also return directly for further processing
+func (u *UnfoldedUser) GeneratePassword(password string) (string, error) {
+	passwordBytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	if err == nil {
+		u.PasswordHash = string(passwordBytes)
 	}
-
-	return nil
+	return "", err
 }
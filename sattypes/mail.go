@@ -0,0 +1,802 @@
+package sattypes
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// MailMessage is a single mail with a plain text and an optional html part
+type MailMessage struct {
+	Recipient string
+	Subject   string
+	Text      string
+	HTML      string
+	// MessageID is generated on sending, if empty
+	MessageID string
+	// InReplyTo and References are used for threading mails together
+	InReplyTo  string
+	References []string
+}
+
+// ServiceNotification contains everything, that is rendered into a service mail
+type ServiceNotification struct {
+	Service     Service
+	Result      ServiceResult
+	LastResults []ServiceResult
+	ServerURL   string
+	// MessageID of this notification, ThreadID of the mail that opened the incident
+	MessageID string
+	ThreadID  string
+}
+
+// DigestNotification collects the service notifications of an alert group during the aggregation window
+type DigestNotification struct {
+	AlertGroup    AlertGroup
+	Notifications []ServiceNotification
+	ServerURL     string
+}
+
+// SummaryNotification contains the incidents and the current states of an alert group for the daily summary
+type SummaryNotification struct {
+	AlertGroup AlertGroup
+	Services   []Service
+	Logs       []ServiceLog
+	Since      time.Time
+	ServerURL  string
+}
+
+// AgentNotification contains everything, that is rendered into a dead or recovered agent mail
+type AgentNotification struct {
+	Name      string
+	Location  string
+	Down      bool
+	LastSeen  time.Time
+	Silence   time.Duration
+	ServerURL string
+	// Problem describes the health of an agent, e.g. "is overloaded, ...", Down is true for unhealthy agents
+	Problem string
+}
+
+// StateName returns the short state name of the notified agent
+func (an AgentNotification) StateName() string {
+	switch {
+	case an.Problem != "" && an.Down:
+		return "UNHEALTHY"
+	case an.Problem != "":
+		return "HEALTHY"
+	case an.Down:
+		return "DOWN"
+	}
+	return "UP"
+}
+
+// StateColor returns the banner color for the state of the notified agent
+func (an AgentNotification) StateColor() string {
+	if an.Down {
+		return Service{ServiceState: ServiceDown}.StateColor()
+	}
+	return Service{ServiceState: ServiceUP}.StateColor()
+}
+
+// StateName returns the short state name of the notified service
+func (n ServiceNotification) StateName() string {
+	return n.Service.StateName()
+}
+
+// StateColor returns the banner color for the state of the notified service
+func (n ServiceNotification) StateColor() string {
+	return n.Service.StateColor()
+}
+
+// Count returns the number of notifications in the digest, that transitioned into the state name
+func (d DigestNotification) Count(stateName string) int {
+	var count int
+	for _, n := range d.Notifications {
+		if n.StateName() == stateName {
+			count++
+		}
+	}
+	return count
+}
+
+// StateColor returns the banner color of the digest, red as soon as one service is down
+func (d DigestNotification) StateColor() string {
+	if d.Count("DOWN") > 0 {
+		return Service{ServiceState: ServiceDown}.StateColor()
+	} else if d.Count("UNKNOWN") > 0 {
+		return Service{ServiceState: ServiceUnknown}.StateColor()
+	}
+	return Service{ServiceState: ServiceUP}.StateColor()
+}
+
+// Count returns the number of services of the summary in the state name
+func (sn SummaryNotification) Count(stateName string) int {
+	var count int
+	for _, s := range sn.Services {
+		if s.StateName() == stateName {
+			count++
+		}
+	}
+	return count
+}
+
+// MailDomain returns the domain part of the sender address, or the hostname as fallback
+func (smtpConfig SMTPConfiguration) MailDomain() string {
+	if i := strings.LastIndex(smtpConfig.SmtpSender, "@"); i != -1 && i+1 < len(smtpConfig.SmtpSender) {
+		return strings.Trim(smtpConfig.SmtpSender[i+1:], "<> ")
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "localhost"
+	}
+	return hostname
+}
+
+// NewMessageID generates a unique Message-ID for the sender domain
+func (smtpConfig SMTPConfiguration) NewMessageID() string {
+	randomBytes := make([]byte, 8)
+	_, _ = rand.Read(randomBytes)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(randomBytes),
+		smtpConfig.MailDomain())
+}
+
+// BuildMail renders the message with all headers as multipart/alternative MIME message
+func (smtpConfig SMTPConfiguration) BuildMail(m MailMessage, t time.Time) ([]byte, error) {
+	if m.MessageID == "" {
+		m.MessageID = smtpConfig.NewMessageID()
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	// text part first, the html part last, as the last part is the preferred one
+	parts := []struct{ contentType, content string }{{"text/plain; charset=utf-8", m.Text}}
+	if m.HTML != "" {
+		parts = append(parts, struct{ contentType, content string }{"text/html; charset=utf-8", m.HTML})
+	}
+	for _, p := range parts {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err = qw.Write([]byte(p.content)); err != nil {
+			return nil, err
+		}
+		if err = qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	/* prepare header with from, to, subject, the current date / time and the mime information */
+	header := new(bytes.Buffer)
+	fmt.Fprintf(header, "From: %s\r\n", smtpConfig.SmtpSender)
+	fmt.Fprintf(header, "To: %s\r\n", m.Recipient)
+	fmt.Fprintf(header, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(header, "Date: %s\r\n", t.Format(time.RFC1123Z))
+	fmt.Fprintf(header, "Message-ID: %s\r\n", m.MessageID)
+	if m.InReplyTo != "" {
+		fmt.Fprintf(header, "In-Reply-To: %s\r\n", m.InReplyTo)
+	}
+	if len(m.References) > 0 {
+		fmt.Fprintf(header, "References: %s\r\n", strings.Join(m.References, " "))
+	}
+	fmt.Fprintf(header, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(header, "Content-Type: multipart/alternative; boundary=\"%s\"\r\n", mw.Boundary())
+	fmt.Fprintf(header, "\r\n")
+
+	return append(header.Bytes(), body.Bytes()...), nil
+}
+
+// SendMail sends out a plain text mail using the smtp configuration from command line
+func (smtpConfig SMTPConfiguration) SendMail(subject, recipient, body string) error {
+	return smtpConfig.SendMailMessage(MailMessage{Subject: subject, Recipient: recipient, Text: body})
+}
+
+// Configured returns true, if the configuration is complete enough for sending mails
+func (smtpConfig SMTPConfiguration) Configured() bool {
+	if len(smtpConfig.SmtpServer) == 0 || len(smtpConfig.SmtpSender) == 0 {
+		return false
+	}
+	// auth mechanisms need credentials
+	if mechanism := smtpConfig.authMechanism(); mechanism != SMTPAuthNone {
+		return len(smtpConfig.SmtpUser) != 0 && len(smtpConfig.SmtpPassword) != 0
+	}
+	return true
+}
+
+// authMechanism returns the configured auth mechanism, plain is default for configured users
+func (smtpConfig SMTPConfiguration) authMechanism() string {
+	mechanism := strings.ToLower(smtpConfig.SmtpAuth)
+	if mechanism == "" {
+		if smtpConfig.SmtpUser == "" {
+			return SMTPAuthNone
+		}
+		return SMTPAuthPlain
+	}
+	return mechanism
+}
+
+// tlsConfig builds the TLS configuration for the smtp server
+func (smtpConfig SMTPConfiguration) tlsConfig(hostname string) (*tls.Config, error) {
+	tlsconfig := &tls.Config{
+		ServerName:         hostname,
+		InsecureSkipVerify: smtpConfig.SmtpInsecure,
+	}
+
+	// load a custom CA for verification, if any
+	if smtpConfig.SmtpCAFile != "" {
+		caPEM, err := os.ReadFile(smtpConfig.SmtpCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsconfig.RootCAs = x509.NewCertPool()
+		if !tlsconfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", smtpConfig.SmtpCAFile)
+		}
+	}
+
+	return tlsconfig, nil
+}
+
+// auth returns the smtp auth object for the configured mechanism, nil for no auth
+func (smtpConfig SMTPConfiguration) auth(hostname string) (smtp.Auth, error) {
+	switch smtpConfig.authMechanism() {
+	case SMTPAuthNone:
+		return nil, nil
+	case SMTPAuthPlain:
+		return smtp.PlainAuth("", smtpConfig.SmtpUser, smtpConfig.SmtpPassword, hostname), nil
+	case SMTPAuthLogin:
+		return &loginAuth{username: smtpConfig.SmtpUser, password: smtpConfig.SmtpPassword}, nil
+	case SMTPAuthCRAMMD5:
+		return smtp.CRAMMD5Auth(smtpConfig.SmtpUser, smtpConfig.SmtpPassword), nil
+	}
+	return nil, fmt.Errorf("unknown smtp auth mechanism %s", smtpConfig.SmtpAuth)
+}
+
+// dial connects to the smtp server, greets and secures the connection depending on the mode
+func (smtpConfig SMTPConfiguration) dial() (*smtp.Client, error) {
+	hostname, _, err := net.SplitHostPort(smtpConfig.SmtpServer)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsconfig, err := smtpConfig.tlsConfig(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start the connection, implicit TLS is wrapping the connection from the first byte
+	dialer := &net.Dialer{Timeout: time.Second * 30}
+	var conn net.Conn
+	mode := strings.ToLower(smtpConfig.SmtpMode)
+	switch mode {
+	case SMTPModeTLS:
+		conn, err = tls.DialWithDialer(dialer, "tcp", smtpConfig.SmtpServer, tlsconfig)
+	case "", SMTPModeStartTLS, SMTPModeNone:
+		conn, err = dialer.Dial("tcp", smtpConfig.SmtpServer)
+	default:
+		return nil, fmt.Errorf("unknown smtp mode %s", smtpConfig.SmtpMode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(conn, hostname)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// say hello with the configured name
+	helo := smtpConfig.SmtpHelo
+	if helo == "" {
+		helo, err = os.Hostname()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if err = c.Hello(helo); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// Upgrade to TLS
+	if mode == "" || mode == SMTPModeStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("smtp server %s does not offer STARTTLS", smtpConfig.SmtpServer)
+		}
+		if err = c.StartTLS(tlsconfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// SendMailMessage sends out a mail message using the smtp configuration from command line
+func (smtpConfig SMTPConfiguration) SendMailMessage(m MailMessage) error {
+	// split server and port away
+	authHostName := strings.Split(smtpConfig.SmtpServer, ":")[0]
+	if len(authHostName) == 0 {
+		log.Println("No server name for smtp auth")
+		return fmt.Errorf("no server name for smtp auth, given %s", smtpConfig.SmtpServer)
+	}
+
+	// render the message before we talk to the server
+	message, err := smtpConfig.BuildMail(m, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// create smtp auth object
+	auth, err := smtpConfig.auth(authHostName)
+	if err != nil {
+		return err
+	}
+
+	// Start the connection
+	c, err := smtpConfig.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Send Auth
+	if auth != nil {
+		err = c.Auth(auth)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Mail(smtpConfig.SmtpSender)
+	if err != nil {
+		return err
+	}
+
+	err = c.Rcpt(m.Recipient)
+	if err != nil {
+		return err
+	}
+
+	/* data begins here */
+	wc, err := c.Data()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	/* output header and body lines */
+	if _, err = bytes.NewReader(message).WriteTo(wc); err != nil {
+		log.Println(err)
+		wc.Close()
+		return err
+	}
+
+	// and close the curtain
+	if err = wc.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// loginAuth implements the non-standard, but widely used LOGIN mechanism
+type loginAuth struct {
+	username, password string
+}
+
+// Start begins the LOGIN authentication without initial response
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+// Next answers the username and password challenges of the server
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:", "user name", "username":
+		return []byte(a.username), nil
+	case "password:", "password":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge for LOGIN: %s", fromServer)
+}
+
+// service mail in plain text
+const serviceMailText = `
+IP-Unfolded monitoring service notification
+
+{{if eq .StateName "UP"}}{{.Service.Name}} is UP and has recovered from an error or an unknown state.{{else if eq .StateName "DOWN"}}{{.Service.Name}} is DOWN and has encountered an error.{{else}}{{.Service.Name}} is in an UNKNOWN state, unfolded did not receive any check results lately or the state has been reset.{{end}}
+
+Type of Check: {{.Service.Type}}
+Checked: {{.Service.ToCheck}}
+
+Timepoint: {{.Result.Time}}
+Message: {{.Result.Message}}
+{{if .LastResults}}
+Last results per location:
+{{range .LastResults}}- {{.TestNode}}: {{.Status}} {{.Time.Format "2006-01-02 15:04:05"}} {{.Message}}
+{{end}}{{end}}{{if .ServerURL}}
+Acknowledge: {{.ServerURL}}/service_ack?id={{.Service.ServiceID}}
+Dashboard: {{.ServerURL}}/services
+{{end}}
+BR
+IP Unfolded
+`
+
+// service mail in html, with a colored banner for the state
+const serviceMailHTML = `<!DOCTYPE html>
+<html>
+<body style="margin:0;padding:0;font-family:Nunito,Arial,sans-serif;color:#3a3b45;">
+<div style="background-color:{{.StateColor}};color:#ffffff;padding:16px 24px;font-size:20px;font-weight:bold;">
+  {{.Service.Name}} is {{.StateName}}
+</div>
+<div style="padding:16px 24px;">
+  <table style="border-collapse:collapse;">
+    <tr><td style="padding:2px 12px 2px 0;"><strong>Type of Check</strong></td><td>{{.Service.Type}}</td></tr>
+    <tr><td style="padding:2px 12px 2px 0;"><strong>Checked</strong></td><td>{{.Service.ToCheck}}</td></tr>
+    <tr><td style="padding:2px 12px 2px 0;"><strong>Timepoint</strong></td><td>{{.Result.Time}}</td></tr>
+    <tr><td style="padding:2px 12px 2px 0;"><strong>Message</strong></td><td>{{.Result.Message}}</td></tr>
+  </table>
+  {{if .LastResults}}
+  <h4 style="margin:20px 0 8px 0;">Last results per location</h4>
+  <table style="border-collapse:collapse;width:100%;">
+    <tr style="background-color:#f8f9fc;">
+      <th style="text-align:left;padding:4px 8px;">Location</th>
+      <th style="text-align:left;padding:4px 8px;">Status</th>
+      <th style="text-align:left;padding:4px 8px;">Time</th>
+      <th style="text-align:left;padding:4px 8px;">Message</th>
+    </tr>
+    {{range .LastResults}}
+    <tr>
+      <td style="padding:4px 8px;">{{.TestNode}}</td>
+      <td style="padding:4px 8px;">{{.Status}}</td>
+      <td style="padding:4px 8px;">{{.Time.Format "2006-01-02 15:04:05"}}</td>
+      <td style="padding:4px 8px;">{{.Message}}</td>
+    </tr>
+    {{end}}
+  </table>
+  {{end}}
+  {{if .ServerURL}}
+  <p style="margin-top:24px;">
+    <a href="{{.ServerURL}}/service_ack?id={{.Service.ServiceID}}" style="background-color:#4e73df;color:#ffffff;padding:8px 16px;text-decoration:none;border-radius:4px;">Acknowledge</a>
+    &nbsp;
+    <a href="{{.ServerURL}}/services" style="background-color:#858796;color:#ffffff;padding:8px 16px;text-decoration:none;border-radius:4px;">Dashboard</a>
+  </p>
+  {{end}}
+  <p style="margin-top:24px;color:#858796;">BR<br>IP Unfolded</p>
+</div>
+</body>
+</html>
+`
+
+// SendServiceMail templates and prepares the mail for service related information
+func (smtpConfig SMTPConfiguration) SendServiceMail(n ServiceNotification, recipient string) error {
+	text, html, err := renderMail(serviceMailText, serviceMailHTML, n)
+	if err != nil {
+		return err
+	}
+
+	m := MailMessage{
+		Recipient: recipient,
+		Subject:   fmt.Sprintf("Your Service: %s is %s", n.Service.Name, n.StateName()),
+		Text:      text,
+		HTML:      html,
+		MessageID: n.MessageID,
+	}
+	// thread the mail below the mail, that opened the incident
+	if n.ThreadID != "" && n.ThreadID != n.MessageID {
+		m.InReplyTo = n.ThreadID
+		m.References = []string{n.ThreadID}
+	}
+
+	return smtpConfig.SendMailMessage(m)
+}
+
+// digest mail in plain text
+const digestMailText = `
+IP-Unfolded monitoring service notification
+
+{{len .Notifications}} services of the alert group {{.AlertGroup.GroupName}} changed their state: ` +
+	`{{.Count "DOWN"}} DOWN, {{.Count "UP"}} UP, {{.Count "UNKNOWN"}} UNKNOWN.
+{{range .Notifications}}
+- {{.Service.Name}} is {{.StateName}} ({{.Service.Type}} {{.Service.ToCheck}})
+  {{.Result.Time.Format "2006-01-02 15:04:05"}} {{.Result.TestNode}}: {{.Result.Message}}
+{{end}}{{if .ServerURL}}
+Dashboard: {{.ServerURL}}/services
+{{end}}
+BR
+IP Unfolded
+`
+
+// digest mail in html
+const digestMailHTML = `<!DOCTYPE html>
+<html>
+<body style="margin:0;padding:0;font-family:Nunito,Arial,sans-serif;color:#3a3b45;">
+<div style="background-color:{{.StateColor}};color:#ffffff;padding:16px 24px;font-size:20px;font-weight:bold;">
+  {{len .Notifications}} services of {{.AlertGroup.GroupName}} changed their state
+</div>
+<div style="padding:16px 24px;">
+  <p>{{.Count "DOWN"}} DOWN, {{.Count "UP"}} UP, {{.Count "UNKNOWN"}} UNKNOWN</p>
+  <table style="border-collapse:collapse;width:100%;">
+    <tr style="background-color:#f8f9fc;">
+      <th style="text-align:left;padding:4px 8px;">State</th>
+      <th style="text-align:left;padding:4px 8px;">Service</th>
+      <th style="text-align:left;padding:4px 8px;">Checked</th>
+      <th style="text-align:left;padding:4px 8px;">Time</th>
+      <th style="text-align:left;padding:4px 8px;">Message</th>
+    </tr>
+    {{range .Notifications}}
+    <tr>
+      <td style="padding:4px 8px;color:#ffffff;background-color:{{.StateColor}};">{{.StateName}}</td>
+      <td style="padding:4px 8px;">{{if $.ServerURL}}<a href="{{$.ServerURL}}/service_logs?id={{.Service.ServiceID}}">{{.Service.Name}}</a>{{else}}{{.Service.Name}}{{end}}</td>
+      <td style="padding:4px 8px;">{{.Service.Type}} {{.Service.ToCheck}}</td>
+      <td style="padding:4px 8px;">{{.Result.Time.Format "2006-01-02 15:04:05"}}</td>
+      <td style="padding:4px 8px;">{{.Result.TestNode}}: {{.Result.Message}}</td>
+    </tr>
+    {{end}}
+  </table>
+  {{if .ServerURL}}
+  <p style="margin-top:24px;">
+    <a href="{{.ServerURL}}/services" style="background-color:#858796;color:#ffffff;padding:8px 16px;text-decoration:none;border-radius:4px;">Dashboard</a>
+  </p>
+  {{end}}
+  <p style="margin-top:24px;color:#858796;">BR<br>IP Unfolded</p>
+</div>
+</body>
+</html>
+`
+
+// summary mail in plain text
+const summaryMailText = `
+IP-Unfolded daily summary for {{.AlertGroup.GroupName}}
+
+{{len .Logs}} events since {{.Since.Format "2006-01-02 15:04"}}
+{{range .Logs}}- {{.Date}} {{.Name}} ({{.ToCheck}}) {{.Status_From}} -> {{.Status_To}}: {{.Why}}
+{{end}}
+Current states: {{.Count "DOWN"}} DOWN, {{.Count "UP"}} UP, {{.Count "UNKNOWN"}} UNKNOWN
+{{range .Services}}- {{.StateName}} {{.Name}} ({{.Type}} {{.ToCheck}})
+{{end}}{{if .ServerURL}}
+Dashboard: {{.ServerURL}}/services
+{{end}}
+BR
+IP Unfolded
+`
+
+// summary mail in html
+const summaryMailHTML = `<!DOCTYPE html>
+<html>
+<body style="margin:0;padding:0;font-family:Nunito,Arial,sans-serif;color:#3a3b45;">
+<div style="background-color:#4e73df;color:#ffffff;padding:16px 24px;font-size:20px;font-weight:bold;">
+  Daily summary for {{.AlertGroup.GroupName}}
+</div>
+<div style="padding:16px 24px;">
+  <h4 style="margin:0 0 8px 0;">{{len .Logs}} events since {{.Since.Format "2006-01-02 15:04"}}</h4>
+  {{if .Logs}}
+  <table style="border-collapse:collapse;width:100%;">
+    <tr style="background-color:#f8f9fc;">
+      <th style="text-align:left;padding:4px 8px;">Date</th>
+      <th style="text-align:left;padding:4px 8px;">Service</th>
+      <th style="text-align:left;padding:4px 8px;">To</th>
+      <th style="text-align:left;padding:4px 8px;">Message</th>
+    </tr>
+    {{range .Logs}}
+    <tr>
+      <td style="padding:4px 8px;">{{.Date}}</td>
+      <td style="padding:4px 8px;">{{.Name}}</td>
+      <td style="padding:4px 8px;">{{.Status_To}}</td>
+      <td style="padding:4px 8px;">{{.Why}}</td>
+    </tr>
+    {{end}}
+  </table>
+  {{end}}
+  <h4 style="margin:20px 0 8px 0;">Current states: {{.Count "DOWN"}} DOWN, {{.Count "UP"}} UP, {{.Count "UNKNOWN"}} UNKNOWN</h4>
+  <table style="border-collapse:collapse;width:100%;">
+    {{range .Services}}
+    <tr>
+      <td style="padding:4px 8px;color:#ffffff;background-color:{{.StateColor}};">{{.StateName}}</td>
+      <td style="padding:4px 8px;">{{.Name}}</td>
+      <td style="padding:4px 8px;">{{.Type}} {{.ToCheck}}</td>
+    </tr>
+    {{end}}
+  </table>
+  {{if .ServerURL}}
+  <p style="margin-top:24px;">
+    <a href="{{.ServerURL}}/services" style="background-color:#858796;color:#ffffff;padding:8px 16px;text-decoration:none;border-radius:4px;">Dashboard</a>
+  </p>
+  {{end}}
+  <p style="margin-top:24px;color:#858796;">BR<br>IP Unfolded</p>
+</div>
+</body>
+</html>
+`
+
+// agent mail in plain text
+const agentMailText = `
+IP-Unfolded monitoring agent notification
+
+{{if .Problem}}The agent {{.Name}} in {{.Location}} {{.Problem}}.
+{{if .Down}}Results of the location {{.Location}} may be late or have wrong times.{{end}}
+{{else if .Down}}The agent {{.Name}} in {{.Location}} has not contacted the server for {{.Silence}}.
+Checks for the location {{.Location}} may not run anymore.{{else}}The agent {{.Name}} in {{.Location}} is back.{{end}}
+Last seen: {{.LastSeen.Format "2006-01-02 15:04:05 MST"}}
+{{if .ServerURL}}
+Dashboard: {{.ServerURL}}/services
+{{end}}
+BR
+IP Unfolded
+`
+
+// agent mail in html
+const agentMailHTML = `<!DOCTYPE html>
+<html>
+<body style="margin:0;padding:0;font-family:Nunito,Arial,sans-serif;color:#3a3b45;">
+<div style="background-color:{{.StateColor}};color:#ffffff;padding:16px 24px;font-size:20px;font-weight:bold;">
+  Agent {{.Name}} is {{.StateName}}
+</div>
+<div style="padding:16px 24px;">
+  {{if .Problem}}
+  <p>The agent <strong>{{.Name}}</strong> in <strong>{{.Location}}</strong> {{.Problem}}.
+    {{if .Down}}Results of the location {{.Location}} may be late or have wrong times.{{end}}</p>
+  {{else if .Down}}
+  <p>The agent <strong>{{.Name}}</strong> in <strong>{{.Location}}</strong> has not contacted the server for {{.Silence}}.
+    Checks for the location {{.Location}} may not run anymore.</p>
+  {{else}}
+  <p>The agent <strong>{{.Name}}</strong> in <strong>{{.Location}}</strong> is back.</p>
+  {{end}}
+  <p>Last seen: {{.LastSeen.Format "2006-01-02 15:04:05 MST"}}</p>
+  {{if .ServerURL}}
+  <p style="margin-top:24px;">
+    <a href="{{.ServerURL}}/services" style="background-color:#858796;color:#ffffff;padding:8px 16px;text-decoration:none;border-radius:4px;">Dashboard</a>
+  </p>
+  {{end}}
+  <p style="margin-top:24px;color:#858796;">BR<br>IP Unfolded</p>
+</div>
+</body>
+</html>
+`
+
+// renderMail executes the text and the html template against the content
+func renderMail(textMessage, htmlMessage string, content interface{}) (string, string, error) {
+	var text, html bytes.Buffer
+
+	// construct and execute the text template
+	textTmpl, err := texttemplate.New("Mail").Parse(textMessage)
+	if err != nil {
+		return "", "", err
+	}
+	err = textTmpl.Execute(&text, content)
+	if err != nil {
+		return "", "", err
+	}
+
+	// construct and execute the html template
+	htmlTmpl, err := template.New("Mail").Parse(htmlMessage)
+	if err != nil {
+		return "", "", err
+	}
+	err = htmlTmpl.Execute(&html, content)
+	if err != nil {
+		return "", "", err
+	}
+
+	return text.String(), html.String(), nil
+}
+
+// SendDigestMail templates and prepares a single mail for all transitions of the aggregation window
+func (smtpConfig SMTPConfiguration) SendDigestMail(d DigestNotification, recipient string) error {
+	text, html, err := renderMail(digestMailText, digestMailHTML, d)
+	if err != nil {
+		return err
+	}
+
+	return smtpConfig.SendMailMessage(MailMessage{
+		Recipient: recipient,
+		Subject: fmt.Sprintf("%s: %d DOWN, %d UP, %d UNKNOWN", d.AlertGroup.GroupName,
+			d.Count("DOWN"), d.Count("UP"), d.Count("UNKNOWN")),
+		Text: text,
+		HTML: html,
+	})
+}
+
+// SendSummaryMail templates and prepares the daily summary of an alert group
+func (smtpConfig SMTPConfiguration) SendSummaryMail(sn SummaryNotification, recipient string) error {
+	text, html, err := renderMail(summaryMailText, summaryMailHTML, sn)
+	if err != nil {
+		return err
+	}
+
+	return smtpConfig.SendMailMessage(MailMessage{
+		Recipient: recipient,
+		Subject:   fmt.Sprintf("Daily summary for %s: %d events, %d DOWN", sn.AlertGroup.GroupName, len(sn.Logs), sn.Count("DOWN")),
+		Text:      text,
+		HTML:      html,
+	})
+}
+
+// SendAgentMail templates and prepares the mail for a dead or recovered agent
+func (smtpConfig SMTPConfiguration) SendAgentMail(an AgentNotification, recipient string) error {
+	text, html, err := renderMail(agentMailText, agentMailHTML, an)
+	if err != nil {
+		return err
+	}
+
+	return smtpConfig.SendMailMessage(MailMessage{
+		Recipient: recipient,
+		Subject:   fmt.Sprintf("Agent %s (%s) is %s", an.Name, an.Location, an.StateName()),
+		Text:      text,
+		HTML:      html,
+	})
+}
+
+// SendPasswordForget templates and prepares the mail for the password forget function
+func (smtpConfig SMTPConfiguration) SendPasswordForget(recp, password, hash, serverurl string) error {
+	var body bytes.Buffer
+	var message string = `IP-Unfolded registration service
+
+Hello,
+
+Would you please follow and submit the webpage on the following link? Then we will assign a new password for ` +
+		`our monitoring service. The new password will be {{.P}}
+
+{{.U}}/forget2?hash={{.H}}
+
+BR
+IP Unfolded
+`
+
+	/* Custom template content */
+	type Content struct {
+		P string
+		H string
+		U string
+	}
+
+	// construct template
+	tmpl1, err := texttemplate.New("Mail").Parse(message)
+	if err != nil {
+		return err
+	}
+
+	// Execute
+	err = tmpl1.Execute(&body, Content{P: password, H: hash, U: serverurl})
+	if err != nil {
+		return err
+	}
+
+	err = smtpConfig.SendMail(fmt.Sprintf("Your login information for our website"), recp, body.String())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,350 @@
+package sattypes_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unfoldedip/sattypes"
+)
+
+// fakeSMTP is a tiny in-process smtp server, that records what the client did
+type fakeSMTP struct {
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	implicitTLS bool
+	user, pass  string
+
+	mutex    sync.Mutex
+	helo     string
+	usedTLS  bool
+	authMech string
+	authOK   bool
+	messages []string
+}
+
+// startFakeSMTP starts the server on a random local port
+func startFakeSMTP(t *testing.T, tlsConfig *tls.Config, implicitTLS bool) *fakeSMTP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSMTP{listener: listener, tlsConfig: tlsConfig, implicitTLS: implicitTLS, user: "unfolded", pass: "secret"}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// serve talks smtp on a single connection
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	isTLS := false
+	if f.implicitTLS {
+		conn = tls.Server(conn, f.tlsConfig)
+		isTLS = true
+	}
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			f.mutex.Lock()
+			f.helo = arg
+			f.mutex.Unlock()
+			tp.PrintfLine("250-fake greets %s", arg)
+			if f.tlsConfig != nil && !isTLS {
+				tp.PrintfLine("250-STARTTLS")
+			}
+			tp.PrintfLine("250 AUTH PLAIN LOGIN CRAM-MD5")
+		case "STARTTLS":
+			tp.PrintfLine("220 go ahead")
+			conn = tls.Server(conn, f.tlsConfig)
+			tp = textproto.NewConn(conn)
+			isTLS = true
+		case "AUTH":
+			if !f.auth(tp, arg) {
+				tp.PrintfLine("535 authentication failed")
+				continue
+			}
+			tp.PrintfLine("235 authenticated")
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			f.mutex.Lock()
+			f.usedTLS = isTLS
+			f.messages = append(f.messages, string(data))
+			f.mutex.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+// auth runs the exchange for all three mechanisms
+func (f *fakeSMTP) auth(tp *textproto.Conn, arg string) bool {
+	mech, initial, _ := strings.Cut(arg, " ")
+	mech = strings.ToUpper(mech)
+	f.mutex.Lock()
+	f.authMech = mech
+	f.mutex.Unlock()
+
+	// challenge sends a base64 challenge and returns the decoded answer
+	challenge := func(c string) string {
+		tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(c)))
+		line, _ := tp.ReadLine()
+		answer, _ := base64.StdEncoding.DecodeString(line)
+		return string(answer)
+	}
+
+	var ok bool
+	switch mech {
+	case "PLAIN":
+		decoded, _ := base64.StdEncoding.DecodeString(initial)
+		ok = string(decoded) == "\x00"+f.user+"\x00"+f.pass
+	case "LOGIN":
+		ok = challenge("Username:") == f.user && challenge("Password:") == f.pass
+	case "CRAM-MD5":
+		nonce := "<1896.697170952@fake>"
+		d := hmac.New(md5.New, []byte(f.pass))
+		d.Write([]byte(nonce))
+		ok = challenge(nonce) == f.user+" "+hex.EncodeToString(d.Sum(nil))
+	}
+
+	f.mutex.Lock()
+	f.authOK = ok
+	f.mutex.Unlock()
+	return ok
+}
+
+// certificates generates a CA and a server certificate for 127.0.0.1, the CA is written as PEM file
+func certificates(t *testing.T) (*tls.Config, string) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fake CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serverTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	serverDER, err := x509.CreateCertificate(rand.Reader, serverTemplate, caCert, &serverKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}}}, caFile
+}
+
+// Test the smtp modes and auth mechanisms against the fake server
+func TestSMTPTransport(t *testing.T) {
+	serverTLS, caFile := certificates(t)
+
+	tests := []struct {
+		name        string
+		implicitTLS bool
+		offerTLS    bool
+		config      sattypes.SMTPConfiguration
+		wantTLS     bool
+		wantMech    string
+		wantErr     bool
+	}{
+		{name: "plain relay", config: sattypes.SMTPConfiguration{SmtpMode: sattypes.SMTPModeNone}},
+		{name: "starttls plain", offerTLS: true, wantTLS: true, wantMech: "PLAIN",
+			config: sattypes.SMTPConfiguration{SmtpMode: sattypes.SMTPModeStartTLS, SmtpCAFile: caFile,
+				SmtpUser: "unfolded", SmtpPassword: "secret"}},
+		{name: "starttls cram-md5", offerTLS: true, wantTLS: true, wantMech: "CRAM-MD5",
+			config: sattypes.SMTPConfiguration{SmtpMode: sattypes.SMTPModeStartTLS, SmtpCAFile: caFile,
+				SmtpAuth: sattypes.SMTPAuthCRAMMD5, SmtpUser: "unfolded", SmtpPassword: "secret"}},
+		{name: "implicit tls login", implicitTLS: true, offerTLS: true, wantTLS: true, wantMech: "LOGIN",
+			config: sattypes.SMTPConfiguration{SmtpMode: sattypes.SMTPModeTLS, SmtpCAFile: caFile,
+				SmtpAuth: sattypes.SMTPAuthLogin, SmtpUser: "unfolded", SmtpPassword: "secret"}},
+		{name: "starttls unknown ca", offerTLS: true, wantErr: true,
+			config: sattypes.SMTPConfiguration{SmtpMode: sattypes.SMTPModeStartTLS}},
+		{name: "starttls insecure", offerTLS: true, wantTLS: true,
+			config: sattypes.SMTPConfiguration{SmtpMode: sattypes.SMTPModeStartTLS, SmtpInsecure: true}},
+		{name: "starttls not offered", wantErr: true,
+			config: sattypes.SMTPConfiguration{SmtpMode: sattypes.SMTPModeStartTLS}},
+		{name: "wrong password", offerTLS: true, wantTLS: true, wantMech: "LOGIN", wantErr: true,
+			config: sattypes.SMTPConfiguration{SmtpCAFile: caFile, SmtpAuth: sattypes.SMTPAuthLogin,
+				SmtpUser: "unfolded", SmtpPassword: "wrong"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tlsConfig *tls.Config
+			if tt.offerTLS {
+				tlsConfig = serverTLS
+			}
+			f := startFakeSMTP(t, tlsConfig, tt.implicitTLS)
+
+			config := tt.config
+			config.SmtpServer = f.listener.Addr().String()
+			config.SmtpSender = "unfolded@icmp.info"
+			config.SmtpHelo = "agent.icmp.info"
+
+			err := config.SendMail("Test", "ops@icmp.info", "Hello")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f.mutex.Lock()
+			defer f.mutex.Unlock()
+			if len(f.messages) != 1 {
+				t.Fatalf("expected one message, got %d", len(f.messages))
+			}
+			if f.helo != "agent.icmp.info" {
+				t.Errorf("HELO name is %s", f.helo)
+			}
+			if f.usedTLS != tt.wantTLS {
+				t.Errorf("TLS used %v, expected %v", f.usedTLS, tt.wantTLS)
+			}
+			if f.authMech != tt.wantMech || (tt.wantMech != "" && !f.authOK) {
+				t.Errorf("auth mechanism %s (ok %v), expected %s", f.authMech, f.authOK, tt.wantMech)
+			}
+			if !strings.Contains(f.messages[0], "Subject: Test") {
+				t.Errorf("message without subject: %s", f.messages[0])
+			}
+		})
+	}
+}
+
+// Test, when the configuration is complete
+func TestSMTPConfigured(t *testing.T) {
+	tests := []struct {
+		config sattypes.SMTPConfiguration
+		want   bool
+	}{
+		{sattypes.SMTPConfiguration{}, false},
+		{sattypes.SMTPConfiguration{SmtpServer: "localhost:25", SmtpSender: "a@b.c"}, true},
+		{sattypes.SMTPConfiguration{SmtpServer: "localhost:25", SmtpSender: "a@b.c", SmtpUser: "a"}, false},
+		{sattypes.SMTPConfiguration{SmtpServer: "localhost:25", SmtpSender: "a@b.c", SmtpUser: "a", SmtpPassword: "b"}, true},
+		{sattypes.SMTPConfiguration{SmtpServer: "localhost:25", SmtpSender: "a@b.c", SmtpAuth: "login"}, false},
+	}
+	for i, tt := range tests {
+		if got := tt.config.Configured(); got != tt.want {
+			t.Errorf("%d: Configured() = %v, expected %v", i, got, tt.want)
+		}
+	}
+}
+
+// Test the digest mail for many transitions of an alert group
+func TestSMTPDigest(t *testing.T) {
+	f := startFakeSMTP(t, nil, false)
+	config := sattypes.SMTPConfiguration{SmtpServer: f.listener.Addr().String(), SmtpSender: "unfolded@icmp.info",
+		SmtpMode: sattypes.SMTPModeNone}
+
+	digest := sattypes.DigestNotification{AlertGroup: sattypes.AlertGroup{GroupName: "Upstream"}, ServerURL: "http://localhost"}
+	for i, state := range []string{sattypes.ServiceDown, sattypes.ServiceDown, sattypes.ServiceUP} {
+		digest.Notifications = append(digest.Notifications, sattypes.ServiceNotification{
+			Service: sattypes.Service{ServiceID: int64(i), Name: "service", ServiceState: state},
+			Result:  sattypes.ServiceResult{ServiceID: int64(i), Status: state, Time: time.Now()},
+		})
+	}
+	if err := config.SendDigestMail(digest, "ops@icmp.info"); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.messages) != 1 || !strings.Contains(f.messages[0], "Subject: Upstream: 2 DOWN, 1 UP, 0 UNKNOWN") {
+		t.Errorf("unexpected digest mail %v", f.messages)
+	}
+}
+
+// Test the mail for dead agents
+func TestSMTPAgent(t *testing.T) {
+	f := startFakeSMTP(t, nil, false)
+	config := sattypes.SMTPConfiguration{SmtpServer: f.listener.Addr().String(), SmtpSender: "unfolded@icmp.info",
+		SmtpMode: sattypes.SMTPModeNone}
+
+	agent := sattypes.AgentNotification{Name: "muc1", Location: "Munich", Down: true, LastSeen: time.Now(),
+		Silence: time.Minute * 10}
+	if err := config.SendAgentMail(agent, "admin@icmp.info"); err != nil {
+		t.Fatal(err)
+	}
+
+	// heartbeats of an overloaded agent
+	agent.Problem = "is overloaded, checks start up to 45s late, limit 30s"
+	if err := config.SendAgentMail(agent, "admin@icmp.info"); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.messages) != 2 || !strings.Contains(f.messages[0], "Subject: Agent muc1 (Munich) is DOWN") {
+		t.Errorf("unexpected agent mail %v", f.messages)
+	}
+	if len(f.messages) == 2 && (!strings.Contains(f.messages[1], "Subject: Agent muc1 (Munich) is UNHEALTHY") ||
+		!strings.Contains(f.messages[1], "checks start up to 45s late")) {
+		t.Errorf("unexpected unhealthy agent mail %v", f.messages[1])
+	}
+}
@@ -0,0 +1,36 @@
+package sattypes
+
+import "time"
+
+// AnalyticsMetrics is a snapshot of the analytics thread for /metrics
+type AnalyticsMetrics struct {
+	// ReadMessages is the number of results handled by the analytics thread
+	ReadMessages int64
+	Services     []ServiceMetrics
+	Agents       []AgentMetrics
+	// Mails counts the sent and failed notification mails per kind, e.g. service or digest
+	Mails map[string]MailMetrics
+}
+
+// ServiceMetrics are the transitions and the last results of a service
+type ServiceMetrics struct {
+	ServiceID int64
+	// Transitions counts the state changes since the start of the server
+	Transitions int64
+	// LastResults holds the last result of every location
+	LastResults []ServiceResult
+}
+
+// AgentMetrics is the last contact of an agent
+type AgentMetrics struct {
+	Name     string
+	Location string
+	LastSeen time.Time
+	Down     bool
+}
+
+// MailMetrics counts sent and failed mails
+type MailMetrics struct {
+	Sent   int64
+	Failed int64
+}
@@ -0,0 +1,119 @@
+package sattypes
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// OpenAPISchemas collects the OpenAPI 3 schemas of Go types for components/schemas,
+// the properties are taken from the json tags, so the schemas follow the types
+type OpenAPISchemas map[string]any
+
+// openAPIRef is the prefix of references to components/schemas
+const openAPIRef = "#/components/schemas/"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Ref returns the schema for the type of v, named structs are added to the schemas and referenced
+func (s OpenAPISchemas) Ref(v any) map[string]any {
+	return s.schema(reflect.TypeOf(v))
+}
+
+// Object returns the schema of the struct v inline without adding it to the schemas
+func (s OpenAPISchemas) Object(v any) map[string]any {
+	return s.object(reflect.TypeOf(v))
+}
+
+// schema maps a Go type to its schema
+func (s OpenAPISchemas) schema(t reflect.Type) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		schema := s.schema(t.Elem())
+		schema["nullable"] = true
+		return schema
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Struct && t.Name() == "":
+		return s.object(t)
+	case t.Kind() == reflect.Struct:
+		name := OpenAPIName(t)
+		if _, ok := s[name]; !ok {
+			// reserve the name first for types referencing themselves
+			s[name] = nil
+			s[name] = s.object(t)
+		}
+		return map[string]any{"$ref": openAPIRef + name}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Float32:
+		return map[string]any{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return map[string]any{"type": "number", "format": "double"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	}
+	// interfaces and everything else can hold any value
+	return map[string]any{}
+}
+
+// object returns the schema of a struct, fields without omitempty are required
+func (s OpenAPISchemas) object(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	required := []string{}
+	s.fields(t, properties, &required)
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// fields adds the json fields of a struct to the properties, embedded structs are flattened like by encoding/json
+func (s OpenAPISchemas) fields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			s.fields(field.Type, properties, required)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = s.schema(field.Type)
+		if !strings.Contains(","+options+",", ",omitempty,") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// OpenAPIName returns the name of a type in components/schemas, e.g. Service or ApiError
+func OpenAPIName(t reflect.Type) string {
+	name := t.Name()
+	if name == "" {
+		return name
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
@@ -0,0 +1,81 @@
+package sattypes_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"unfoldedip/sattypes"
+)
+
+// Test the schemas of the api types against their json encoding
+func TestOpenAPISchemas(t *testing.T) {
+	schemas := sattypes.OpenAPISchemas{}
+	types := []any{sattypes.Service{}, sattypes.AlertGroup{}, sattypes.ServiceLog{}, sattypes.ServiceResult{}, sattypes.AnalyticsMetrics{}}
+	for _, v := range types {
+		name := reflect.TypeOf(v).Name()
+		if ref := schemas.Ref(v); ref["$ref"] != "#/components/schemas/"+name {
+			t.Errorf("Reference to %s is %v", name, ref)
+		}
+
+		// every field of the json encoding is a property
+		var encoded map[string]any
+		data, _ := json.Marshal(v)
+		if err := json.Unmarshal(data, &encoded); err != nil {
+			t.Fatal(err)
+		}
+		properties := schemas[name].(map[string]any)["properties"].(map[string]any)
+		for field := range encoded {
+			if _, ok := properties[field]; !ok {
+				t.Errorf("Schema of %s misses %s", name, field)
+			}
+		}
+		for property := range properties {
+			if _, ok := encoded[property]; !ok && !omitEmpty(reflect.TypeOf(v), property) {
+				t.Errorf("Schema of %s has %s, that is never encoded", name, property)
+			}
+		}
+	}
+
+	service := schemas["Service"].(map[string]any)
+	properties := service["properties"].(map[string]any)
+	for field, want := range map[string]string{"serviceid": "integer", "name": "string", "exists": "boolean", "lastseen": "string"} {
+		if got := properties[field].(map[string]any)["type"]; got != want {
+			t.Errorf("Type of %s is %v, shall be %s", field, got, want)
+		}
+	}
+	if properties["lastseen"].(map[string]any)["format"] != "date-time" {
+		t.Errorf("Format of lastseen is %v", properties["lastseen"])
+	}
+
+	// omitempty fields are optional
+	required := schemas["ServiceResult"].(map[string]any)["required"].([]string)
+	for _, field := range required {
+		if field == "reason" || field == "latency" {
+			t.Errorf("Optional field %s is required", field)
+		}
+	}
+
+	// all references resolve
+	data, err := json.Marshal(schemas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range strings.Split(string(data), `"$ref":"#/components/schemas/`)[1:] {
+		name := part[:strings.Index(part, `"`)]
+		if schemas[name] == nil {
+			t.Errorf("Reference to %s does not resolve", name)
+		}
+	}
+}
+
+// omitEmpty returns true, if the field of the json name has the omitempty option
+func omitEmpty(t reflect.Type, name string) bool {
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("json")
+		if strings.HasPrefix(tag, name+",") && strings.Contains(tag, "omitempty") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package sattypes
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// rotationTimeFormat is the format for handoff and override times, local to the rotation time zone
+const rotationTimeFormat = "2006-01-02 15:04"
+
+// Rotation is an on-call rotation, the members take turns for LengthDays each,
+// starting with the first member at Handoff
+type Rotation struct {
+	RotationID int64  `json:"rotationid"`
+	OwnerID    int64  `json:"ownerid"`
+	Name       string `json:"name"`
+	// Members is the ordered, comma separated list of emails
+	Members    string `json:"members"`
+	Handoff    string `json:"handoff"`
+	LengthDays int    `json:"lengthdays"`
+	TimeZone   string `json:"timezone"`
+}
+
+// RotationOverride replaces the on-call member of a rotation between Start and End
+type RotationOverride struct {
+	OverrideID int64  `json:"overrideid"`
+	RotationID int64  `json:"rotationid"`
+	Email      string `json:"email"`
+	Start      string `json:"start"`
+	End        string `json:"end"`
+}
+
+// RotationStatus is used for presenting a rotation with the current and next on-call member
+type RotationStatus struct {
+	Rotation
+	OnCall      string
+	Next        string
+	NextHandoff time.Time
+}
+
+// MemberList returns the cleaned up emails of the members in order
+func (r Rotation) MemberList() []string {
+	var members []string
+	for _, email := range strings.Split(r.Members, ",") {
+		email = strings.TrimSpace(email)
+		if email != "" {
+			members = append(members, email)
+		}
+	}
+	return members
+}
+
+// Validate checks members, handoff, length and time zone of the rotation
+func (r Rotation) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rotation name cant be empty")
+	}
+	members := r.MemberList()
+	if len(members) == 0 {
+		return fmt.Errorf("rotation needs at least one member")
+	}
+	for _, email := range members {
+		if _, err := mail.ParseAddress(email); err != nil {
+			return fmt.Errorf("invalid member %s", email)
+		}
+	}
+	if r.LengthDays < 1 {
+		return fmt.Errorf("rotation length must be at least one day")
+	}
+	loc, err := time.LoadLocation(r.TimeZone)
+	if err != nil {
+		return fmt.Errorf("unknown time zone %s", r.TimeZone)
+	}
+	if _, err := time.ParseInLocation(rotationTimeFormat, r.Handoff, loc); err != nil {
+		return fmt.Errorf("invalid handoff %s", r.Handoff)
+	}
+	return nil
+}
+
+// location returns the time zone of the rotation, UTC on errors
+func (r Rotation) location() *time.Location {
+	loc, err := time.LoadLocation(r.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// shift returns the number of the shift at t and its start, shifts before the first handoff are negative
+func (r Rotation) shift(t time.Time) (int, time.Time, bool) {
+	start, err := time.ParseInLocation(rotationTimeFormat, r.Handoff, r.location())
+	if err != nil || r.LengthDays < 1 {
+		return 0, time.Time{}, false
+	}
+	// estimate and correct by calendar days, so daylight saving keeps the handoff hour
+	n := int(t.Sub(start).Hours() / 24 / float64(r.LengthDays))
+	for !start.AddDate(0, 0, (n+1)*r.LengthDays).After(t) {
+		n++
+	}
+	for start.AddDate(0, 0, n*r.LengthDays).After(t) {
+		n--
+	}
+	return n, start.AddDate(0, 0, n*r.LengthDays), true
+}
+
+// member returns the member for the shift number
+func (r Rotation) member(n int) string {
+	members := r.MemberList()
+	if len(members) == 0 {
+		return ""
+	}
+	return members[(n%len(members)+len(members))%len(members)]
+}
+
+// OnCall returns the member on call at t, the latest matching override wins
+func (r Rotation) OnCall(t time.Time, overrides []RotationOverride) string {
+	for i := len(overrides) - 1; i >= 0; i-- {
+		if overrides[i].RotationID == r.RotationID && overrides[i].covers(t, r.location()) {
+			return overrides[i].Email
+		}
+	}
+	n, _, ok := r.shift(t)
+	if !ok {
+		return ""
+	}
+	return r.member(n)
+}
+
+// NextHandoff returns the time of the next regular handoff after t
+func (r Rotation) NextHandoff(t time.Time) time.Time {
+	_, start, ok := r.shift(t)
+	if !ok {
+		return time.Time{}
+	}
+	return start.AddDate(0, 0, r.LengthDays)
+}
+
+// Status returns the rotation with the current and next on-call member at t
+func (r Rotation) Status(t time.Time, overrides []RotationOverride) RotationStatus {
+	status := RotationStatus{Rotation: r, OnCall: r.OnCall(t, overrides), NextHandoff: r.NextHandoff(t)}
+	if !status.NextHandoff.IsZero() {
+		status.Next = r.OnCall(status.NextHandoff, overrides)
+	}
+	return status
+}
+
+// Validate checks member and times of the override
+func (o RotationOverride) Validate(r Rotation) error {
+	if _, err := mail.ParseAddress(o.Email); err != nil {
+		return fmt.Errorf("invalid email %s", o.Email)
+	}
+	start, err := time.ParseInLocation(rotationTimeFormat, o.Start, r.location())
+	if err != nil {
+		return fmt.Errorf("invalid start %s", o.Start)
+	}
+	end, err := time.ParseInLocation(rotationTimeFormat, o.End, r.location())
+	if err != nil {
+		return fmt.Errorf("invalid end %s", o.End)
+	}
+	if !end.After(start) {
+		return fmt.Errorf("end of the override must be after its start")
+	}
+	return nil
+}
+
+// covers returns true, if t is inside the override
+func (o RotationOverride) covers(t time.Time, loc *time.Location) bool {
+	start, err := time.ParseInLocation(rotationTimeFormat, o.Start, loc)
+	if err != nil {
+		return false
+	}
+	end, err := time.ParseInLocation(rotationTimeFormat, o.End, loc)
+	if err != nil {
+		return false
+	}
+	return !t.Before(start) && t.Before(end)
+}
@@ -0,0 +1,61 @@
+package sattypes_test
+
+import (
+	"testing"
+	"time"
+	"unfoldedip/sattypes"
+)
+
+// Test weekly rotations, daylight saving and overrides
+func TestRotation(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+
+	// 2026-10-05 is a Monday, daylight saving ends on 2026-10-25
+	rotation := sattypes.Rotation{RotationID: 1, Name: "ops", Members: "a@example.com, b@example.com,c@example.com",
+		Handoff: "2026-10-05 09:00", LengthDays: 7, TimeZone: "Europe/Berlin"}
+	if err := rotation.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	overrides := []sattypes.RotationOverride{
+		{RotationID: 1, Email: "d@example.com", Start: "2026-10-14 00:00", End: "2026-10-15 00:00"},
+	}
+
+	tests := []struct {
+		name   string
+		now    time.Time
+		onCall string
+		next   time.Time
+	}{
+		{"first shift", time.Date(2026, 10, 5, 9, 0, 0, 0, berlin), "a@example.com",
+			time.Date(2026, 10, 12, 9, 0, 0, 0, berlin)},
+		{"before handoff", time.Date(2026, 10, 12, 8, 59, 0, 0, berlin), "a@example.com",
+			time.Date(2026, 10, 12, 9, 0, 0, 0, berlin)},
+		{"second shift", time.Date(2026, 10, 12, 9, 0, 0, 0, berlin), "b@example.com",
+			time.Date(2026, 10, 19, 9, 0, 0, 0, berlin)},
+		{"override", time.Date(2026, 10, 14, 12, 0, 0, 0, berlin), "d@example.com",
+			time.Date(2026, 10, 19, 9, 0, 0, 0, berlin)},
+		{"after daylight saving", time.Date(2026, 10, 26, 8, 30, 0, 0, berlin), "c@example.com",
+			time.Date(2026, 10, 26, 9, 0, 0, 0, berlin)},
+		{"wrapped around", time.Date(2026, 10, 26, 9, 0, 0, 0, berlin), "a@example.com",
+			time.Date(2026, 11, 2, 9, 0, 0, 0, berlin)},
+		{"before the first handoff", time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC), "c@example.com",
+			time.Date(2026, 10, 5, 9, 0, 0, 0, berlin)},
+	}
+
+	for _, tt := range tests {
+		if onCall := rotation.OnCall(tt.now, overrides); onCall != tt.onCall {
+			t.Errorf("%s: on call %s, want %s", tt.name, onCall, tt.onCall)
+		}
+		if next := rotation.NextHandoff(tt.now); !next.Equal(tt.next) {
+			t.Errorf("%s: next handoff %s, want %s", tt.name, next, tt.next)
+		}
+	}
+
+	status := rotation.Status(time.Date(2026, 10, 13, 12, 0, 0, 0, berlin), overrides)
+	if status.OnCall != "b@example.com" || status.Next != "c@example.com" {
+		t.Errorf("status on call %s next %s", status.OnCall, status.Next)
+	}
+}
@@ -0,0 +1,137 @@
+package sattypes
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Service severities, only critical services notify outside the schedule of a recipient
+const (
+	SeverityNormal   = "normal"
+	SeverityCritical = "critical"
+)
+
+// NotificationSchedule is a window, in which a member of an alert group wants to receive
+// notifications, a member can have several windows
+type NotificationSchedule struct {
+	ScheduleID int64  `json:"scheduleid"`
+	ContactID  int64  `json:"contactid"`
+	Email      string `json:"email"`
+	TimeZone   string `json:"timezone"`
+	// Days is a comma separated list of weekdays, 0 = Sunday
+	Days string `json:"days"`
+	// Start and End as 15:04, an end before the start is spanning midnight
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// weekdayNames is used for printing the days of a schedule
+var weekdayNames = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// Validate checks time zone, days and times of the schedule
+func (ns NotificationSchedule) Validate() error {
+	if _, err := time.LoadLocation(ns.TimeZone); err != nil {
+		return fmt.Errorf("unknown time zone %s", ns.TimeZone)
+	}
+	if len(ns.weekdays()) == 0 {
+		return fmt.Errorf("no days of week given")
+	}
+	if _, err := time.Parse("15:04", ns.Start); err != nil {
+		return fmt.Errorf("invalid start time %s", ns.Start)
+	}
+	if _, err := time.Parse("15:04", ns.End); err != nil {
+		return fmt.Errorf("invalid end time %s", ns.End)
+	}
+	return nil
+}
+
+// DayNames returns the weekdays of the schedule as readable names
+func (ns NotificationSchedule) DayNames() string {
+	var names []string
+	days := ns.weekdays()
+	for day := range weekdayNames {
+		if days[time.Weekday(day)] {
+			names = append(names, weekdayNames[day])
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// weekdays parses the days into a lookup table
+func (ns NotificationSchedule) weekdays() map[time.Weekday]bool {
+	days := make(map[time.Weekday]bool)
+	for _, day := range strings.Split(ns.Days, ",") {
+		val, err := strconv.Atoi(strings.TrimSpace(day))
+		if err == nil && val >= 0 && val <= 6 {
+			days[time.Weekday(val)] = true
+		}
+	}
+	return days
+}
+
+// window returns start and end of the window, that opens on the day of t
+func (ns NotificationSchedule) window(t time.Time) (time.Time, time.Time, bool) {
+	start, err := time.Parse("15:04", ns.Start)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	end, err := time.Parse("15:04", ns.End)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	windowStart := time.Date(t.Year(), t.Month(), t.Day(), start.Hour(), start.Minute(), 0, 0, t.Location())
+	windowEnd := time.Date(t.Year(), t.Month(), t.Day(), end.Hour(), end.Minute(), 0, 0, t.Location())
+	if !windowEnd.After(windowStart) {
+		windowEnd = windowEnd.AddDate(0, 0, 1)
+	}
+	return windowStart, windowEnd, true
+}
+
+// location returns the time zone of the schedule, UTC on errors
+func (ns NotificationSchedule) location() *time.Location {
+	loc, err := time.LoadLocation(ns.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// InWindow returns true, if t is inside the schedule
+func (ns NotificationSchedule) InWindow(t time.Time) bool {
+	t = t.In(ns.location())
+	days := ns.weekdays()
+	// a window of yesterday could span midnight
+	for _, day := range []time.Time{t.AddDate(0, 0, -1), t} {
+		if !days[day.Weekday()] {
+			continue
+		}
+		start, end, ok := ns.window(day)
+		if ok && !t.Before(start) && t.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextWindow returns the start of the next window after t, t itself if inside a window
+func (ns NotificationSchedule) NextWindow(t time.Time) time.Time {
+	if ns.InWindow(t) {
+		return t
+	}
+	local := t.In(ns.location())
+	days := ns.weekdays()
+	for i := 0; i <= 7; i++ {
+		day := local.AddDate(0, 0, i)
+		if !days[day.Weekday()] {
+			continue
+		}
+		start, _, ok := ns.window(day)
+		if ok && start.After(local) {
+			return start
+		}
+	}
+	// broken schedule, do not hold back the notification
+	return t
+}
@@ -0,0 +1,56 @@
+package sattypes_test
+
+import (
+	"testing"
+	"time"
+	"unfoldedip/sattypes"
+)
+
+// Test working hours and windows spanning midnight
+func TestNotificationSchedule(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+
+	workingHours := sattypes.NotificationSchedule{TimeZone: "Europe/Berlin", Days: "1,2,3,4,5", Start: "08:00", End: "18:00"}
+	nightShift := sattypes.NotificationSchedule{TimeZone: "UTC", Days: "5", Start: "22:00", End: "06:00"}
+
+	// 2026-10-16 is a Friday
+	tests := []struct {
+		name     string
+		schedule sattypes.NotificationSchedule
+		now      time.Time
+		inWindow bool
+		next     time.Time
+	}{
+		{"friday noon", workingHours, time.Date(2026, 10, 16, 12, 0, 0, 0, berlin), true,
+			time.Date(2026, 10, 16, 12, 0, 0, 0, berlin)},
+		{"friday night", workingHours, time.Date(2026, 10, 16, 3, 0, 0, 0, berlin), false,
+			time.Date(2026, 10, 16, 8, 0, 0, 0, berlin)},
+		{"friday evening", workingHours, time.Date(2026, 10, 16, 18, 0, 0, 0, berlin), false,
+			time.Date(2026, 10, 19, 8, 0, 0, 0, berlin)},
+		{"saturday in utc", workingHours, time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC), false,
+			time.Date(2026, 10, 19, 8, 0, 0, 0, berlin)},
+		{"night shift after midnight", nightShift, time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC), true,
+			time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)},
+		{"night shift over", nightShift, time.Date(2026, 10, 17, 7, 0, 0, 0, time.UTC), false,
+			time.Date(2026, 10, 23, 22, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		if got := tt.schedule.InWindow(tt.now); got != tt.inWindow {
+			t.Errorf("%s: InWindow() = %v, expected %v", tt.name, got, tt.inWindow)
+		}
+		if got := tt.schedule.NextWindow(tt.now); !got.Equal(tt.next) {
+			t.Errorf("%s: NextWindow() = %v, expected %v", tt.name, got, tt.next)
+		}
+	}
+
+	if workingHours.DayNames() != "Mon, Tue, Wed, Thu, Fri" {
+		t.Errorf("DayNames() = %s", workingHours.DayNames())
+	}
+	if err := (sattypes.NotificationSchedule{TimeZone: "Nowhere/City", Days: "1", Start: "08:00", End: "09:00"}).Validate(); err == nil {
+		t.Error("expected an error for an unknown time zone")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+// unfoldedip (C) 2021 by Jörg Kost, jk@ip-clear.de
+// MIT License
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// serverTLS holds the command line arguments for the native TLS listener
+type serverTLS struct {
+	// certificate and key files
+	CertFile, KeyFile string
+	// ACME mode, certificates are obtained and renewed for the host of the serverurl
+	ACME bool
+	// ACME directory, empty for Let's Encrypt
+	ACMEDirectory string
+	// PEM file with the CA of the ACME directory, e.g. for Pebble
+	ACMECA string
+	// directory for caching account and certificates
+	ACMECache string
+	// contact email for the ACME account
+	ACMEEmail string
+	// listener for redirecting HTTP to HTTPS and ACME http-01 challenges, empty for disabling
+	Redirect string
+}
+
+// enabled returns true, if the web panel is served with TLS
+func (t serverTLS) enabled() bool {
+	return t.ACME || t.CertFile != ""
+}
+
+// setup configures TLS for the server of the web panel and returns the optional redirect server
+func (t serverTLS) setup(server *http.Server, serverURL string) (*http.Server, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil || u.Hostname() == "" {
+		return nil, fmt.Errorf("serverurl %s has no host", serverURL)
+	}
+	if u.Scheme != "https" {
+		log.Println("satserver: serverurl", serverURL, "does not start with https, agents and mails will use plain HTTP")
+	}
+
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	var redirect http.Handler = redirectHandler(u.Host)
+
+	if t.ACME {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(t.ACMECache),
+			HostPolicy: autocert.HostWhitelist(u.Hostname()),
+			Email:      t.ACMEEmail,
+		}
+		if t.ACMEDirectory != "" {
+			manager.Client = &acme.Client{DirectoryURL: t.ACMEDirectory}
+			if t.ACMECA != "" {
+				manager.Client.HTTPClient, err = acmeHTTPClient(t.ACMECA)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		// tls-alpn-01 challenges are answered by the TLS listener, http-01 by the redirect listener
+		server.TLSConfig = manager.TLSConfig()
+		server.TLSConfig.MinVersion = tls.VersionTLS12
+		redirect = manager.HTTPHandler(redirect)
+	}
+
+	if t.Redirect == "" {
+		return nil, nil
+	}
+	return &http.Server{Addr: t.Redirect, Handler: redirect}, nil
+}
+
+// listenAndServe starts the TLS listener of the web panel
+func (t serverTLS) listenAndServe(server *http.Server) error {
+	log.Println("satserver: Starting TLS listener on", server.Addr)
+	if t.ACME {
+		// certificates are fetched by the autocert manager
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServeTLS(t.CertFile, t.KeyFile)
+}
+
+// redirectHandler sends every request to the same path on the HTTPS host
+func redirectHandler(host string) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.Redirect(writer, request, "https://"+host+request.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// acmeHTTPClient returns a client, that trusts the CA of a local ACME directory
+func acmeHTTPClient(caFile string) (*http.Client, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport, Timeout: time.Second * 30}, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test, that the redirect listener keeps path and query
+func TestRedirectHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	redirectHandler("unfolded.test:5001").ServeHTTP(recorder, httptest.NewRequest("GET", "http://unfolded.test/services?id=1", nil))
+	if recorder.Code != http.StatusMovedPermanently || recorder.Header().Get("Location") != "https://unfolded.test:5001/services?id=1" {
+		t.Errorf("Redirect answered %d to %q", recorder.Code, recorder.Header().Get("Location"))
+	}
+}
+
+// Test the setup of the TLS listener and the redirect listener
+func TestTLSSetup(t *testing.T) {
+	for _, serverURL := range []string{"", "https://", "https:///services", "unfolded.test:5001", "://unfolded.test"} {
+		if _, err := (serverTLS{CertFile: "server.crt"}).setup(&http.Server{}, serverURL); err == nil {
+			t.Errorf("Serverurl %q without host accepted", serverURL)
+		}
+	}
+
+	// certificate files, no redirect listener
+	server := &http.Server{}
+	redirect, err := (serverTLS{CertFile: "server.crt", KeyFile: "server.key"}).setup(server, "https://unfolded.test:5001")
+	if err != nil || redirect != nil || server.TLSConfig == nil || server.TLSConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Setup returned %v, %v and config %+v", redirect, err, server.TLSConfig)
+	}
+
+	// ACME answers the http-01 challenges on the redirect listener and redirects everything else
+	config := serverTLS{ACME: true, ACMECache: t.TempDir(), ACMEDirectory: "https://localhost:14000/dir", Redirect: "127.0.0.1:0"}
+	server = &http.Server{}
+	redirect, err = config.setup(server, "https://unfolded.test:5001")
+	if err != nil || redirect == nil || redirect.Addr != "127.0.0.1:0" {
+		t.Fatalf("ACME setup returned %v and %v", redirect, err)
+	}
+	if server.TLSConfig.GetCertificate == nil || server.TLSConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("ACME setup has config %+v", server.TLSConfig)
+	}
+	recorder := httptest.NewRecorder()
+	redirect.Handler.ServeHTTP(recorder, httptest.NewRequest("GET", "http://unfolded.test/login", nil))
+	if recorder.Header().Get("Location") != "https://unfolded.test:5001/login" {
+		t.Errorf("ACME redirect answered %d to %q", recorder.Code, recorder.Header().Get("Location"))
+	}
+
+	// a broken CA of the ACME directory stops the start
+	config.ACMECA = filepath.Join(t.TempDir(), "missing.pem")
+	if _, err = config.setup(&http.Server{}, "https://unfolded.test:5001"); err == nil {
+		t.Error("Missing ACME CA accepted")
+	}
+}
+
+// Test the client for an ACME directory with its own CA
+func TestACMEHTTPClient(t *testing.T) {
+	directory := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte(`{}`))
+	}))
+	defer directory.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: directory.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	client, err := acmeHTTPClient(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Get(directory.URL)
+	if err != nil {
+		t.Fatalf("Client does not trust the CA of the file: %v", err)
+	}
+	response.Body.Close()
+
+	// files without certificates fail
+	empty := filepath.Join(dir, "empty.pem")
+	if err = os.WriteFile(empty, []byte("no certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{empty, filepath.Join(dir, "missing.pem")} {
+		if _, err = acmeHTTPClient(file); err == nil {
+			t.Errorf("CA file %s accepted", file)
+		}
+	}
+}
+
+// Test obtaining a certificate from a local Pebble, skipped without PEBBLE_DIRECTORY,
+// e.g. PEBBLE_DIRECTORY=https://localhost:14000/dir PEBBLE_CA=test/certs/pebble.minica.pem with Pebble
+// validating http-01 on port 5002 and tls-alpn-01 on port 5001 of PEBBLE_HOST (default localhost)
+func TestACMEPebble(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY is not set")
+	}
+	host := os.Getenv("PEBBLE_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+
+	config := serverTLS{ACME: true, ACMEDirectory: directory, ACMECA: os.Getenv("PEBBLE_CA"), ACMECache: t.TempDir(),
+		Redirect: ":5002"}
+	server := &http.Server{Addr: ":5001", Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write([]byte("unfolded"))
+	})}
+	redirect, err := config.setup(server, "https://"+host+":5001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = config.listenAndServe(server) }()
+	go func() { _ = redirect.ListenAndServe() }()
+	defer server.Close()
+	defer redirect.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	// the certificate is issued by Pebble on the first handshake, its roots change on every start of Pebble
+	dialer := &tls.Dialer{Config: &tls.Config{ServerName: host, InsecureSkipVerify: true}}
+	conn, err := dialer.Dial("tcp", "127.0.0.1:5001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	certificate := conn.(*tls.Conn).ConnectionState().PeerCertificates[0]
+	if err = certificate.VerifyHostname(host); err != nil {
+		t.Error(err)
+	}
+	if certificate.Issuer.String() == certificate.Subject.String() {
+		t.Errorf("Certificate for %s is self-signed", host)
+	}
+}
@@ -1,8 +1,14 @@
 package main_test
 
 import (
+	"bytes"
 	"database/sql"
 	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
 	"testing"
 	"time"
 	"unfoldedip/satanalytics"
@@ -14,9 +20,9 @@ func TestTemplates(t *testing.T) {
 	templates := []string{
 		"base.html",
 		"service_add.html",
-		"alertgroups.html", "alertgroup_add.html",
+		"alertgroups.html", "alertgroup_add.html", "rotations.html", "rotation_add.html", "satagents.html",
 		"profile.html", "register.html", "login.html",
-		"services.html", "service_add.html",
+		"services.html", "service_add.html", "service_ack.html",
 	}
 	for _, v := range templates {
 		temp, err := template.New("test").ParseFiles("templates/" + v)
@@ -37,10 +43,70 @@ func TestSMTPConnection(t *testing.T) {
 	SMTPConfig.SmtpUser = "unfolded"
 	SMTPConfig.SmtpPassword = "jg4u4huru"
 	SMTPConfig.SmtpSender = "unfolded@icmp.info"
-	SMTPConfig.SendServiceMail(sattypes.Service{ServiceID: 100, Type: "ping", Name: "Test-Service", ServiceState: sattypes.ServiceUP},
-		sattypes.ServiceResult{ServiceID: 100, Message: "OK"}, "@")
-	SMTPConfig.SendServiceMail(sattypes.Service{ServiceID: 100, Type: "ping", Name: "Test-Service", ServiceState: sattypes.ServiceDown},
-		sattypes.ServiceResult{ServiceID: 100, Message: "NOT OK"}, "@")
+	SMTPConfig.SendServiceMail(sattypes.ServiceNotification{
+		Service: sattypes.Service{ServiceID: 100, Type: "ping", Name: "Test-Service", ServiceState: sattypes.ServiceUP},
+		Result:  sattypes.ServiceResult{ServiceID: 100, Message: "OK"}}, "@")
+	SMTPConfig.SendServiceMail(sattypes.ServiceNotification{
+		Service: sattypes.Service{ServiceID: 100, Type: "ping", Name: "Test-Service", ServiceState: sattypes.ServiceDown},
+		Result:  sattypes.ServiceResult{ServiceID: 100, Message: "NOT OK"}}, "@")
+}
+
+// Test MIME mail rendering
+func TestMailMIME(t *testing.T) {
+	var SMTPConfig sattypes.SMTPConfiguration
+	SMTPConfig.SmtpSender = "unfolded@icmp.info"
+
+	threadID := SMTPConfig.NewMessageID()
+	raw, err := SMTPConfig.BuildMail(sattypes.MailMessage{
+		Recipient:  "ops@icmp.info",
+		Subject:    "Your Service: Prüfung is UP",
+		Text:       "plain",
+		HTML:       "<b>html</b>",
+		InReplyTo:  threadID,
+		References: []string{threadID},
+	}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// decoded subject shall match the original one
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Your Service: Prüfung is UP" {
+		t.Errorf("Subject not encoded right: %s %v", msg.Header.Get("Subject"), err)
+	}
+	if msg.Header.Get("Message-ID") == "" || !strings.HasSuffix(msg.Header.Get("Message-ID"), "@icmp.info>") {
+		t.Errorf("Message-ID missing or wrong: %s", msg.Header.Get("Message-ID"))
+	}
+	if msg.Header.Get("In-Reply-To") != threadID || msg.Header.Get("References") != threadID {
+		t.Errorf("Threading headers are wrong: %s %s", msg.Header.Get("In-Reply-To"), msg.Header.Get("References"))
+	}
+
+	// walk the parts, expect text first and html last
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type is %s, %v", mediaType, err)
+	}
+	var partTypes []string
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		partType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		partTypes = append(partTypes, partType)
+	}
+	if len(partTypes) != 2 || partTypes[0] != "text/plain" || partTypes[1] != "text/html" {
+		t.Errorf("Unexpected mime parts %v", partTypes)
+	}
 }
 
 // Test sat analytics thread
@@ -59,7 +125,8 @@ func TestAnalyticsThread(t *testing.T) {
 	// create Channel
 	sattypes.ResultsChannel = make(chan sattypes.ServiceResult, 100)
 	// send message to analytics
-	sattypes.ResultsChannel <- sattypes.ServiceResult{ServiceID: 99, Status: sattypes.ServiceUP, Message: "OK"}
+	sattypes.ResultsChannel <- sattypes.ServiceResult{ServiceID: 99, Status: sattypes.ServiceUP, Message: "OK",
+		TestNode: "Munich", Latency: 0.25}
 	// create Analytics thread
 	satAnalytics := satanalytics.CreateSatAnalytics("main", BaseHandler)
 
@@ -79,4 +146,18 @@ func TestAnalyticsThread(t *testing.T) {
 		t.Errorf("Tracker for Service ID %d does not exist", 99)
 	}
 
+	// the metrics shall contain the last result of the location
+	metrics := satAnalytics.Metrics()
+	if metrics.ReadMessages != 1 {
+		t.Errorf("Read Messages of the metrics shall be %d, but it is %d", 1, metrics.ReadMessages)
+	}
+	var found bool
+	for _, service := range metrics.Services {
+		if service.ServiceID == 99 && len(service.LastResults) == 1 && service.LastResults[0].Latency == 0.25 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Metrics for Service ID %d are missing the last result: %+v", 99, metrics.Services)
+	}
 }